@@ -0,0 +1,170 @@
+package dynproxy
+
+import (
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+const (
+	acceptBatchSize   = 64
+	minAcceptBackoff  = 10 * time.Millisecond
+	maxAcceptBackoff  = time.Second
+	acceptReservePath = "/dev/null"
+)
+
+// acceptor accepts the connections of the listening socket on the event loop thread. The reserve fd is
+// released when the process runs out of fds, so the pending connection can be accepted and closed instead
+// of spinning on the listener which stays readable.
+type acceptor struct {
+	name        string
+	fd          int
+	reserveFd   int
+	loop        *EventLoop
+	onAccept    func(conn *fdConn)
+	backoff     time.Duration
+	resumeTimer *Timer
+	closed      bool
+}
+
+func newAcceptor(loop *EventLoop, name string, fd int, onAccept func(conn *fdConn)) (*acceptor, error) {
+	reserveFd, err := openReserveFd()
+	if err != nil {
+		return nil, err
+	}
+	return &acceptor{
+		name:      name,
+		fd:        fd,
+		reserveFd: reserveFd,
+		loop:      loop,
+		onAccept:  onAccept,
+	}, nil
+}
+
+func openReserveFd() (int, error) {
+	fd, err := unix.Open(acceptReservePath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("open", err)
+	}
+	return fd, nil
+}
+
+// accept Accepts the batch of the pending connections, the rest is accepted on the next loop iteration.
+func (a *acceptor) accept() {
+	if a.closed || a.resumeTimer.Active() {
+		return
+	}
+	if poller, ok := a.loop.poller.(acceptPoller); ok {
+		results, multishot := poller.TakeAccepted(a.fd)
+		if multishot || len(results) > 0 {
+			a.takeAccepted(results)
+			return
+		}
+	}
+	for i := 0; i < acceptBatchSize; i++ {
+		fd, sa, err := unix.Accept4(a.fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		switch err {
+		case nil:
+			a.backoff = 0
+			a.onAccept(newFdConn(fd, sockaddrToAddr(sa)))
+		case unix.EAGAIN:
+			return
+		case unix.EINTR, unix.ECONNABORTED:
+			continue
+		default:
+			a.fail(err)
+			return
+		}
+	}
+	// edge triggered poller doesn't report the listener again while it isn't drained
+	a.loop.Execute(a.accept)
+}
+
+// takeAccepted Serves the connections accepted by the poller, the error of the accept pauses accepting.
+func (a *acceptor) takeAccepted(results []int32) {
+	var acceptErr error
+	for _, res := range results {
+		if res < 0 {
+			acceptErr = unix.Errno(-res)
+			continue
+		}
+		fd := int(res)
+		sa, err := unix.Getpeername(fd)
+		if err != nil {
+			// the client is gone before the connection is served
+			unix.Close(fd)
+			continue
+		}
+		a.backoff = 0
+		a.onAccept(newFdConn(fd, sockaddrToAddr(sa)))
+	}
+	if acceptErr != nil {
+		a.fail(acceptErr)
+	}
+}
+
+// fail Pauses accepting on the error, the pending connection is shed when the process runs out of fds.
+func (a *acceptor) fail(err error) {
+	if err == unix.EMFILE || err == unix.ENFILE {
+		a.shedConnection()
+	}
+	a.pause(err)
+}
+
+// shedConnection Accepts and closes the pending connection with help of the reserve fd.
+func (a *acceptor) shedConnection() {
+	if a.reserveFd < 0 {
+		return
+	}
+	unix.Close(a.reserveFd)
+	fd, _, err := unix.Accept4(a.fd, unix.SOCK_CLOEXEC)
+	if err == nil {
+		unix.Close(fd)
+	}
+	a.reserveFd, err = openReserveFd()
+	if err != nil {
+		log.Error().Msgf("[%s] can't reopen accept reserve fd: %+v", a.name, err)
+	}
+}
+
+// pause Stops accepting for the growing backoff time.
+func (a *acceptor) pause(reason error) {
+	if a.backoff == 0 {
+		a.backoff = minAcceptBackoff
+	} else if a.backoff < maxAcceptBackoff {
+		a.backoff *= 2
+	}
+	log.Error().Msgf("[%s] got error while accepting connection, pause accepting for %s: %+v", a.name, a.backoff, os.NewSyscallError("accept4", reason))
+	err := a.loop.poller.Modify(a.fd, false, false)
+	if err != nil {
+		log.Error().Msgf("[%s] can't pause polling of listener: %+v", a.name, err)
+	}
+	a.resumeTimer = a.loop.Schedule(a.backoff, a.resume)
+}
+
+func (a *acceptor) resume() {
+	a.resumeTimer = nil
+	if a.closed {
+		return
+	}
+	// modification re-arms the poller, so it reports the connections queued while polling was paused
+	err := a.loop.poller.Modify(a.fd, true, false)
+	if err != nil {
+		log.Error().Msgf("[%s] can't resume polling of listener: %+v", a.name, err)
+	}
+	a.accept()
+}
+
+func (a *acceptor) close() {
+	a.closed = true
+	a.loop.CancelTimer(a.resumeTimer)
+	err := a.loop.DeletePoll(a.fd)
+	if err != nil {
+		log.Error().Msgf("[%s] error occurs while detaching listener from netpoll: %v", a.name, err)
+	}
+	unix.Close(a.fd)
+	if a.reserveFd >= 0 {
+		unix.Close(a.reserveFd)
+	}
+}
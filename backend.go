@@ -9,6 +9,8 @@ import (
 	"time"
 )
 
+const defConnectTimeout = 5 * time.Second
+
 const (
 	unknown  = -1
 	enabled  = 1
@@ -22,8 +24,11 @@ type Backend struct {
 	Net           string
 	Status        int
 	HealthCheck   *HealthCheck
-	checkBuf      []byte
-	updateChannel chan status
+	SocketBuffers SocketBuffers
+	// ConnectTimeout limits the connection to the backend, the default is used when it isn't set
+	ConnectTimeout time.Duration
+	checkBuf       []byte
+	updateChannel  chan status
 }
 
 type HealthCheck struct {
@@ -57,9 +62,16 @@ func (b *Backend) runHealthCheck() {
 	}
 }
 
-func (b *Backend) getBackendConn() (net.Conn, error) {
+// dialFunc opens the backend connection which can be served by the engine.
+type dialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
+func (b *Backend) getBackendConn(dial dialFunc) (net.Conn, error) {
 	if b.Status != disabled {
-		return net.Dial(b.Net, b.Address)
+		timeout := b.ConnectTimeout
+		if timeout <= 0 {
+			timeout = defConnectTimeout
+		}
+		return dial(b.Net, b.Address, timeout)
 	}
 	return nil, noActiveBackends
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/rs/zerolog/log"
 	"net"
+	"time"
 )
 
 const (
@@ -40,6 +41,11 @@ func InitBalancers(ctx context.Context, config Config) {
 				HealthCheck: &HealthCheck{
 					Period: backendConfig.HealthCheckPeriod,
 				},
+				SocketBuffers: SocketBuffers{
+					RcvBuf: backendConfig.SocketRcvBuf,
+					SndBuf: backendConfig.SocketSndBuf,
+				},
+				ConnectTimeout: time.Duration(backendConfig.ConnectTimeoutSec) * time.Second,
 			}
 			backend.initBackend()
 			backends = append(backends, backend)
@@ -56,27 +62,28 @@ func InitBalancers(ctx context.Context, config Config) {
 	}
 }
 
-func getConnByBalancerName(name string) (net.Conn, error) {
+// getConnByBalancerName Returns the connection to the next backend of the balancer and the backend.
+func getConnByBalancerName(name string, dial dialFunc) (*Backend, net.Conn, error) {
 	balancer, ok := balancers[name]
 	if !ok {
-		return nil, balancerNotFound
+		return nil, nil, balancerNotFound
 	}
-	return balancer.getNextBackendConn()
+	return balancer.getNextBackendConn(dial)
 }
 
-func (b *Balancer) getNextBackendConn() (net.Conn, error) {
+func (b *Balancer) getNextBackendConn(dial dialFunc) (*Backend, net.Conn, error) {
 	if len(b.Backends) > 0 {
 		// todo: need to use ipaddress of the frontend connection
 		//backend := b.Backends[JumpHash(uint64(time.Now().UnixNano()), len(b.Backends))]
 		backend := b.Backends[0]
-		conn, err := backend.getBackendConn()
+		conn, err := backend.getBackendConn(dial)
 		if err != nil {
-			return nil, nil
+			return nil, nil, err
 		}
-		setSocketOptions(conn)
-		return conn, nil
+		setSocketOptions(conn, backend.SocketBuffers)
+		return backend, conn, nil
 	}
-	return nil, noActiveBackends
+	return nil, nil, noActiveBackends
 }
 
 func (b *Balancer) start() {
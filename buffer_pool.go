@@ -0,0 +1,153 @@
+package dynproxy
+
+import "sync"
+
+const (
+	defMinReadSize = 4 * 1024
+	defMaxReadSize = 256 * 1024
+	slabSize       = 256 * 1024
+	maxReadVector  = 8
+)
+
+// bufferClasses sizes of the pooled buffers, the reads bigger than the largest class are vectored.
+var bufferClasses = []int{4 * 1024, 16 * 1024, 64 * 1024}
+
+type BufferConfig struct {
+	// MinReadSize initial read window of the session, the window of idle session shrinks back to it
+	MinReadSize int
+	// MaxReadSize the read window of busy session grows up to it, it's the max bytes read by one readv(2)
+	MaxReadSize int
+}
+
+// BufferPool keeps the buffers of the event loop by size classes. The buffers of a class are cut from the slabs,
+// so the pool allocates one slab instead of many small buffers. It isn't safe for concurrent use, the buffers are
+// borrowed and returned on the event loop thread, the pool of the goroutine engine is guarded by the lock.
+type BufferPool struct {
+	classes     []*bufferClass
+	minReadSize int
+	maxReadSize int
+	lock        *sync.Mutex
+}
+
+type bufferClass struct {
+	size int
+	free [][]byte
+}
+
+func NewBufferPool(config BufferConfig) *BufferPool {
+	pool := &BufferPool{
+		minReadSize: config.MinReadSize,
+		maxReadSize: config.MaxReadSize,
+	}
+	if pool.minReadSize <= 0 {
+		pool.minReadSize = defMinReadSize
+	}
+	if pool.maxReadSize < pool.minReadSize {
+		pool.maxReadSize = defMaxReadSize
+		if pool.maxReadSize < pool.minReadSize {
+			pool.maxReadSize = pool.minReadSize
+		}
+	}
+	largest := bufferClasses[len(bufferClasses)-1]
+	if pool.maxReadSize > largest*maxReadVector {
+		pool.maxReadSize = largest * maxReadVector
+	}
+	for _, size := range bufferClasses {
+		pool.classes = append(pool.classes, &bufferClass{size: size})
+	}
+	return pool
+}
+
+// newSyncBufferPool Returns the pool which can be shared by the goroutines.
+func newSyncBufferPool(config BufferConfig) *BufferPool {
+	pool := NewBufferPool(config)
+	pool.lock = &sync.Mutex{}
+	return pool
+}
+
+// Get Returns the buffer of the smallest class which fits the size, the largest class is used for the bigger sizes.
+func (p *BufferPool) Get(size int) []byte {
+	if p.lock != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+	}
+	class := p.classes[len(p.classes)-1]
+	for _, c := range p.classes {
+		if c.size >= size {
+			class = c
+			break
+		}
+	}
+	if len(class.free) == 0 {
+		slab := make([]byte, slabSize)
+		for offset := 0; offset+class.size <= len(slab); offset += class.size {
+			class.free = append(class.free, slab[offset:offset+class.size:offset+class.size])
+		}
+	}
+	last := len(class.free) - 1
+	buf := class.free[last]
+	class.free[last] = nil
+	class.free = class.free[:last]
+	return buf
+}
+
+// Put Returns the buffer to its class, the buffers which don't belong to the pool are dropped.
+func (p *BufferPool) Put(buf []byte) {
+	if p.lock != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+	}
+	for _, c := range p.classes {
+		if c.size == cap(buf) {
+			c.free = append(c.free, buf[:c.size])
+			return
+		}
+	}
+}
+
+// GetVector Appends to bufs the buffers which together hold the size bytes.
+func (p *BufferPool) GetVector(size int, bufs [][]byte) [][]byte {
+	for size > 0 {
+		buf := p.Get(size)
+		bufs = append(bufs, buf)
+		size -= len(buf)
+	}
+	return bufs
+}
+
+func (p *BufferPool) PutVector(bufs [][]byte) {
+	for i, buf := range bufs {
+		p.Put(buf)
+		bufs[i] = nil
+	}
+}
+
+// growWindow Doubles the read window of the session which filled the whole window by one read.
+func (p *BufferPool) growWindow(window int) int {
+	window *= 2
+	if window > p.maxReadSize {
+		window = p.maxReadSize
+	}
+	return window
+}
+
+// shrinkWindow Halves the read window of the session which reads much less than the window per wakeup.
+func (p *BufferPool) shrinkWindow(window int) int {
+	window /= 2
+	if window < p.minReadSize {
+		window = p.minReadSize
+	}
+	return window
+}
+
+// trimVector Cuts the buffers to hold n bytes, the buffers are returned to the pool by capacity, so they stay reusable.
+func trimVector(bufs [][]byte, n int) [][]byte {
+	for i, buf := range bufs {
+		if n <= len(buf) {
+			bufs[i] = buf[:n]
+			return bufs[:i+1]
+		}
+		n -= len(buf)
+	}
+	return bufs
+}
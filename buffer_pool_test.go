@@ -0,0 +1,55 @@
+package dynproxy
+
+import (
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(BufferConfig{})
+	buf := pool.Get(1000)
+	if len(buf) != 4*1024 {
+		t.Fatalf("expected buffer of the smallest class, got: %d", len(buf))
+	}
+	pool.Put(buf)
+	if reused := pool.Get(4 * 1024); &reused[0] != &buf[0] {
+		t.Fatalf("returned buffer isn't reused")
+	}
+
+	bufs := pool.GetVector(defMaxReadSize, nil)
+	if len(bufs) != defMaxReadSize/(64*1024) {
+		t.Fatalf("expected %d buffers of the largest class, got: %d", defMaxReadSize/(64*1024), len(bufs))
+	}
+	data := trimVector(bufs, 64*1024+10)
+	if len(data) != 2 || len(data[1]) != 10 {
+		t.Fatalf("unexpected trimmed vector: %d buffers", len(data))
+	}
+	// the trimmed buffers go back to their class
+	pool.PutVector(bufs)
+	if free := len(pool.classes[2].free); free != slabSize/(64*1024) {
+		t.Fatalf("expected %d free buffers, got: %d", slabSize/(64*1024), free)
+	}
+
+	window := pool.minReadSize
+	for i := 0; i < 10; i++ {
+		window = pool.growWindow(window)
+	}
+	if window != defMaxReadSize {
+		t.Fatalf("window grows beyond the max: %d", window)
+	}
+	for i := 0; i < 10; i++ {
+		window = pool.shrinkWindow(window)
+	}
+	if window != defMinReadSize {
+		t.Fatalf("window shrinks below the min: %d", window)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	pool := NewBufferPool(BufferConfig{})
+	var bufs [][]byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bufs = pool.GetVector(defMaxReadSize, bufs[:0])
+		pool.PutVector(bufs)
+	}
+}
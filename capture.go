@@ -0,0 +1,440 @@
+package dynproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/atomic"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defCaptureMaxBytes    = 64 * 1024 * 1024
+	defCaptureMaxDuration = 5 * time.Minute
+	// linkTypeRaw the packets start with IPv4 or IPv6 header
+	linkTypeRaw = 101
+	// captureSegment the payload is cut to the segments which fit into the IP packet with the headers
+	captureSegment = 65000
+	// captureQueueSize the packets queued to the writer of the capture, the packets are dropped on overflow
+	captureQueueSize = 4096
+)
+
+// CaptureConfig selects the sessions by the identity value of the key, the plaintext of both directions is written
+// to the pcapng file at Path. The capture stops when it wrote MaxBytes or after MaxDuration, the defaults are used
+// when they aren't set.
+type CaptureConfig struct {
+	Key         SessionKey
+	Value       string
+	Path        string
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+type CaptureStats struct {
+	Id      string
+	Config  CaptureConfig
+	Started time.Time
+	Packets uint64
+	Bytes   int64
+	// Dropped the packets which weren't written because the writer fell behind the sessions
+	Dropped uint64
+	Stopped bool
+}
+
+// Captures is the set of the running captures. The sessions check the version of the set on every read,
+// so the captures started at runtime are attached to the active sessions too.
+type Captures struct {
+	lock     sync.Mutex
+	version  atomic.Uint64
+	captures map[string]*Capture
+}
+
+// Capture writes the synthesized TCP/IP packets of the matched sessions to the pcapng file, it's shared by
+// the sessions of all loops. The loops queue the packets, the file is written by the goroutine of the capture.
+type Capture struct {
+	id      string
+	config  CaptureConfig
+	owner   *Captures
+	started time.Time
+	lock    sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	timer   *time.Timer
+	packets uint64
+	bytes   int64
+	dropped atomic.Uint64
+	stopped atomic.Bool
+	queue   chan capturedPacket
+	// done stops the writer, exited is closed once the writer wrote the queued packets
+	done   chan struct{}
+	exited chan struct{}
+}
+
+type capturedPacket struct {
+	time time.Time
+	data []byte
+}
+
+// captureStream is the TCP connection of the session in the capture, client is the frontend peer.
+type captureStream struct {
+	capture   *Capture
+	client    *net.TCPAddr
+	server    *net.TCPAddr
+	clientSeq uint32
+	serverSeq uint32
+}
+
+func NewCaptures() *Captures {
+	return &Captures{captures: make(map[string]*Capture)}
+}
+
+// Start Creates the capture file and attaches the capture to the matched sessions.
+func (c *Captures) Start(config CaptureConfig) (*Capture, error) {
+	if !config.Key.valid() {
+		return nil, unknownSessionKey
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defCaptureMaxBytes
+	}
+	if config.MaxDuration <= 0 {
+		config.MaxDuration = defCaptureMaxDuration
+	}
+	file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	capture := &Capture{
+		id:      newSessionId(),
+		config:  config,
+		owner:   c,
+		started: time.Now(),
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		queue:   make(chan capturedPacket, captureQueueSize),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	capture.writeHeader()
+	go capture.run()
+	// the capture can't be stopped by the sessions until the timer is set
+	capture.lock.Lock()
+	c.lock.Lock()
+	c.captures[capture.id] = capture
+	c.lock.Unlock()
+	capture.timer = time.AfterFunc(config.MaxDuration, func() {
+		capture.Stop()
+	})
+	capture.lock.Unlock()
+	c.version.Inc()
+	log.Info().Msgf("capture %s of sessions with %s=%s is started: %s", capture.id, config.Key, config.Value, config.Path)
+	return capture, nil
+}
+
+// Stop Stops the capture by id.
+func (c *Captures) Stop(id string) error {
+	c.lock.Lock()
+	capture, ok := c.captures[id]
+	c.lock.Unlock()
+	if !ok {
+		return captureNotFound
+	}
+	return capture.Stop()
+}
+
+// Stats Returns the stats of the running captures.
+func (c *Captures) Stats() []CaptureStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := make([]CaptureStats, 0, len(c.captures))
+	for _, capture := range c.captures {
+		stats = append(stats, capture.Stats())
+	}
+	return stats
+}
+
+// match Returns the running capture of the session, nil when the session isn't captured.
+func (c *Captures) match(identity SessionIdentity) *Capture {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, capture := range c.captures {
+		if identity.Get(capture.config.Key) == capture.config.Value {
+			return capture
+		}
+	}
+	return nil
+}
+
+func (c *Capture) Id() string {
+	return c.id
+}
+
+func (c *Capture) Stats() CaptureStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CaptureStats{
+		Id:      c.id,
+		Config:  c.config,
+		Started: c.started,
+		Packets: c.packets,
+		Bytes:   c.bytes,
+		Dropped: c.dropped.Load(),
+		Stopped: c.stopped.Load(),
+	}
+}
+
+// Stop Writes the queued packets, flushes and closes the capture file, the sessions detach the capture on the next read.
+func (c *Capture) Stop() error {
+	c.lock.Lock()
+	if c.stopped.Load() {
+		c.lock.Unlock()
+		return nil
+	}
+	c.stopped.Store(true)
+	c.timer.Stop()
+	c.lock.Unlock()
+	close(c.done)
+	<-c.exited
+
+	c.lock.Lock()
+	err := c.writer.Flush()
+	closeErr := c.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	packets, bytes := c.packets, c.bytes
+	c.lock.Unlock()
+
+	c.owner.lock.Lock()
+	delete(c.owner.captures, c.id)
+	c.owner.lock.Unlock()
+	c.owner.version.Inc()
+	log.Info().Msgf("capture %s is stopped, %d packets %d bytes are written, %d packets are dropped: %s", c.id, packets, bytes, c.dropped.Load(), c.config.Path)
+	return err
+}
+
+// run Writes the queued packets until the capture is stopped, the capture is stopped when the file reaches MaxBytes.
+func (c *Capture) run() {
+	defer close(c.exited)
+	full := false
+	for {
+		select {
+		case packet := <-c.queue:
+			if !full && !c.writeBlock(packet) {
+				full = true
+				go c.Stop()
+			}
+		case <-c.done:
+			for !full {
+				select {
+				case packet := <-c.queue:
+					full = !c.writeBlock(packet)
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+// writeHeader Writes the section header and the interface description blocks of the raw IP link.
+func (c *Capture) writeHeader() {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], 0x0A0D0D0A)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	// the section length isn't known
+	binary.LittleEndian.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], 1)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+	c.writer.Write(shb)
+	c.writer.Write(idb)
+	c.bytes = int64(len(shb) + len(idb))
+}
+
+// writePacket Queues the packet to the writer, the packet is dropped when the queue is full. Returns false
+// when the capture is stopped.
+func (c *Capture) writePacket(now time.Time, packet []byte) bool {
+	if c.stopped.Load() {
+		return false
+	}
+	select {
+	case c.queue <- capturedPacket{time: now, data: packet}:
+	default:
+		c.dropped.Inc()
+	}
+	return true
+}
+
+// writeBlock Writes the enhanced packet block with microsecond timestamp, returns false when the block exceeds MaxBytes.
+func (c *Capture) writeBlock(p capturedPacket) bool {
+	now, packet := p.time, p.data
+	padded := (len(packet) + 3) &^ 3
+	size := 32 + padded
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.bytes+int64(size) > c.config.MaxBytes {
+		return false
+	}
+	header := make([]byte, 28)
+	ts := uint64(now.UnixMicro())
+	binary.LittleEndian.PutUint32(header[0:], 6)
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	binary.LittleEndian.PutUint32(header[8:], 0)
+	binary.LittleEndian.PutUint32(header[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(header[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(packet)))
+	c.writer.Write(header)
+	c.writer.Write(packet)
+	c.writer.Write(make([]byte, padded-len(packet)))
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(size))
+	c.writer.Write(trailer[:])
+	c.packets++
+	c.bytes += int64(size)
+	return true
+}
+
+// newCaptureStream Starts the TCP stream of the session in the capture by the synthesized handshake,
+// so the dissectors see the whole connection.
+func newCaptureStream(capture *Capture, client, server net.Addr) *captureStream {
+	stream := &captureStream{
+		capture:   capture,
+		client:    tcpAddr(client),
+		server:    tcpAddr(server),
+		clientSeq: 1000,
+		serverSeq: 2000,
+	}
+	now := time.Now()
+	stream.segment(now, true, tcpSyn, nil)
+	stream.segment(now, false, tcpSyn|tcpAck, nil)
+	stream.segment(now, true, tcpAck, nil)
+	return stream
+}
+
+// write Writes the payload sent by the client or the server, returns false when the capture is stopped.
+func (s *captureStream) write(fromClient bool, payload []byte) bool {
+	now := time.Now()
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > captureSegment {
+			n = captureSegment
+		}
+		if !s.segment(now, fromClient, tcpPsh|tcpAck, payload[:n]) {
+			return false
+		}
+		payload = payload[n:]
+	}
+	return true
+}
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+// segment Builds the IP packet of the TCP segment and advances the sequence numbers of the stream.
+func (s *captureStream) segment(now time.Time, fromClient bool, flags byte, payload []byte) bool {
+	src, dst := s.client, s.server
+	seq, ack := &s.clientSeq, &s.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], *ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+	packet := ipPacket(src.IP, dst.IP, tcp)
+	return s.capture.writePacket(now, packet)
+}
+
+// ipPacket Wraps the TCP segment into IPv4 or IPv6 packet and sets the checksums.
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+	var packet, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		packet = make([]byte, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = unix.IPPROTO_TCP
+		copy(packet[12:], src4)
+		copy(packet[16:], dst4)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20], 0))
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = unix.IPPROTO_TCP
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		copy(packet[20:], tcp)
+		tcp = packet[20:]
+	} else {
+		packet = make([]byte, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = unix.IPPROTO_TCP
+		packet[7] = 64
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src.To16())
+		copy(pseudo[16:], dst.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = unix.IPPROTO_TCP
+		copy(packet[40:], tcp)
+		tcp = packet[40:]
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo, 0)))
+	return packet
+}
+
+func sum(data []byte, initial uint32) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		initial += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		initial += uint32(data[len(data)-1]) << 8
+	}
+	return initial
+}
+
+func checksum(data []byte, initial uint32) uint16 {
+	s := sum(data, initial)
+	for s > 0xFFFF {
+		s = s>>16 + s&0xFFFF
+	}
+	return ^uint16(s)
+}
+
+// tcpAddr Returns the TCP address of the peer, the other addresses are captured as unspecified IPv4 address.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
@@ -0,0 +1,157 @@
+package dynproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readPcapng Returns the packets of the enhanced packet blocks.
+func readPcapng(t *testing.T, path string) [][]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("can't read capture: %+v", err)
+	}
+	if len(data) < 48 || binary.LittleEndian.Uint32(data) != 0x0A0D0D0A || binary.LittleEndian.Uint32(data[8:]) != 0x1A2B3C4D {
+		t.Fatalf("capture doesn't start with section header")
+	}
+	var packets [][]byte
+	for offset := 0; offset < len(data); {
+		blockType := binary.LittleEndian.Uint32(data[offset:])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if size < 12 || offset+size > len(data) || binary.LittleEndian.Uint32(data[offset+size-4:]) != uint32(size) {
+			t.Fatalf("broken block at %d", offset)
+		}
+		if blockType == 6 {
+			length := int(binary.LittleEndian.Uint32(data[offset+20:]))
+			packets = append(packets, data[offset+28:offset+28+length])
+		}
+		offset += size
+	}
+	return packets
+}
+
+func TestCapture(t *testing.T) {
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			captures := NewCaptures()
+			proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{Frontend: "TestFrontend", SpliceEnabled: true, Captures: captures},
+			})
+			defer proxy.Stop()
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = roundTrip(conn, []byte("before"), make([]byte, 6))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+
+			// the active session is captured after the start
+			path := filepath.Join(t.TempDir(), "session.pcapng")
+			capture, err := captures.Start(CaptureConfig{Key: SessionByFrontend, Value: "TestFrontend", Path: path})
+			if err != nil {
+				t.Fatalf("can't start capture: %+v", err)
+			}
+			err = roundTrip(conn, []byte("hello"), make([]byte, 5))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+			err = captures.Stop(capture.Id())
+			if err != nil {
+				t.Fatalf("can't stop capture: %+v", err)
+			}
+			err = roundTrip(conn, []byte("after"), make([]byte, 5))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+
+			packets := readPcapng(t, path)
+			if len(packets) != 5 {
+				t.Fatalf("expected handshake and 2 payload packets, got: %d", len(packets))
+			}
+			var payload []byte
+			for i, packet := range packets {
+				if packet[0] != 0x45 || checksum(packet[:20], 0) != 0 {
+					t.Fatalf("packet %d has broken IPv4 header", i)
+				}
+				pseudo := append(append([]byte{}, packet[12:20]...), 0, 6, byte((len(packet)-20)>>8), byte(len(packet)-20))
+				if checksum(packet[20:], sum(pseudo, 0)) != 0 {
+					t.Fatalf("packet %d has broken TCP checksum", i)
+				}
+				payload = append(payload, packet[40:]...)
+			}
+			if packets[0][33] != tcpSyn || packets[1][33] != tcpSyn|tcpAck {
+				t.Fatalf("capture doesn't start with handshake")
+			}
+			if !bytes.Equal(payload, []byte("hellohello")) {
+				t.Fatalf("unexpected captured payload: %q", payload)
+			}
+		})
+	}
+}
+
+func TestCaptureMaxBytes(t *testing.T) {
+	backend := startEchoServer(t)
+	defer backend.Close()
+	captures := NewCaptures()
+	proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+		engine:  EpollPoller,
+		session: ProxySessionConfig{Captures: captures},
+	})
+	defer proxy.Stop()
+	path := filepath.Join(t.TempDir(), "session.pcapng")
+	_, err := captures.Start(CaptureConfig{Key: SessionByClientIp, Value: "127.0.0.1", Path: path, MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("can't start capture: %+v", err)
+	}
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("can't connect to proxy: %+v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = roundTrip(conn, make([]byte, 2048), make([]byte, 2048))
+	if err != nil {
+		t.Fatalf("round trip failed: %+v", err)
+	}
+	// the capture is stopped by its writer
+	stats := captures.Stats()
+	for deadline := time.Now().Add(5 * time.Second); len(stats) != 0 && time.Now().Before(deadline); stats = captures.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats) != 0 {
+		t.Fatalf("capture isn't stopped by the size limit: %+v", stats)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > 1024 {
+		t.Fatalf("capture exceeds the size limit: %+v", err)
+	}
+}
+
+func TestCaptureQueueOverflow(t *testing.T) {
+	// the writer isn't started, so the queue isn't drained
+	capture := &Capture{queue: make(chan capturedPacket, 2)}
+	for i := 0; i < 5; i++ {
+		if !capture.writePacket(time.Now(), []byte{0x45}) {
+			t.Fatalf("packet isn't accepted by running capture")
+		}
+	}
+	if stats := capture.Stats(); stats.Dropped != 3 || len(capture.queue) != 2 {
+		t.Fatalf("expected 3 dropped packets, got: %+v", stats)
+	}
+	capture.stopped.Store(true)
+	if capture.writePacket(time.Now(), []byte{0x45}) {
+		t.Fatalf("packet is accepted by stopped capture")
+	}
+}
@@ -10,8 +10,11 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
+const defDrainTimeout = 30 * time.Second
+
 var config dynproxy.Config
 
 func init() {
@@ -38,14 +41,40 @@ func main() {
 	sigOsChan := make(chan int)
 	go handleSysSignals(sigOsChan)
 	mainCtx, mainCancelFn := context.WithCancel(context.Background())
-	manager := dynproxy.NewContextManager(mainCtx)
+	manager := dynproxy.NewContextManager(mainCtx, config)
 	dynproxy.InitBalancers(mainCtx, config)
 	manager.InitFrontends(config)
 	<-sigOsChan
+	drain(manager, sigOsChan)
 	mainCancelFn()
 	log.Info().Msg("proxy stopped")
 }
 
+// drain Gives the sessions the drain timeout to finish, the second signal kills the remaining sessions and
+// exits at once without waiting for them.
+func drain(manager *dynproxy.ContextManager, sigOsChan chan int) {
+	timeout := time.Duration(config.Global.DrainTimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = defDrainTimeout
+	}
+	log.Info().Msgf("stop accepting connections, drain sessions for %s", timeout)
+	drainCtx, drainCancelFn := context.WithTimeout(context.Background(), timeout)
+	defer drainCancelFn()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- manager.Shutdown(drainCtx)
+	}()
+	select {
+	case err := <-drained:
+		if err != nil {
+			log.Warn().Msgf("sessions aren't drained: %+v", err)
+		}
+	case <-sigOsChan:
+		killed := manager.KillAllSessions()
+		log.Warn().Msgf("second signal, killed %d sessions, force exit", killed)
+	}
+}
+
 func handleSysSignals(exitChan chan int) {
 	sysSignalChanel := make(chan os.Signal, 1)
 	signal.Notify(sysSignalChanel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -9,23 +9,66 @@ import (
 )
 
 type Global struct {
-	LogLevel string `yaml:"log_level" toml:"log_level"`
+	LogLevel        string `yaml:"log_level" toml:"log_level"`
+	Poller          string `yaml:"poller" toml:"poller"`
+	Engine          string `yaml:"engine" toml:"engine"`
+	MinReadSize     int    `yaml:"min_read_buffer_bytes" toml:"min_read_buffer_bytes"`
+	MaxReadSize     int    `yaml:"max_read_buffer_bytes" toml:"max_read_buffer_bytes"`
+	DrainTimeoutSec int    `yaml:"drain_timeout_sec" toml:"drain_timeout_sec"`
 }
 
 type FrontendConfig struct {
-	Name                   string `yaml:"name" toml:"name"`
-	Net                    string `yaml:"net" toml:"net"`
-	Address                string `yaml:"address" toml:"address"`
-	TlsSkipVerify          bool   `yaml:"tls_skip_verify" toml:"tls_skip_verify"`
-	TlsCACertPath          string `yaml:"tls_ca_cert_path" toml:"tls_ca_cert_path"`
-	TlsCertPath            string `yaml:"tls_cert_path" toml:"tls_cert_path"`
-	TlsPkPath              string `yaml:"tls_pk_path" toml:"tls_pk_path"`
-	BackendGroup           string `yaml:"backend_group" toml:"backend_group"`
-	OcspStapleEnabled      bool   `yaml:"ocsp_staple_enabled" toml:"ocsp_staple_enabled"`
-	OcspResponderUrl       string `yaml:"ocsp_responder_url" toml:"ocsp_responder_url"`
-	OcspCacheEnabled       bool   `yaml:"ocsp_cache_enabled" toml:"ocsp_cache_enabled"`
-	OcspAutoRenewalEnabled bool   `yaml:"ocsp_auto_renewal_enabled" toml:"ocsp_auto_renewal_enabled"`
-	OcspValidationEnabled  bool   `yaml:"ocsp_validation_enabled" toml:"ocsp_validation_enabled"`
+	Name                   string   `yaml:"name" toml:"name"`
+	Net                    string   `yaml:"net" toml:"net"`
+	Address                string   `yaml:"address" toml:"address"`
+	TlsSkipVerify          bool     `yaml:"tls_skip_verify" toml:"tls_skip_verify"`
+	TlsCACertPath          string   `yaml:"tls_ca_cert_path" toml:"tls_ca_cert_path"`
+	TlsCertPath            string   `yaml:"tls_cert_path" toml:"tls_cert_path"`
+	TlsPkPath              string   `yaml:"tls_pk_path" toml:"tls_pk_path"`
+	BackendGroup           string   `yaml:"backend_group" toml:"backend_group"`
+	OcspStapleEnabled      bool     `yaml:"ocsp_staple_enabled" toml:"ocsp_staple_enabled"`
+	OcspResponderUrl       string   `yaml:"ocsp_responder_url" toml:"ocsp_responder_url"`
+	OcspCacheEnabled       bool     `yaml:"ocsp_cache_enabled" toml:"ocsp_cache_enabled"`
+	OcspAutoRenewalEnabled bool     `yaml:"ocsp_auto_renewal_enabled" toml:"ocsp_auto_renewal_enabled"`
+	OcspValidationEnabled  bool     `yaml:"ocsp_validation_enabled" toml:"ocsp_validation_enabled"`
+	SpliceEnabled          bool     `yaml:"splice_enabled" toml:"splice_enabled"`
+	ReadBudgetBytes        int      `yaml:"read_budget_bytes" toml:"read_budget_bytes"`
+	HandshakeTimeoutSec    int      `yaml:"handshake_timeout_sec" toml:"handshake_timeout_sec"`
+	MaxHandshakes          int      `yaml:"max_concurrent_handshakes" toml:"max_concurrent_handshakes"`
+	SocketRcvBuf           int      `yaml:"socket_rcvbuf_bytes" toml:"socket_rcvbuf_bytes"`
+	SocketSndBuf           int      `yaml:"socket_sndbuf_bytes" toml:"socket_sndbuf_bytes"`
+	SocketMode             string   `yaml:"socket_mode" toml:"socket_mode"`
+	SocketOwner            string   `yaml:"socket_owner" toml:"socket_owner"`
+	SocketGroup            string   `yaml:"socket_group" toml:"socket_group"`
+	IdleTimeoutSec         int      `yaml:"idle_timeout_sec" toml:"idle_timeout_sec"`
+	MaxSessionLifetimeSec  int      `yaml:"max_session_lifetime_sec" toml:"max_session_lifetime_sec"`
+	UpstreamBytesPerSec    int      `yaml:"upstream_bytes_per_sec" toml:"upstream_bytes_per_sec"`
+	DownstreamBytesPerSec  int      `yaml:"downstream_bytes_per_sec" toml:"downstream_bytes_per_sec"`
+	IdentityBytesPerSec    int      `yaml:"identity_bytes_per_sec" toml:"identity_bytes_per_sec"`
+	IdentityLimitKey       string   `yaml:"identity_limit_key" toml:"identity_limit_key"`
+	MirrorGroup            string   `yaml:"mirror_group" toml:"mirror_group"`
+	MirrorSamplePercent    int      `yaml:"mirror_sample_percent" toml:"mirror_sample_percent"`
+	MirrorMaxBytes         int64    `yaml:"mirror_max_bytes" toml:"mirror_max_bytes"`
+	Filters                []string `yaml:"filters" toml:"filters"`
+	SniffTimeoutSec        int      `yaml:"sniff_timeout_sec" toml:"sniff_timeout_sec"`
+	MaxSniffs              int      `yaml:"max_concurrent_sniffs" toml:"max_concurrent_sniffs"`
+	// SniffRules enables the protocol sniffing, the first matched rule chooses the backend group
+	SniffRules []SniffRuleConfig `yaml:"sniff_rules" toml:"sniff_rules"`
+	// PeerRoutes choose the backend group of the unix socket connections by the user and the group of the peer
+	PeerRoutes []PeerRouteConfig `yaml:"peer_routes" toml:"peer_routes"`
+}
+
+type SniffRuleConfig struct {
+	Protocol     string `yaml:"protocol" toml:"protocol"`
+	Pattern      string `yaml:"pattern" toml:"pattern"`
+	BackendGroup string `yaml:"backend_group" toml:"backend_group"`
+	TerminateTls bool   `yaml:"terminate_tls" toml:"terminate_tls"`
+}
+
+type PeerRouteConfig struct {
+	Uid          string `yaml:"uid" toml:"uid"`
+	Gid          string `yaml:"gid" toml:"gid"`
+	BackendGroup string `yaml:"backend_group" toml:"backend_group"`
 }
 
 type BackendGroup struct {
@@ -38,6 +81,9 @@ type BackendConfig struct {
 	Net               string `yaml:"net" toml:"net"`
 	Address           string `yaml:"address" toml:"address"`
 	HealthCheckPeriod int    `yaml:"health_check_period_sec" toml:"health_check_period_sec"`
+	ConnectTimeoutSec int    `yaml:"connect_timeout_sec" toml:"connect_timeout_sec"`
+	SocketRcvBuf      int    `yaml:"socket_rcvbuf_bytes" toml:"socket_rcvbuf_bytes"`
+	SocketSndBuf      int    `yaml:"socket_sndbuf_bytes" toml:"socket_sndbuf_bytes"`
 }
 
 type Config struct {
@@ -0,0 +1,60 @@
+package dynproxy
+
+import (
+	"github.com/rs/zerolog/log"
+	"net"
+	"time"
+)
+
+const (
+	EventLoopEngine = "event_loop"
+	GoroutineEngine = "goroutine"
+)
+
+// Engine serves the listeners and the sessions of the proxy. The event loop polls the raw fds on one thread,
+// the goroutine engine waits for every connection direction in its own goroutine with the Go runtime netpoller.
+type Engine interface {
+	// Start Runs the engine until it's stopped
+	Start(handler NetEventHandler, holder SessionHolder)
+	// Stop Stops the engine and closes its listeners
+	Stop()
+	// Accept Opens the listening socket, onAccept is called for every accepted connection
+	Accept(name, network, address string, onAccept func(conn net.Conn)) (Listener, error)
+	// ListenPacket Opens the datagram socket, onPacket is called for every received datagram, the data is reused after the call
+	ListenPacket(name, network, address string, onPacket func(data []byte, addr *net.UDPAddr)) (PacketListener, error)
+	// Dial Opens the connection which can be served by the engine, the event loop doesn't wait for the connect,
+	// the served session finishes it
+	Dial(network, address string, timeout time.Duration) (net.Conn, error)
+	// Serve Attaches the session to the engine, it's safe to call it from any goroutine
+	Serve(session Session)
+	// Stats Returns the load metrics of the engine
+	Stats() EventLoopStats
+}
+
+// Listener is the listening socket served by the engine.
+type Listener interface {
+	Addr() net.Addr
+	Close() error
+}
+
+// PacketListener is the datagram socket served by the engine, the sessions send the replies to the clients from it.
+type PacketListener interface {
+	Listener
+	// WriteTo Sends the datagram to the address, the datagram is dropped when the socket buffer is full
+	// and zero bytes are returned then.
+	// The sessions of the event loop call it on the loop thread.
+	WriteTo(data []byte, addr *net.UDPAddr) (int, error)
+}
+
+// NewEngine Creates the engine by name, the goroutine engine is used when the event loop can't be created.
+func NewEngine(name string, config EventLoopConfig) Engine {
+	if name == GoroutineEngine {
+		return NewGoroutineEngine(config)
+	}
+	eventLoop, err := NewEventLoop(config)
+	if err != nil {
+		log.Warn().Msgf("can't create event loop, fallback to goroutine engine: %+v", err)
+		return NewGoroutineEngine(config)
+	}
+	return eventLoop
+}
@@ -10,135 +10,100 @@ import (
 	"unsafe"
 )
 
-const (
-	readEvents       = unix.EPOLLPRI | unix.EPOLLIN | unix.EPOLLET
-	writeEvents      = unix.EPOLLOUT
-	readWriteEvents  = readEvents | writeEvents
-	errorEvents      = unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
-	readErrorsEvents = readEvents | errorEvents
-	allEvents        = readEvents | errorEvents | writeEvents
-)
+type epollPoller struct {
+	eventBufferSize int
+	fd              int
+	wakeupFd        int
+	events          []unix.EpollEvent
+}
 
-func openPoller(eventsBufferSize int) (*Poller, error) {
+func openEpollPoller(eventsBufferSize int) (Poller, error) {
 	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
 		return nil, os.NewSyscallError("epoll_create1", err)
 	}
 	bufferSize := int(math.Max(float64(eventsBufferSize), defEventsBufferSize))
-	return &Poller{
+	p := &epollPoller{
 		eventBufferSize: bufferSize,
 		fd:              fd,
-		timeout:         blocked,
+		wakeupFd:        -1,
 		events:          make([]unix.EpollEvent, bufferSize),
-	}, nil
+	}
+	p.wakeupFd, err = openWakeupFd()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = p.Add(p.wakeupFd, true, false)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *epollPoller) Name() string {
+	return EpollPoller
 }
 
-func (p *Poller) close() {
+func (p *epollPoller) Close() error {
+	if p.wakeupFd >= 0 {
+		unix.Close(p.wakeupFd)
+	}
 	err := os.NewSyscallError("close", unix.Close(p.fd))
 	if err != nil {
 		log.Error().Msgf("got error while closing epoll: %+v", err)
 	}
+	return err
 }
 
-func (p *Poller) waitForEvents(handler NetEventHandler, provider SessionHolder) (int, error) {
-	evCount, err := epollWait(p.fd, p.events, p.timeout)
+func (p *epollPoller) Wait(timeout int, callback func(fd int, events uint32)) (int, error) {
+	evCount, err := epollWait(p.fd, p.events, timeout)
 	if evCount == 0 || (evCount < 0 && err == unix.EINTR) {
 		runtime.Gosched()
+		return 0, nil
 	} else if err != nil {
 		log.Printf("error occurs in epoll: %v", os.NewSyscallError("epoll_wait", err))
 		return 0, err
 	}
 	for i := 0; i < evCount; i++ {
 		event := p.events[i]
-		fd := int(event.Fd)
-		log.Debug().Msgf("[%d] epoll event:%d", fd, event)
-		session, err := provider.FindSessionByFd(fd)
-		if err != nil {
-			err := p.deletePoll(fd)
-			if err != nil {
-				log.Error().Msgf("[%d] error occurs while detaching fd from netpoll: %v", fd, err)
-			}
+		if int(event.Fd) == p.wakeupFd {
+			drainWakeupFd(p.wakeupFd)
 			continue
 		}
-		if readEvents&event.Events > 0 {
-			err = handler.ReadEvent(session, fd)
-		}
-		if errorEvents&event.Events > 0 {
-			err = handler.ErrorEvent(session, parseErrors(event.Events))
-		}
-		if err != nil {
-			fds := session.GetFds()
-			for _, fd := range fds {
-				err := p.deletePoll(fd)
-				if err != nil {
-					log.Error().Msgf("[%d] error occurs while detaching fd from netpoll: %v", fd, err)
-				}
-			}
-			if err != closedSession {
-				log.Error().Msgf("[%d] error occurs in event-loop: %v", fd, err)
-				err := session.Close()
-				if err != nil {
-					log.Error().Msgf("[%d] error occurs while closing session: %v", fd, err)
-				}
-			}
-			provider.RemoveSession(session)
-		}
+		callback(int(event.Fd), event.Events)
 	}
 	return evCount, nil
 }
 
-func parseErrors(events uint32) []error {
-	if errorEvents&events > 0 {
-
-	}
-	return nil
+func (p *epollPoller) Wakeup() error {
+	return writeWakeupFd(p.wakeupFd)
 }
 
-func (p *Poller) addReadErrors(fd int) error {
+func (p *epollPoller) Add(fd int, read, write bool) error {
 	if log.Debug().Enabled() {
-		log.Debug().Msgf("add read|errors epoll for fd: %d", fd)
+		log.Debug().Msgf("add epoll for fd: %d read: %t write: %t", fd, read, write)
 	}
-	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readErrorsEvents})
+	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: pollEvents(read, write) | unix.EPOLLET})
 	if err != nil {
 		return os.NewSyscallError("epoll_ctl add", err)
 	}
 	return nil
 }
 
-func (p *Poller) addReadWrite(fd int) error {
+func (p *epollPoller) Modify(fd int, read, write bool) error {
 	if log.Debug().Enabled() {
-		log.Debug().Msgf("add read|write epoll for fd: %d", fd)
+		log.Debug().Msgf("modify epoll for fd: %d read: %t write: %t", fd, read, write)
 	}
-	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents})
+	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: pollEvents(read, write) | unix.EPOLLET})
 	if err != nil {
-		return os.NewSyscallError("epoll_ctl add", err)
+		return os.NewSyscallError("epoll_ctl mod", err)
 	}
 	return nil
 }
 
-func (p *Poller) addRead(fd int) error {
-	if log.Debug().Enabled() {
-		log.Debug().Msgf("add read epoll for fd: %d", fd)
-	}
-	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents})
-	if err != nil {
-		return os.NewSyscallError("epoll_ctl add", err)
-	}
-	return nil
-}
-
-func (p *Poller) addWrite(fd int) error {
-	if log.Debug().Enabled() {
-		log.Debug().Msgf("add write epoll for fd: %d", fd)
-	}
-	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents})
-	if err != nil {
-		return os.NewSyscallError("epoll_ctl add", err)
-	}
-	return nil
-}
-
-func (p *Poller) deletePoll(fd int) error {
+func (p *epollPoller) Delete(fd int) error {
 	if log.Debug().Enabled() {
 		log.Debug().Msgf("delete epoll for fd: %d", fd)
 	}
@@ -149,17 +114,6 @@ func (p *Poller) deletePoll(fd int) error {
 	return nil
 }
 
-func (p *Poller) addError(fd int) error {
-	if log.Debug().Enabled() {
-		log.Debug().Msgf("add error epoll for fd: %d", fd)
-	}
-	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: errorEvents})
-	if err != nil {
-		return os.NewSyscallError("epoll_ctl del", err)
-	}
-	return nil
-}
-
 func epollWait(epollFd int, events []unix.EpollEvent, msec int) (count int, err error) {
 	var eventCount uintptr
 	var eventsPointer = unsafe.Pointer(&events[0])
@@ -6,6 +6,28 @@ var noActiveBackends = errors.New("no active backends")
 var balancerNotFound = errors.New("invalid balancer name")
 var noSessionFound = errors.New("no session found")
 var closedSession = errors.New("closed session")
+var finishedSession = errors.New("finished session")
+var pollError = errors.New("error event is reported by poller")
+var lingerTimeout = errors.New("half-closed session linger timeout")
+var idleTimeout = errors.New("session idle timeout")
+var lifetimeExpired = errors.New("session max lifetime expired")
+var connectTimeout = errors.New("backend connect timeout")
+var killedSession = errors.New("session is killed")
+var unknownSessionKey = errors.New("unknown session key")
+var captureNotFound = errors.New("capture not found")
+var unknownFilter = errors.New("unknown filter")
+var tooManyPendingConns = errors.New("too many pending connections")
+var unknownProtocol = errors.New("unknown sniffed protocol")
+var tlsNotConfigured = errors.New("tls isn't configured")
+var notUnixSocket = errors.New("connection isn't over unix socket")
+var notSocketFile = errors.New("file isn't a socket")
+var socketInUse = errors.New("socket is in use")
+var spliceUnsupported = errors.New("splice isn't supported")
+var unsupportedNetwork = errors.New("unsupported network")
+var unsupportedTlsConn = errors.New("tls connection isn't created for the event loop")
+var unsupportedPoller = errors.New("poller isn't supported on this architecture")
+var incompleteSubmit = errors.New("io_uring didn't submit all requests")
+var unsupportedEngineSession = errors.New("session can't be served by goroutine engine")
 
 var revokedCert = errors.New("certificate is revoked")
 var incorrectSn = errors.New("incorrect serial number")
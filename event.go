@@ -6,6 +6,7 @@ import (
 )
 
 const (
+	SessionTimeout                = 408
 	OcspValidationError           = 500
 	UnavailableOcspResponderError = 503
 )
@@ -30,9 +31,22 @@ func genOcspErrorEvent(id string, errorType int, err error, msg string) Event {
 	}
 }
 
+// genSessionTimeoutEvent Returns the event with the identity of the session in MetaData.
+func genSessionTimeoutEvent(identity SessionIdentity, reason error) Event {
+	return Event{
+		Id:        identity.Id,
+		MetaData:  identity.metaData(),
+		Timestamp: time.Now().UnixMilli(),
+		Type:      SessionTimeout,
+		Err:       reason,
+		Msg:       reason.Error(),
+	}
+}
+
 type newConn struct {
-	frontend net.Conn
-	backend  string
+	frontend      net.Conn
+	backend       string
+	sessionConfig ProxySessionConfig
 }
 
 type status struct {
@@ -3,13 +3,53 @@ package dynproxy
 import (
 	"github.com/rs/zerolog/log"
 	"go.uber.org/atomic"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
 	"runtime"
+	"sync"
+	"time"
 )
 
 type EventLoopConfig struct {
 	Name            string
 	LockOsThread    bool
 	EventBufferSize int
+	// Poller name of the netpoll implementation: epoll (default) or io_uring
+	Poller string
+	// TimerTick resolution of the event loop timers
+	TimerTick time.Duration
+	// Buffers sizes of the read buffers borrowed by the sessions from the loop pool
+	Buffers BufferConfig
+}
+
+// LoopController gives the sessions access to the event loop, it must be used only from the event loop thread.
+type LoopController interface {
+	// ModifyPoll Enable or disable read and write readiness notifications for the fd
+	ModifyPoll(fd int, read, write bool) error
+	// Schedule Runs the callback on the event loop thread after the delay
+	Schedule(delay time.Duration, callback func()) *Timer
+	// CancelTimer Stops the timer if it isn't fired yet
+	CancelTimer(timer *Timer)
+	// CloseSession Detaches the session fds from the event loop and closes the session
+	CloseSession(session Session, reason error)
+	// Ready Reads the fd of the session on the next loop iteration without waiting for the readiness
+	Ready(session Session, fd int)
+	// Execute Queues the task to be run on the event loop thread, it's safe to call it from any goroutine
+	Execute(task func())
+	// Buffers Returns the buffer pool of the event loop
+	Buffers() *BufferPool
+}
+
+// recvController is the LoopController whose poller receives the bytes of the session fds, the session takes
+// the received bytes instead of reading the fd.
+type recvController interface {
+	// RecvFd Starts receiving the bytes of the fd by the poller, false is returned when the session has to read the fd
+	RecvFd(fd int) bool
+	// PeekReceived Returns the received bytes of the fd which aren't consumed yet and the error which ends them
+	PeekReceived(fd int) ([]byte, error)
+	// ConsumeReceived Consumes n of the received bytes of the fd
+	ConsumeReceived(fd int, n int)
 }
 
 type EventLoop struct {
@@ -17,9 +57,31 @@ type EventLoop struct {
 	lockOsThread    bool
 	eventBufferSize int
 	isRunning       *atomic.Bool
-	poller          *Poller
+	poller          Poller
 	eventChan       chan Event
 	sessionHolder   SessionHolder
+	handler         NetEventHandler
+	timers          *timerWheel
+	tasksLock       sync.Mutex
+	tasks           []func()
+	runningTasks    []func()
+	wakeupPending   *atomic.Bool
+	ready           []readyFd
+	processingReady []readyFd
+	acceptors       map[int]*acceptor
+	packetReaders   map[int]*packetReader
+	metrics         *loopMetrics
+	buffers         *BufferPool
+	wokeUp          time.Time
+	wakeupEvents    int
+	// polled are the events of the current iteration, they're dispatched once the poller returned
+	polled []SocketEvent
+}
+
+// readyFd is the fd which still has the data to read after the session spent its read budget.
+type readyFd struct {
+	session Session
+	fd      int
 }
 
 func NewEventLoop(config EventLoopConfig) (*EventLoop, error) {
@@ -29,16 +91,23 @@ func NewEventLoop(config EventLoopConfig) (*EventLoop, error) {
 		log.Info().Msgf("init event loop:%s", config.Name)
 	}
 
-	poller, err := openPoller(config.EventBufferSize)
+	poller, err := openPoller(config.Poller, config.EventBufferSize)
 	if err != nil {
 		log.Error().Msgf("can't open poller: %+v", err)
 		return nil, err
 	}
+	log.Info().Msgf("event loop %s uses %s poller", config.Name, poller.Name())
 	eLoop := &EventLoop{
-		Name:         config.Name,
-		lockOsThread: config.LockOsThread,
-		isRunning:    atomic.NewBool(false),
-		poller:       poller,
+		Name:          config.Name,
+		lockOsThread:  config.LockOsThread,
+		isRunning:     atomic.NewBool(false),
+		poller:        poller,
+		timers:        newTimerWheel(config.TimerTick, time.Now()),
+		wakeupPending: atomic.NewBool(false),
+		acceptors:     make(map[int]*acceptor),
+		packetReaders: make(map[int]*packetReader),
+		metrics:       newLoopMetrics(),
+		buffers:       NewBufferPool(config.Buffers),
 	}
 	return eLoop, nil
 }
@@ -48,31 +117,384 @@ func (el *EventLoop) Start(handler NetEventHandler, holder SessionHolder) {
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 	}
+	el.handler = handler
+	el.sessionHolder = holder
 	el.isRunning.Store(true)
 	for el.isRunning.Load() {
-		_, err := el.poller.waitForEvents(handler, holder)
+		// the poller wakes up in time for the nearest timer and doesn't wait at all while there are ready fds
+		timeout := el.timers.nextTimeout(time.Now())
+		if len(el.ready) > 0 {
+			timeout = nonBlocked
+		}
+		_, err := el.poller.Wait(timeout, el.pollEvent)
 		if err != nil {
 			log.Error().Msgf("got error while waiting for the net events: %+v", err)
 		}
+		el.wokeUp = time.Now()
+		for i, event := range el.polled {
+			el.polled[i] = SocketEvent{}
+			el.processEvent(int(event.Fd), event.Events)
+		}
+		el.polled = el.polled[:0]
+		el.processReady()
+		el.runTasks()
+		el.timers.advance(time.Now())
+		el.metrics.wakeup(el.wakeupEvents, time.Since(el.wokeUp))
+		el.wakeupEvents = 0
 	}
-	defer el.poller.close()
+	for _, a := range el.acceptors {
+		a.close()
+	}
+	for _, r := range el.packetReaders {
+		r.close()
+	}
+	defer el.poller.Close()
 }
 
+// Stop Stops the event loop, the loop wakes up and exits without waiting for the net events.
 func (el *EventLoop) Stop() {
 	el.isRunning.Store(false)
+	el.wakeup()
+}
+
+func (el *EventLoop) Execute(task func()) {
+	el.tasksLock.Lock()
+	el.tasks = append(el.tasks, task)
+	el.tasksLock.Unlock()
+	// one wakeup is enough until the loop takes the queued tasks
+	if !el.wakeupPending.Swap(true) {
+		el.wakeup()
+	}
+}
+
+func (el *EventLoop) wakeup() {
+	err := el.poller.Wakeup()
+	if err != nil {
+		log.Error().Msgf("got error while waking up event loop %s: %+v", el.Name, err)
+	}
+}
+
+func (el *EventLoop) runTasks() {
+	el.wakeupPending.Store(false)
+	el.tasksLock.Lock()
+	tasks := el.tasks
+	el.tasks = el.runningTasks[:0]
+	el.tasksLock.Unlock()
+	el.metrics.observeTaskQueue(len(tasks))
+	for i, task := range tasks {
+		task()
+		tasks[i] = nil
+	}
+	el.runningTasks = tasks
+}
+
+// Listen Accepts the connections of the non-blocking listening fd on the event loop thread, the event loop owns the fd.
+func (el *EventLoop) Listen(name string, fd int, onAccept func(conn *fdConn)) {
+	el.Execute(func() {
+		a, err := newAcceptor(el, name, fd, onAccept)
+		if err != nil {
+			log.Error().Msgf("[%s] can't create acceptor: %+v", name, err)
+			return
+		}
+		err = el.pollListener(fd)
+		if err != nil {
+			log.Error().Msgf("[%s] can't poll listener: %+v", name, err)
+			a.close()
+			return
+		}
+		el.acceptors[fd] = a
+		a.accept()
+	})
+}
+
+// Accept Opens the non-blocking listening socket which is served by the event loop.
+func (el *EventLoop) Accept(name, network, address string, onAccept func(conn net.Conn)) (Listener, error) {
+	var fd int
+	var addr net.Addr
+	var err error
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		fd, addr, err = listenTcp(network, address)
+	case "unix":
+		fd, addr, err = listenUnix(address)
+	default:
+		return nil, unsupportedNetwork
+	}
+	if err != nil {
+		return nil, err
+	}
+	el.Listen(name, fd, func(conn *fdConn) {
+		onAccept(conn)
+	})
+	return &loopListener{loop: el, fd: fd, addr: addr}, nil
+}
+
+// Dial Starts connecting the socket which is owned by the proxy, the session finishes the connect on the loop.
+func (el *EventLoop) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return dialUdp(network, address)
+	case "unix":
+		return dialUnix(address, timeout)
+	}
+	conn, err := dialTcp(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Serve Registers the session on the event loop thread, so it never races with the net events.
+func (el *EventLoop) Serve(session Session) {
+	el.Execute(func() {
+		el.RegisterSession(session)
+	})
+}
+
+type loopListener struct {
+	loop *EventLoop
+	fd   int
+	addr net.Addr
+}
+
+func (l *loopListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close Closes the listening fd on the loop thread, the socket file of the unix listener is removed like net.UnixListener does.
+func (l *loopListener) Close() error {
+	l.loop.CloseListener(l.fd)
+	if addr, ok := l.addr.(*net.UnixAddr); ok {
+		return os.Remove(addr.Name)
+	}
+	return nil
+}
+
+// CloseListener Stops accepting or reading and closes the listening fd.
+func (el *EventLoop) CloseListener(fd int) {
+	el.Execute(func() {
+		a, ok := el.acceptors[fd]
+		if ok {
+			delete(el.acceptors, fd)
+			a.close()
+		}
+		r, ok := el.packetReaders[fd]
+		if ok {
+			delete(el.packetReaders, fd)
+			r.close()
+		}
+	})
+}
+
+// RegisterSession Attaches the session fds to the event loop, it must be called on the event loop thread.
+func (el *EventLoop) RegisterSession(session Session) {
+	el.sessionHolder.AddSession(session, el)
+	err := el.PollForReadAndErrors(session.GetFds()...)
+	if err != nil {
+		session.Logger().Error().Msgf("got error while attach read netpoll: %+v", err)
+		el.CloseSession(session, err)
+		return
+	}
+	err = session.Init(el)
+	if err != nil {
+		el.CloseSession(session, err)
+	}
+}
+
+func (el *EventLoop) Buffers() *BufferPool {
+	return el.buffers
+}
+
+func (el *EventLoop) PollerName() string {
+	return el.poller.Name()
+}
+
+// Stats Returns the load metrics of the event loop, it's safe to call it from any goroutine.
+func (el *EventLoop) Stats() EventLoopStats {
+	el.tasksLock.Lock()
+	depth := len(el.tasks)
+	el.tasksLock.Unlock()
+	return el.metrics.stats(el.Name, depth)
+}
+
+// handlerStarted Records the lag of the handler since the poller returned.
+func (el *EventLoop) handlerStarted() {
+	el.metrics.observeLag(time.Since(el.wokeUp))
+}
+
+// pollEvent Collects the event reported by the poller, the handlers are run after the wakeup time is taken.
+func (el *EventLoop) pollEvent(fd int, events uint32) {
+	el.polled = append(el.polled, SocketEvent{Events: events, Fd: int32(fd)})
+}
+
+func (el *EventLoop) processEvent(fd int, events uint32) {
+	log.Debug().Msgf("[%d] poll events:%d", fd, events)
+	el.handlerStarted()
+	el.wakeupEvents++
+	a, ok := el.acceptors[fd]
+	if ok {
+		a.accept()
+		return
+	}
+	r, ok := el.packetReaders[fd]
+	if ok {
+		r.read()
+		return
+	}
+	session, err := el.sessionHolder.FindSessionByFd(fd)
+	if err != nil {
+		err := el.DeletePoll(fd)
+		if err != nil {
+			log.Error().Msgf("[%d] error occurs while detaching fd from netpoll: %v", fd, err)
+		}
+		return
+	}
+	// hang up is handled by reading the rest of the data until EOF, so the session can half-close the stream
+	if (readEvents|hangupEvents)&events > 0 {
+		err = el.handler.ReadEvent(session, fd)
+	}
+	if err == nil && writeEvents&events > 0 {
+		err = el.handler.WriteEvent(session, fd)
+	}
+	if err == nil && pollErr&events > 0 {
+		err = el.handler.ErrorEvent(session, parseErrors(fd, events))
+	}
+	if err != nil {
+		el.CloseSession(session, err)
+	}
+}
+
+func (el *EventLoop) CloseSession(session Session, reason error) {
+	recordCloseReason(session, reason)
+	fds := session.GetFds()
+	for _, fd := range fds {
+		err := el.DeletePoll(fd)
+		if err != nil {
+			log.Error().Msgf("[%d] error occurs while detaching fd from netpoll: %v", fd, err)
+		}
+	}
+	if reason != closedSession {
+		logger := session.Logger()
+		if closedByProxy(reason) {
+			logger.Info().Msgf("%v session is closed: %v", fds, reason)
+		} else if reason != finishedSession {
+			logger.Error().Msgf("%v error occurs in event-loop: %v", fds, reason)
+		}
+		err := session.Close()
+		if err != nil {
+			logger.Error().Msgf("%v error occurs while closing session: %v", fds, err)
+		}
+	}
+	el.sessionHolder.RemoveSession(session)
+}
+
+func (el *EventLoop) Ready(session Session, fd int) {
+	el.ready = append(el.ready, readyFd{session: session, fd: fd})
+}
+
+func (el *EventLoop) processReady() {
+	if len(el.ready) == 0 {
+		return
+	}
+	ready := el.ready
+	el.ready = el.processingReady[:0]
+	for i, r := range ready {
+		ready[i] = readyFd{}
+		// the session could be closed while it was waiting in the list
+		session, err := el.sessionHolder.FindSessionByFd(r.fd)
+		if err != nil || session != r.session {
+			continue
+		}
+		el.handlerStarted()
+		err = el.handler.ReadEvent(session, r.fd)
+		if err != nil {
+			el.CloseSession(session, err)
+		}
+	}
+	el.processingReady = ready[:0]
+}
+
+// parseErrors Returns the pending error of the socket which the error event reports.
+func parseErrors(fd int, events uint32) []error {
+	if pollErr&events == 0 {
+		return nil
+	}
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return []error{os.NewSyscallError("getsockopt", err)}
+	}
+	if soErr != 0 {
+		return []error{os.NewSyscallError("socket", unix.Errno(soErr))}
+	}
+	return []error{pollError}
 }
 
 func (el *EventLoop) PollForRead(fd int) error {
-	return el.poller.addRead(fd)
+	err := el.poller.Add(fd, true, false)
+	if err == nil {
+		el.metrics.registeredFds.Inc()
+	}
+	return err
+}
+
+// pollListener Registers the listener for the accepts by the poller when it can accept, for the readiness otherwise.
+func (el *EventLoop) pollListener(fd int) error {
+	poller, ok := el.poller.(acceptPoller)
+	if !ok {
+		return el.PollForRead(fd)
+	}
+	err := poller.AddAccept(fd)
+	if err == nil {
+		el.metrics.registeredFds.Inc()
+	}
+	return err
+}
+
+func (el *EventLoop) ModifyPoll(fd int, read, write bool) error {
+	return el.poller.Modify(fd, read, write)
+}
+
+// RecvFd Starts receiving the bytes of the fd by the poller when it supports the receive, the fd is read
+// by the session otherwise.
+func (el *EventLoop) RecvFd(fd int) bool {
+	poller, ok := el.poller.(recvPoller)
+	if !ok {
+		return false
+	}
+	recv, err := poller.Recv(fd)
+	if err != nil {
+		log.Error().Msgf("[%d] can't receive fd by %s poller: %v", fd, el.poller.Name(), err)
+	}
+	return recv
+}
+
+func (el *EventLoop) PeekReceived(fd int) ([]byte, error) {
+	return el.poller.(recvPoller).PeekReceived(fd)
+}
+
+func (el *EventLoop) ConsumeReceived(fd int, n int) {
+	el.poller.(recvPoller).ConsumeReceived(fd, n)
+}
+
+func (el *EventLoop) Schedule(delay time.Duration, callback func()) *Timer {
+	return el.timers.schedule(time.Now(), delay, callback)
+}
+
+func (el *EventLoop) CancelTimer(timer *Timer) {
+	el.timers.cancel(timer)
 }
 
 func (el *EventLoop) DeletePoll(fd int) error {
-	return el.poller.deletePoll(fd)
+	err := el.poller.Delete(fd)
+	if err == nil {
+		el.metrics.registeredFds.Dec()
+	}
+	return err
 }
 
 func (el *EventLoop) PollForReadAndErrors(fds ...int) error {
 	for _, fd := range fds {
-		err := el.poller.addReadErrors(fd)
+		err := el.PollForRead(fd)
 		if err != nil {
 			return err
 		}
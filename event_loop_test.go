@@ -0,0 +1,211 @@
+package dynproxy
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEventLoopExecuteAndStop(t *testing.T) {
+	for _, poller := range testPollers {
+		t.Run(poller, func(t *testing.T) {
+			eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: poller})
+			if err != nil {
+				t.Fatalf("can't create event loop: %+v", err)
+			}
+			if eventLoop.PollerName() != poller {
+				t.Skipf("%s poller isn't available", poller)
+			}
+			stopped := make(chan struct{})
+			go func() {
+				eventLoop.Start(NewBufferHandler(), NewMapSessionProvider(context.Background()))
+				close(stopped)
+			}()
+
+			executed := make(chan struct{})
+			eventLoop.Execute(func() {
+				// the timer is scheduled on the loop thread, so the loop must wake up for it
+				eventLoop.Schedule(10*time.Millisecond, func() {
+					close(executed)
+				})
+			})
+			select {
+			case <-executed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("queued task isn't executed")
+			}
+
+			// the loop is blocked in the poller without any events or timers
+			eventLoop.Stop()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("event loop isn't stopped")
+			}
+		})
+	}
+}
+
+func TestPollerZeroEventBufferSize(t *testing.T) {
+	for _, name := range testPollers {
+		t.Run(name, func(t *testing.T) {
+			// the zero size of the zero value config is raised to the default one
+			poller, err := openPoller(name, 0)
+			if err != nil {
+				t.Fatalf("can't open poller: %+v", err)
+			}
+			defer poller.Close()
+			if poller.Name() != name {
+				t.Skipf("%s poller isn't available", name)
+			}
+			fds := make([]int, 2)
+			if err = unix.Pipe2(fds, unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+				t.Fatalf("can't create pipe: %+v", err)
+			}
+			defer unix.Close(fds[0])
+			defer unix.Close(fds[1])
+			if err = poller.Add(fds[0], true, false); err != nil {
+				t.Fatalf("can't add fd: %+v", err)
+			}
+			unix.Write(fds[1], []byte("x"))
+			ready := false
+			for deadline := time.Now().Add(5 * time.Second); !ready && time.Now().Before(deadline); {
+				_, err = poller.Wait(100, func(fd int, events uint32) {
+					ready = ready || (fd == fds[0] && events&readEvents != 0)
+				})
+				if err != nil {
+					t.Fatalf("can't wait for events: %+v", err)
+				}
+			}
+			if !ready {
+				t.Fatalf("readiness of fd isn't reported")
+			}
+		})
+	}
+}
+
+func TestEventLoopAccept(t *testing.T) {
+	for _, poller := range testPollers {
+		t.Run(poller, func(t *testing.T) {
+			eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: poller})
+			if err != nil {
+				t.Fatalf("can't create event loop: %+v", err)
+			}
+			if eventLoop.PollerName() != poller {
+				t.Skipf("%s poller isn't available", poller)
+			}
+			go eventLoop.Start(NewBufferHandler(), NewMapSessionProvider(context.Background()))
+			defer eventLoop.Stop()
+			fd, addr, err := listenTcp("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("can't listen: %+v", err)
+			}
+			accepted := make(chan *fdConn, 256)
+			eventLoop.Listen("TestFrontend", fd, func(conn *fdConn) {
+				accepted <- conn
+			})
+			// the backlog can exceed one accept batch, the rest is accepted without new readiness events
+			clients := 3 * acceptBatchSize
+			for i := 0; i < clients; i++ {
+				conn, err := net.Dial("tcp", addr.String())
+				if err != nil {
+					t.Fatalf("can't connect: %+v", err)
+				}
+				defer conn.Close()
+			}
+			for i := 0; i < clients; i++ {
+				select {
+				case conn := <-accepted:
+					if conn.RemoteAddr() == nil || conn.LocalAddr().String() != addr.String() {
+						t.Fatalf("unexpected addresses of accepted connection: %v %v", conn.RemoteAddr(), conn.LocalAddr())
+					}
+					conn.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatalf("accepted %d connections of %d", i, clients)
+				}
+			}
+		})
+	}
+}
+
+func TestEventLoopStats(t *testing.T) {
+	eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256})
+	if err != nil {
+		t.Fatalf("can't create event loop: %+v", err)
+	}
+	go eventLoop.Start(NewBufferHandler(), NewMapSessionProvider(context.Background()))
+	defer eventLoop.Stop()
+	fd, addr, err := listenTcp("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %+v", err)
+	}
+	accepted := make(chan *fdConn, 1)
+	eventLoop.Listen("TestFrontend", fd, func(conn *fdConn) {
+		accepted <- conn
+	})
+	// the connection is accepted on the readiness event, not by the initial accept of the listener
+	listening := make(chan struct{})
+	eventLoop.Execute(func() { close(listening) })
+	<-listening
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	defer conn.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection isn't accepted")
+	}
+
+	// the iteration is recorded after the handlers are done
+	stats := eventLoop.Stats()
+	for deadline := time.Now().Add(5 * time.Second); stats.Events == 0 && time.Now().Before(deadline); stats = eventLoop.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Wakeups == 0 || stats.Events == 0 || stats.MaxEventsPerWakeup == 0 {
+		t.Fatalf("wakeups aren't counted: %+v", stats)
+	}
+	if stats.RegisteredFds != 1 {
+		t.Fatalf("expected only listener fd to be registered, got: %d", stats.RegisteredFds)
+	}
+	handlers := uint64(0)
+	for _, bucket := range stats.LagHistogram {
+		handlers += bucket.Count
+	}
+	if handlers < stats.Events {
+		t.Fatalf("lag of %d handlers is recorded for %d events", handlers, stats.Events)
+	}
+	if stats.BusyTime <= 0 || stats.BusyTime > stats.Uptime {
+		t.Fatalf("unexpected busy time %s of uptime %s", stats.BusyTime, stats.Uptime)
+	}
+}
+
+func TestEventLoopErrorEvent(t *testing.T) {
+	eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256})
+	if err != nil {
+		t.Fatalf("can't create event loop: %+v", err)
+	}
+	defer eventLoop.poller.Close()
+	holder := NewMapSessionProvider(context.Background())
+	eventLoop.sessionHolder = holder
+	eventLoop.handler = NewBufferHandler()
+	frontConn, backendConn := tcpPair(t)
+	session, err := NewProxySession(frontConn, backendConn, nil, ProxySessionConfig{})
+	if err != nil {
+		t.Fatalf("can't create session: %+v", err)
+	}
+	eventLoop.RegisterSession(session)
+
+	// the loop closes the session by the error of the event and records it as the close reason
+	eventLoop.processEvent(session.GetFds()[0], pollErr)
+	if reason := session.GetStats().CloseReason; reason != pollError {
+		t.Fatalf("expected %v close reason, got: %v", pollError, reason)
+	}
+	if sessions := holder.ListSessions(); len(sessions) != 0 {
+		t.Fatalf("closed session is still registered: %+v", sessions)
+	}
+}
@@ -0,0 +1,34 @@
+package dynproxy
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"unsafe"
+)
+
+// openWakeupFd Opens the eventfd which is used to interrupt the poller wait from the other threads.
+func openWakeupFd() (int, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return -1, os.NewSyscallError("eventfd", err)
+	}
+	return fd, nil
+}
+
+func writeWakeupFd(fd int) error {
+	var value uint64 = 1
+	_, err := unix.Write(fd, (*(*[8]byte)(unsafe.Pointer(&value)))[:])
+	// the counter is full, so the poller is going to be woken up anyway
+	if err == unix.EAGAIN {
+		return nil
+	}
+	if err != nil {
+		return os.NewSyscallError("write eventfd", err)
+	}
+	return nil
+}
+
+func drainWakeupFd(fd int) {
+	var value [8]byte
+	unix.Read(fd, value[:])
+}
@@ -20,12 +20,14 @@ import (
 var serverIp string
 var serverPort int
 var privateKeyPath string
-var eventLoop *dynproxy.EventLoop
+var engineName string
+var engine dynproxy.Engine
 
 func init() {
 	flag.StringVar(&serverIp, "ip", "10.0.0.81", "listening ip address.")
 	flag.StringVar(&privateKeyPath, "pk", "/home/igor/ca/server.pk", "path to private key")
 	flag.IntVar(&serverPort, "p", 3030, "listening port.")
+	flag.StringVar(&engineName, "engine", dynproxy.EventLoopEngine, "engine serving the sessions: event_loop or goroutine.")
 	flag.Parse()
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -59,16 +61,13 @@ func main() {
 		handler:   dynproxy.NewBufferHandler(),
 		eventChan: make(chan dynproxy.Event, 100),
 	}
-	eventLoop, err = dynproxy.NewEventLoop(dynproxy.EventLoopConfig{
+	engine = dynproxy.NewEngine(engineName, dynproxy.EventLoopConfig{
 		Name:            "MainLoop",
 		EventBufferSize: 256,
 		LockOsThread:    true,
 	})
-	if err != nil {
-		log.Fatal().Msgf("can't create event loop: %+v", err)
-	}
 
-	go eventLoop.Start(srv.handler, srv.streams)
+	go engine.Start(srv.handler, srv.streams)
 	srv.listenTcp()
 	wg.Wait()
 }
@@ -112,11 +111,7 @@ func (s *server) handleAcceptConnection(ln *net.TCPListener) {
 			log.Error().Msgf("can't create new client session %+v", err)
 			continue
 		}
-		s.streams.AddSession(session)
-		err = eventLoop.PollForReadAndErrors(session.GetFds()...)
-		if err != nil {
-			log.Info().Msgf("can't add read fd to epoll %+v", err)
-		}
+		engine.Serve(session)
 	}
 	log.Info().Msg("finished to accepting tcp connections")
 }
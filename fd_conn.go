@@ -0,0 +1,334 @@
+package dynproxy
+
+import (
+	"go.uber.org/atomic"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// fdConn is net.Conn over the non-blocking socket fd which is owned by the proxy, not by the Go runtime.
+// The event loop uses the fd directly, blocking Read and Write wait with poll(2) and are used only
+// out of the event loop (e.g. by the TLS handshake).
+type fdConn struct {
+	fd            int
+	local         net.Addr
+	remote        net.Addr
+	lock          sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        *atomic.Bool
+	// connecting the connect is in progress, the session finishes it on the event loop within connectTimeout
+	connecting     bool
+	connectTimeout time.Duration
+}
+
+func newFdConn(fd int, remote net.Addr) *fdConn {
+	return &fdConn{
+		fd:     fd,
+		remote: remote,
+		closed: atomic.NewBool(false),
+	}
+}
+
+func (c *fdConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		n, err := readFd(c.fd, b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		err = c.wait(unix.POLLIN, c.deadline(&c.readDeadline))
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *fdConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := writeFd(c.fd, b[written:])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		if written < len(b) {
+			err = c.wait(unix.POLLOUT, c.deadline(&c.writeDeadline))
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// wait Waits for the fd readiness, changes of the deadline don't interrupt the wait.
+func (c *fdConn) wait(events int16, deadline time.Time) error {
+	for {
+		if c.closed.Load() {
+			return net.ErrClosed
+		}
+		timeout := -1
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timeout = int((left + time.Millisecond - 1) / time.Millisecond)
+		}
+		fds := []unix.PollFd{{Fd: int32(c.fd), Events: events}}
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("poll", err)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+}
+
+func (c *fdConn) deadline(deadline *time.Time) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return *deadline
+}
+
+func (c *fdConn) Close() error {
+	if !c.closed.CAS(false, true) {
+		return net.ErrClosed
+	}
+	return os.NewSyscallError("close", unix.Close(c.fd))
+}
+
+func (c *fdConn) CloseWrite() error {
+	return os.NewSyscallError("shutdown", unix.Shutdown(c.fd, unix.SHUT_WR))
+}
+
+func (c *fdConn) LocalAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.local == nil {
+		sa, err := unix.Getsockname(c.fd)
+		if err != nil {
+			return nil
+		}
+		c.local = sockaddrToAddr(sa)
+	}
+	return c.local
+}
+
+func (c *fdConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *fdConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *fdConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *fdConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// listenTcp Opens the non-blocking listening socket.
+func listenTcp(network, address string) (int, net.Addr, error) {
+	tcpAddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return -1, nil, err
+	}
+	fd, sa, err := openTcpSocket(tcpAddr)
+	if err != nil {
+		return -1, nil, err
+	}
+	err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1))
+	if err == nil {
+		err = os.NewSyscallError("bind", unix.Bind(fd, sa))
+	}
+	if err == nil {
+		err = os.NewSyscallError("listen", unix.Listen(fd, unix.SOMAXCONN))
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	name, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, os.NewSyscallError("getsockname", err)
+	}
+	return fd, sockaddrToTcpAddr(name), nil
+}
+
+// dialTcp Starts connecting the non-blocking socket, the connection owns the fd.
+func dialTcp(network, address string, timeout time.Duration) (*fdConn, error) {
+	tcpAddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	fd, sa, err := openTcpSocket(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newFdConn(fd, tcpAddr)
+	err = conn.startConnect(sa, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: tcpAddr, Err: os.NewSyscallError("connect", err)}
+	}
+	return conn, nil
+}
+
+// startConnect Starts connecting the non-blocking socket, the connection in progress is finished by finishConnect
+// on the write readiness of the socket, so the caller never waits for the backend.
+func (c *fdConn) startConnect(sa unix.Sockaddr, timeout time.Duration) error {
+	err := unix.Connect(c.fd, sa)
+	for err == unix.EINTR {
+		err = unix.Connect(c.fd, sa)
+	}
+	if err == unix.EINPROGRESS {
+		c.connecting = true
+		c.connectTimeout = timeout
+		return nil
+	}
+	return err
+}
+
+// finishConnect Returns true when the connect in progress succeeded, false when it's still in progress.
+func (c *fdConn) finishConnect() (bool, error) {
+	soErr, err := unix.GetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && soErr != 0 {
+		err = unix.Errno(soErr)
+	}
+	if err == nil {
+		_, err = unix.Getpeername(c.fd)
+		if err == unix.ENOTCONN {
+			return false, nil
+		}
+	}
+	c.connecting = false
+	if err != nil {
+		return false, &net.OpError{Op: "dial", Net: c.remote.Network(), Addr: c.remote, Err: os.NewSyscallError("connect", err)}
+	}
+	return true, nil
+}
+
+func openTcpSocket(tcpAddr *net.TCPAddr) (int, unix.Sockaddr, error) {
+	return openSocket(tcpAddr.IP, tcpAddr.Port, unix.SOCK_STREAM)
+}
+
+func openSocket(ip net.IP, port int, sotype int) (int, unix.Sockaddr, error) {
+	family, sa := ipSockaddr(ip, port)
+	fd, err := unix.Socket(family, sotype|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, os.NewSyscallError("socket", err)
+	}
+	return fd, sa, nil
+}
+
+// ipSockaddr Returns the address family and the socket address of the ip, nil ip is the IPv4 wildcard.
+func ipSockaddr(ip net.IP, port int) (int, unix.Sockaddr) {
+	if ip4 := ip.To4(); ip == nil || ip4 != nil {
+		sa4 := &unix.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		return unix.AF_INET, sa4
+	}
+	sa6 := &unix.SockaddrInet6{Port: port}
+	copy(sa6.Addr[:], ip.To16())
+	return unix.AF_INET6, sa6
+}
+
+func sockaddrToTcpAddr(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	case *unix.SockaddrInet6:
+		return &net.TCPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	}
+	return nil
+}
+
+// sockaddrToAddr Returns the address of the stream socket.
+func sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	if sa, ok := sa.(*unix.SockaddrUnix); ok {
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	}
+	return sockaddrToTcpAddr(sa)
+}
+
+func sockaddrToUdpAddr(sa unix.Sockaddr) *net.UDPAddr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.UDPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	case *unix.SockaddrInet6:
+		return &net.UDPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	}
+	return nil
+}
+
+// listenUdp Opens the non-blocking datagram socket bound to the address.
+func listenUdp(network, address string) (int, net.Addr, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return -1, nil, err
+	}
+	fd, sa, err := openSocket(udpAddr.IP, udpAddr.Port, unix.SOCK_DGRAM)
+	if err != nil {
+		return -1, nil, err
+	}
+	err = os.NewSyscallError("bind", unix.Bind(fd, sa))
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	name, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, os.NewSyscallError("getsockname", err)
+	}
+	return fd, sockaddrToUdpAddr(name), nil
+}
+
+// dialUdp Connects the non-blocking datagram socket, so it receives the datagrams of the address only.
+func dialUdp(network, address string) (*fdConn, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	fd, sa, err := openSocket(udpAddr.IP, udpAddr.Port, unix.SOCK_DGRAM)
+	if err != nil {
+		return nil, err
+	}
+	conn := newFdConn(fd, udpAddr)
+	err = unix.Connect(fd, sa)
+	if err == nil {
+		var name unix.Sockaddr
+		name, err = unix.Getsockname(fd)
+		conn.local = sockaddrToUdpAddr(name)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: udpAddr, Err: os.NewSyscallError("connect", err)}
+	}
+	return conn, nil
+}
@@ -0,0 +1,107 @@
+package dynproxy
+
+import (
+	"net"
+	"sync"
+)
+
+// Direction of the session data, Upstream is from the client to the backend.
+type Direction int
+
+const (
+	Upstream Direction = iota
+	Downstream
+)
+
+// Filter intercepts the lifecycle of one session, every accepted connection gets its own filters from the chain
+// of the frontend, so the filter can keep the state of the session. OnAccept is called on the accepting thread,
+// the other hooks are called on the loop of the session, so the hooks must not block.
+type Filter interface {
+	// OnAccept Is called for the accepted client connection, the error rejects the connection
+	OnAccept(conn net.Conn) error
+	// OnBackendSelected Is called when the connection to the backend is opened, the error closes the session
+	OnBackendSelected(identity SessionIdentity, backend net.Conn) error
+	// OnData Returns the data passed to the next filter and to the peer, the empty result drops the data or keeps it
+	// in the filter. The data is reused after the call, so the filter copies the bytes it keeps. The nil data is passed
+	// once the peer finished sending, then the filter returns the bytes it still keeps. The error closes the session.
+	OnData(direction Direction, data []byte) ([]byte, error)
+	// OnClose Is called once the filter saw OnAccept, when the session is closed or the connection is dropped
+	// before the session is created, CloseReason of the stats is set then
+	OnClose(stats SessionStats)
+}
+
+// FilterFactory Creates the filter of the new connection.
+type FilterFactory func() Filter
+
+// FilterChain is the filters of the frontend in the order they see the upstream data.
+type FilterChain []FilterFactory
+
+// BaseFilter passes everything through, the filters embed it to implement only the hooks they need.
+type BaseFilter struct{}
+
+func (BaseFilter) OnAccept(conn net.Conn) error {
+	return nil
+}
+
+func (BaseFilter) OnBackendSelected(identity SessionIdentity, backend net.Conn) error {
+	return nil
+}
+
+func (BaseFilter) OnData(direction Direction, data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (BaseFilter) OnClose(stats SessionStats) {
+}
+
+var filtersLock sync.RWMutex
+var filterFactories = make(map[string]FilterFactory)
+
+// RegisterFilter Registers the filter by the name it's referred by in the config of the frontends.
+func RegisterFilter(name string, factory FilterFactory) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	filterFactories[name] = factory
+}
+
+// NewFilterChain Returns the chain of the registered filters by names.
+func NewFilterChain(names []string) (FilterChain, error) {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	chain := make(FilterChain, 0, len(names))
+	for _, name := range names {
+		factory, ok := filterFactories[name]
+		if !ok {
+			return nil, unknownFilter
+		}
+		chain = append(chain, factory)
+	}
+	return chain, nil
+}
+
+// accept Creates the filters of the connection and calls OnAccept of them, the filters which accepted
+// the connection are closed when the later one rejects it.
+func (c FilterChain) accept(conn net.Conn) ([]Filter, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	filters := make([]Filter, 0, len(c))
+	for _, factory := range c {
+		filter := factory()
+		err := filter.OnAccept(conn)
+		if err != nil {
+			closeFilters(filters, err)
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// closeFilters Calls OnClose of the filters of the connection which is dropped before its session is created.
+func closeFilters(filters []Filter, reason error) {
+	stats := SessionStats{CloseReason: reason}
+	for _, filter := range filters {
+		filter.OnClose(stats)
+	}
+}
@@ -0,0 +1,208 @@
+package dynproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// lineFilter buffers the upstream bytes until the end of line and sends the line in upper case,
+// the last line without the end is sent when the client finished sending.
+type lineFilter struct {
+	BaseFilter
+	line []byte
+}
+
+func (f *lineFilter) OnData(direction Direction, data []byte) ([]byte, error) {
+	if direction == Downstream {
+		return data, nil
+	}
+	if data == nil {
+		line := bytes.ToUpper(f.line)
+		f.line = nil
+		return line, nil
+	}
+	f.line = append(f.line, data...)
+	end := bytes.LastIndexByte(f.line, '\n')
+	if end < 0 {
+		return nil, nil
+	}
+	line := bytes.ToUpper(f.line[:end+1])
+	f.line = append(f.line[:0], f.line[end+1:]...)
+	return line, nil
+}
+
+// auditFilter reports the lifecycle of the session.
+type auditFilter struct {
+	BaseFilter
+	events chan string
+}
+
+func (f *auditFilter) OnBackendSelected(identity SessionIdentity, backend net.Conn) error {
+	f.events <- "selected"
+	return nil
+}
+
+func (f *auditFilter) OnClose(stats SessionStats) {
+	f.events <- "closed"
+}
+
+type rejectFilter struct {
+	BaseFilter
+}
+
+// failFilter fails the session once the backend is selected.
+type failFilter struct {
+	BaseFilter
+}
+
+func (f *failFilter) OnBackendSelected(identity SessionIdentity, backend net.Conn) error {
+	return errors.New("failed")
+}
+
+func (f *rejectFilter) OnAccept(conn net.Conn) error {
+	return errors.New("rejected")
+}
+
+func TestFilterChain(t *testing.T) {
+	events := make(chan string, 16)
+	RegisterFilter("test-line", func() Filter {
+		return &lineFilter{}
+	})
+	RegisterFilter("test-audit", func() Filter {
+		return &auditFilter{events: events}
+	})
+	RegisterFilter("test-reject", func() Filter {
+		return &rejectFilter{}
+	})
+	_, err := NewFilterChain([]string{"test-line", "missing"})
+	if err != unknownFilter {
+		t.Fatalf("expected unknown filter error, got: %+v", err)
+	}
+	chain, err := NewFilterChain([]string{"test-line", "test-audit"})
+	if err != nil {
+		t.Fatalf("can't create filter chain: %+v", err)
+	}
+	rejecting, err := NewFilterChain([]string{"test-reject"})
+	if err != nil {
+		t.Fatalf("can't create filter chain: %+v", err)
+	}
+
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{SpliceEnabled: true},
+				filters: chain,
+			})
+			defer proxy.Stop()
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("hel"))
+			conn.Write([]byte("lo\nwor"))
+			response := make([]byte, 6)
+			_, err = io.ReadFull(conn, response)
+			if err != nil || string(response) != "HELLO\n" {
+				t.Fatalf("unexpected filtered response %q: %+v", response, err)
+			}
+			// the line kept by the filter is flushed before the half-close reaches the backend
+			conn.(*net.TCPConn).CloseWrite()
+			response, err = io.ReadAll(conn)
+			if err != nil || string(response) != "WOR" {
+				t.Fatalf("unexpected flushed response %q: %+v", response, err)
+			}
+			conn.Close()
+			for _, expected := range []string{"selected", "closed"} {
+				select {
+				case event := <-events:
+					if event != expected {
+						t.Fatalf("expected %s event, got: %s", expected, event)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%s event isn't reported", expected)
+				}
+			}
+
+			proxyAddr, rejectingProxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				filters: rejecting,
+			})
+			defer rejectingProxy.Stop()
+			conn, err = net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			if err != io.EOF {
+				t.Fatalf("rejected connection isn't closed: %+v", err)
+			}
+		})
+	}
+}
+
+func TestFilterCloseOnDrop(t *testing.T) {
+	events := make(chan string, 16)
+	audit := func() Filter {
+		return &auditFilter{events: events}
+	}
+	expectClosed := func(t *testing.T) {
+		select {
+		case event := <-events:
+			if event != "closed" {
+				t.Fatalf("expected closed event, got: %s", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("closed event isn't reported")
+		}
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// the later filter rejects the connection accepted by the earlier one
+	_, err := FilterChain{audit, func() Filter { return &rejectFilter{} }}.accept(server)
+	if err == nil {
+		t.Fatalf("connection isn't rejected")
+	}
+	expectClosed(t)
+
+	// the manager falls behind and the connection is dropped
+	frontend := &Frontend{Name: "TestFrontend", Filters: FilterChain{audit}, connChannel: make(chan *newConn)}
+	frontend.handleNewConnection(server, "backend")
+	expectClosed(t)
+
+	// the session fails on the selected backend
+	backend := startEchoServer(t)
+	defer backend.Close()
+	frontConn, err := net.Dial("tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	defer frontConn.Close()
+	backendConn, err := net.Dial("tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	defer backendConn.Close()
+	filters, err := FilterChain{audit, func() Filter { return &failFilter{} }}.accept(frontConn)
+	if err != nil {
+		t.Fatalf("can't accept connection: %+v", err)
+	}
+	_, err = NewProxySession(frontConn, backendConn, nil, ProxySessionConfig{Filters: filters})
+	if err == nil {
+		t.Fatalf("session isn't failed by filter")
+	}
+	if event := <-events; event != "selected" {
+		t.Fatalf("expected selected event, got: %s", event)
+	}
+	expectClosed(t)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"io/ioutil"
 	"net"
+	"time"
 )
 
 type Frontend struct {
@@ -18,8 +19,30 @@ type Frontend struct {
 	Name            string
 	defaultBalancer string
 	TlsConfig       *TlsConfig
+	SessionConfig   ProxySessionConfig
+	// HandshakeTimeout and MaxHandshakes limit the TLS handshakes, defaults are used when they aren't set
+	HandshakeTimeout time.Duration
+	MaxHandshakes    int
+	SocketBuffers    SocketBuffers
+	// UnixSocket permissions and ownership of the socket file of the unix frontend
+	UnixSocket UnixSocketConfig
+	// PeerRoutes choose the backend group by the credentials of the unix socket peer, the first matched route
+	// overrides the sniffed and the default groups
+	PeerRoutes []PeerRoute
+	// Filters creates the filters of every accepted connection
+	Filters FilterChain
+	// Sniff chooses the backend group and TLS termination by the first bytes of the connection when it's set
+	Sniff           *SniffConfig
 	connChannel     chan *newConn
 	ocspProc        *OCSPProcessor
+	handshakes      *handshakePool
+	serverTlsConfig *tls.Config
+	sniffer         *sniffer
+	peerRoutes      []peerRoute
+	relay           *udpRelay
+	events          chan Event
+	engine          Engine
+	listener        Listener
 }
 
 type TlsConfig struct {
@@ -32,57 +55,127 @@ type TlsConfig struct {
 	caCertPool   *x509.CertPool
 }
 
+// Listen Opens the listening socket, the connections are accepted by the engine.
 func (f *Frontend) Listen() error {
-	listener, err := f.listen()
-	if err != nil {
-		return err
+	if f.Net == "udp" || f.Net == "udp4" || f.Net == "udp6" {
+		return f.listenPacket()
+	}
+	onAccept := func(conn net.Conn) {
+		f.handleTcpAccept(conn, f.defaultBalancer)
 	}
 	if f.TlsConfig != nil {
-		listener = f.listenTls(listener)
-		go f.handleTlsAccept(listener)
-	} else {
-		go f.handleTcpAccept(listener)
+		f.handshakes = newHandshakePool(f.Name, f.HandshakeTimeout, f.MaxHandshakes)
+		f.serverTlsConfig = f.tlsServerConfig()
+		onAccept = func(conn net.Conn) {
+			f.handleTlsAccept(conn, f.defaultBalancer)
+		}
 	}
-	return nil
-}
-func (f *Frontend) handleTcpAccept(listener net.Listener) {
-	for {
-		conn, err := listener.Accept()
+	if f.Sniff != nil {
+		for _, rule := range f.Sniff.Rules {
+			if rule.TerminateTls && f.TlsConfig == nil {
+				return tlsNotConfigured
+			}
+		}
+		sniffer, err := newSniffer(f.Name, *f.Sniff, f.handleSniffed)
 		if err != nil {
-			log.Printf("got error while accept connection: %+v", err)
-			continue
+			return err
 		}
-		setSocketOptions(conn)
-		f.handleNewConnection(conn)
+		f.sniffer = sniffer
+		onAccept = f.sniffer.submit
 	}
-}
-
-func (f *Frontend) handleTlsAccept(listener net.Listener) {
-	for {
-		conn, err := listener.Accept()
+	if f.Net == "unix" {
+		peerRoutes, err := resolvePeerRoutes(f.PeerRoutes)
 		if err != nil {
-			log.Error().Msgf("got error while accept connection: %+v", err)
+			return err
 		}
-		tlsConn, ok := conn.(*tls.Conn)
-		if !ok {
-			log.Error().Msg("error in casting *net.Conn to *net.TCPConn!")
-		} else {
-			err := tlsConn.Handshake()
-			if err != nil {
-				log.Error().Msgf("TLS handshake error: %+v", err)
-				tlsConn.Close()
-				// TODO: notify about client error
-				continue
-			}
-			setSocketOptions(tlsConn)
-			f.handleNewConnection(tlsConn)
+		f.peerRoutes = peerRoutes
+		err = removeStaleSocket(f.Address)
+		if err != nil {
+			return err
 		}
 	}
+	listener, err := f.engine.Accept(f.Name, f.Net, f.Address, onAccept)
+	if err != nil {
+		return err
+	}
+	if f.Net == "unix" {
+		err = f.UnixSocket.apply(f.Address)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	f.listener = listener
+	log.Info().Msgf("[%s] listening on %s", f.Name, listener.Addr())
+	return nil
 }
 
-func (f *Frontend) listenTls(listener net.Listener) net.Listener {
+// listenPacket Opens the UDP socket of the frontend, the datagrams of every client address are relayed by its own session.
+func (f *Frontend) listenPacket() error {
+	f.relay = newUdpRelay(f)
+	listener, err := f.engine.ListenPacket(f.Name, f.Net, f.Address, f.relay.handlePacket)
+	if err != nil {
+		return err
+	}
+	f.relay.setListener(listener)
+	f.listener = listener
+	log.Info().Msgf("[%s] listening on %s/%s", f.Name, listener.Addr(), f.Net)
+	return nil
+}
+
+// Close Stops accepting the connections of the frontend.
+func (f *Frontend) Close() {
+	f.listener.Close()
+}
+
+// Addr Returns the address of the listening socket.
+func (f *Frontend) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *Frontend) handleTcpAccept(conn net.Conn, backend string) {
+	setSocketOptions(conn, f.SocketBuffers)
+	f.handleNewConnection(conn, backend)
+}
+
+// handleTlsAccept Hands the accepted connection to the handshake pool, the connection is moved to the event loop after the handshake.
+func (f *Frontend) handleTlsAccept(conn net.Conn, backend string) {
+	serverConn, err := newTlsServerConn(conn, f.serverTlsConfig)
+	if err != nil {
+		log.Error().Msgf("can't create TLS connection: %+v", err)
+		conn.Close()
+		return
+	}
+	setSocketOptions(serverConn, f.SocketBuffers)
+	f.handshakes.submit(serverConn, func(conn *tlsConn) {
+		f.handleNewConnection(conn, backend)
+	})
+}
+
+// handleSniffed Serves the sniffed connection as the matched rule says, the peeked bytes are still in the socket.
+func (f *Frontend) handleSniffed(conn net.Conn, rule *SniffRule) {
+	backend := rule.Backend
+	if backend == "" {
+		backend = f.defaultBalancer
+	}
+	if rule.TerminateTls {
+		f.handleTlsAccept(conn, backend)
+		return
+	}
+	f.handleTcpAccept(conn, backend)
+}
+
+// HandshakeStats Returns the outcomes of the TLS handshakes of the frontend.
+func (f *Frontend) HandshakeStats() HandshakeStats {
+	if f.handshakes == nil {
+		return HandshakeStats{}
+	}
+	return f.handshakes.stats()
+}
+
+func (f *Frontend) tlsServerConfig() *tls.Config {
 	f.initTlsConfig()
-	config := &tls.Config{
+	return &tls.Config{
 		InsecureSkipVerify:    f.TlsConfig.SkipVerify,
 		ClientAuth:            tls.RequireAndVerifyClientCert,
 		ClientCAs:             f.TlsConfig.caCertPool,
@@ -91,11 +184,6 @@ func (f *Frontend) listenTls(listener net.Listener) net.Listener {
 		VerifyPeerCertificate: f.verifyClientCert,
 		//ClientSessionCache: tls.NewLRUClientSessionCache(500),
 	}
-	return tls.NewListener(listener, config)
-}
-
-func (f *Frontend) listen() (net.Listener, error) {
-	return net.Listen(f.Net, f.Address)
 }
 
 func (f *Frontend) getFrontendCert(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
@@ -164,10 +252,30 @@ func (f *Frontend) addOcspStaple(cert *tls.Certificate, caCert *x509.Certificate
 	return nil
 }
 
-func (f *Frontend) handleNewConnection(conn net.Conn) {
-	f.connChannel <- &newConn{
-		frontend: conn,
-		backend:  f.defaultBalancer,
+// handleNewConnection Passes the connection to the session manager. It's called on the event loop thread,
+// so the connection is dropped instead of blocking when the manager falls behind.
+func (f *Frontend) handleNewConnection(conn net.Conn, backend string) {
+	if len(f.peerRoutes) > 0 {
+		backend = routeByPeer(f.peerRoutes, conn, backend)
+	}
+	filters, err := f.Filters.accept(conn)
+	if err != nil {
+		log.Info().Msgf("[%s] connection from %s is rejected by filter: %+v", f.Name, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	sessionConfig := f.SessionConfig
+	sessionConfig.Filters = filters
+	select {
+	case f.connChannel <- &newConn{
+		frontend:      conn,
+		backend:       backend,
+		sessionConfig: sessionConfig,
+	}:
+	default:
+		log.Warn().Msgf("[%s] too many pending connections, drop connection from: %s", f.Name, conn.RemoteAddr())
+		closeFilters(filters, tooManyPendingConns)
+		conn.Close()
 	}
 }
 
@@ -0,0 +1,403 @@
+package dynproxy
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// goroutineEngine serves every direction of the session by its own goroutine which copies the bytes with io.Copy,
+// the plain blocking Read and Write of the connections wait with the Go runtime netpoller. It doesn't share the I/O
+// path with the event loop, so it's the reference the loop is compared with, and it works on every architecture.
+type goroutineEngine struct {
+	name      string
+	handler   NetEventHandler
+	holder    SessionHolder
+	buffers   *BufferPool
+	metrics   *loopMetrics
+	started   chan struct{}
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	lock      sync.Mutex
+	listeners map[Listener]struct{}
+}
+
+// streamSession is the session which can be served by the goroutine engine.
+type streamSession interface {
+	Session
+	// streams Starts the timers of the session and returns its directions
+	streams(controller LoopController) []goStream
+}
+
+// goStream is one direction of the session, io.Copy moves the bytes from src to dst. The bytes read from src
+// pass forward on the way, nil data is the end of src. The reads are paused for the delay of the rate limits.
+// end is called once src is drained and everything is written to dst, its error closes the session.
+// src is read into the buffer of bufferSize, the max read size of the pool is used when it isn't set.
+type goStream struct {
+	src        io.Reader
+	dst        io.Writer
+	forward    func(data []byte) (out []byte, delay time.Duration, err error)
+	end        func() error
+	bufferSize int
+}
+
+// goSession is the LoopController of the session served by the goroutine engine. forward and end of the streams,
+// the timers and the tasks are serialized by the session lock, so the session code never runs concurrently.
+type goSession struct {
+	engine  *goroutineEngine
+	session Session
+	lock    sync.Mutex
+	timers  map[*Timer]struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+// goReader reads src of the stream and passes the bytes through the session, io.Copy writes every forwarded
+// chunk to dst at once, so the datagrams aren't split.
+type goReader struct {
+	session *goSession
+	stream  goStream
+	buf     []byte
+	// rest of the chunk which didn't fit the read
+	rest []byte
+	eof  bool
+}
+
+func NewGoroutineEngine(config EventLoopConfig) Engine {
+	log.Info().Msgf("event loop %s uses goroutine engine", config.Name)
+	return &goroutineEngine{
+		name:      config.Name,
+		buffers:   newSyncBufferPool(config.Buffers),
+		metrics:   newLoopMetrics(),
+		started:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+		listeners: make(map[Listener]struct{}),
+	}
+}
+
+func (e *goroutineEngine) Start(handler NetEventHandler, holder SessionHolder) {
+	e.handler = handler
+	e.holder = holder
+	close(e.started)
+	<-e.stopped
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for ln := range e.listeners {
+		ln.Close()
+	}
+}
+
+func (e *goroutineEngine) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopped)
+	})
+}
+
+func (e *goroutineEngine) Accept(name, network, address string, onAccept func(conn net.Conn)) (Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	e.listeners[ln] = struct{}{}
+	e.lock.Unlock()
+	go e.accept(name, ln, onAccept)
+	return ln, nil
+}
+
+func (e *goroutineEngine) accept(name string, ln net.Listener, onAccept func(conn net.Conn)) {
+	backoff := time.Duration(0)
+	for {
+		conn, err := ln.Accept()
+		if err == nil {
+			backoff = 0
+			onAccept(conn)
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			e.lock.Lock()
+			delete(e.listeners, ln)
+			e.lock.Unlock()
+			return
+		}
+		if backoff == 0 {
+			backoff = minAcceptBackoff
+		} else if backoff < maxAcceptBackoff {
+			backoff *= 2
+		}
+		log.Error().Msgf("[%s] got error while accepting connection, pause accepting for %s: %+v", name, backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// ListenPacket Opens the datagram socket which is read by its own goroutine.
+func (e *goroutineEngine) ListenPacket(name, network, address string, onPacket func(data []byte, addr *net.UDPAddr)) (PacketListener, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	ln := &goPacketListener{conn}
+	e.lock.Lock()
+	e.listeners[ln] = struct{}{}
+	e.lock.Unlock()
+	go e.readPackets(name, ln, onPacket)
+	return ln, nil
+}
+
+func (e *goroutineEngine) readPackets(name string, ln *goPacketListener, onPacket func(data []byte, addr *net.UDPAddr)) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := ln.ReadFromUDP(buf)
+		if err == nil {
+			onPacket(buf[:n], addr)
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			e.lock.Lock()
+			delete(e.listeners, ln)
+			e.lock.Unlock()
+			return
+		}
+		log.Error().Msgf("[%s] got error while reading datagram: %+v", name, err)
+		time.Sleep(minAcceptBackoff)
+	}
+}
+
+// goPacketListener is the datagram socket of the goroutine engine, the writes are safe for the concurrent sessions.
+type goPacketListener struct {
+	*net.UDPConn
+}
+
+func (l *goPacketListener) Addr() net.Addr {
+	return l.LocalAddr()
+}
+
+func (l *goPacketListener) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	return l.WriteToUDP(data, addr)
+}
+
+func (e *goroutineEngine) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return dialer.Dial(network, address)
+}
+
+// Serve Starts the goroutines of the session directions, the session which isn't a stream session is closed.
+func (e *goroutineEngine) Serve(session Session) {
+	<-e.started
+	stream, ok := session.(streamSession)
+	if !ok {
+		session.Logger().Error().Msgf("%v can't serve session: %v", session.GetFds(), unsupportedEngineSession)
+		session.Close()
+		return
+	}
+	s := &goSession{
+		engine:  e,
+		session: session,
+		timers:  make(map[*Timer]struct{}),
+		done:    make(chan struct{}),
+	}
+	e.metrics.registeredFds.Add(int64(len(session.GetFds())))
+	// the session is registered under the lock, so it can't be killed before its timers are started
+	s.lock.Lock()
+	e.holder.AddSession(session, s)
+	streams := stream.streams(s)
+	s.lock.Unlock()
+	for _, st := range streams {
+		go s.copy(st)
+	}
+}
+
+func (e *goroutineEngine) Stats() EventLoopStats {
+	return e.metrics.stats(e.name, 0)
+}
+
+// copy Copies the stream until src is drained, the session is closed by the error of the copy or of the end.
+func (s *goSession) copy(stream goStream) {
+	size := stream.bufferSize
+	if size <= 0 {
+		size = s.engine.buffers.maxReadSize
+	}
+	buf := s.engine.buffers.Get(size)
+	if cap(buf) < size {
+		// the datagrams are larger than the classes of the pool
+		buf = make([]byte, size)
+	}
+	_, err := io.Copy(stream.dst, &goReader{session: s, stream: stream, buf: buf[:size]})
+	s.engine.buffers.Put(buf)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	if err == nil {
+		err = stream.end()
+		if err == nil {
+			return
+		}
+	}
+	s.CloseSession(s.session, err)
+}
+
+// WriteTo Writes the chunks the session forwards for the bytes read from src until src is drained.
+func (r *goReader) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for {
+		out, err := r.next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(out)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (r *goReader) Read(p []byte) (int, error) {
+	if len(r.rest) == 0 {
+		out, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.rest = out
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// next Returns the next chunk the session forwards, the end of src is forwarded once, so the session can
+// flush the bytes it keeps.
+func (r *goReader) next() ([]byte, error) {
+	for !r.eof {
+		n, err := r.stream.src.Read(r.buf)
+		if n == 0 && err == io.EOF {
+			r.eof = true
+			out, err := r.forward(nil)
+			if err != nil || len(out) > 0 {
+				return out, err
+			}
+			break
+		}
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		out, err := r.forward(r.buf[:n])
+		if err != nil || len(out) > 0 {
+			return out, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// forward Passes the data through the session under its lock and sleeps for the delay of the rate limits.
+func (r *goReader) forward(data []byte) ([]byte, error) {
+	s := r.session
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	started := time.Now()
+	out, delay, err := r.stream.forward(data)
+	s.lock.Unlock()
+	s.engine.metrics.wakeup(1, time.Since(started))
+	if err != nil {
+		return nil, err
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return nil, net.ErrClosed
+		}
+	}
+	return out, nil
+}
+
+// ModifyPoll Does nothing, the directions of the session wait in the blocking reads and writes.
+func (s *goSession) ModifyPoll(fd int, read, write bool) error {
+	return nil
+}
+
+func (s *goSession) Schedule(delay time.Duration, callback func()) *Timer {
+	t := &Timer{callback: callback}
+	s.timers[t] = struct{}{}
+	// the session lock is held by the caller, so the timer is set before the callback can run
+	t.timer = time.AfterFunc(delay, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.closed || t.timer == nil {
+			return
+		}
+		t.timer = nil
+		delete(s.timers, t)
+		t.callback()
+	})
+	return t
+}
+
+func (s *goSession) CancelTimer(timer *Timer) {
+	if timer == nil || timer.timer == nil {
+		return
+	}
+	timer.timer.Stop()
+	timer.timer = nil
+	delete(s.timers, timer)
+}
+
+func (s *goSession) CloseSession(session Session, reason error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	recordCloseReason(session, reason)
+	close(s.done)
+	for t := range s.timers {
+		s.CancelTimer(t)
+	}
+	if reason != closedSession {
+		logger := session.Logger()
+		if closedByProxy(reason) {
+			logger.Info().Msgf("%v session is closed: %v", session.GetFds(), reason)
+		} else if reason != finishedSession {
+			logger.Error().Msgf("%v error occurs in goroutine engine: %v", session.GetFds(), reason)
+		}
+		// the goroutines blocked in the reads and the writes are woken up by closing of the connections
+		err := session.Close()
+		if err != nil {
+			logger.Error().Msgf("%v error occurs while closing session: %v", session.GetFds(), err)
+		}
+	}
+	s.engine.holder.RemoveSession(session)
+	s.engine.metrics.registeredFds.Sub(int64(len(session.GetFds())))
+}
+
+// Ready Does nothing, the reader of the session direction reads until src blocks.
+func (s *goSession) Ready(session Session, fd int) {
+}
+
+func (s *goSession) Execute(task func()) {
+	go func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if !s.closed {
+			task()
+		}
+	}()
+}
+
+func (s *goSession) Buffers() *BufferPool {
+	return s.engine.buffers
+}
@@ -0,0 +1,119 @@
+package dynproxy
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/atomic"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defHandshakeTimeout = 10 * time.Second
+	defMaxHandshakes    = 256
+)
+
+// handshakePool runs the TLS handshakes of the frontend in the bounded number of goroutines. The connections
+// which don't fit into the pool are closed right away, so the accept loop never waits for the slow clients.
+type handshakePool struct {
+	name     string
+	timeout  time.Duration
+	slots    chan struct{}
+	counters *handshakeCounters
+}
+
+type handshakeCounters struct {
+	succeeded *atomic.Uint64
+	timedOut  *atomic.Uint64
+	failed    *atomic.Uint64
+	rejected  *atomic.Uint64
+	lock      sync.Mutex
+	alerts    map[string]uint64
+}
+
+func newHandshakePool(name string, timeout time.Duration, maxHandshakes int) *handshakePool {
+	if timeout <= 0 {
+		timeout = defHandshakeTimeout
+	}
+	if maxHandshakes <= 0 {
+		maxHandshakes = defMaxHandshakes
+	}
+	return &handshakePool{
+		name:    name,
+		timeout: timeout,
+		slots:   make(chan struct{}, maxHandshakes),
+		counters: &handshakeCounters{
+			succeeded: atomic.NewUint64(0),
+			timedOut:  atomic.NewUint64(0),
+			failed:    atomic.NewUint64(0),
+			rejected:  atomic.NewUint64(0),
+			alerts:    make(map[string]uint64),
+		},
+	}
+}
+
+// submit Starts the handshake of the connection, done is called with the established connection. Returns false
+// when the pool is full and the connection is closed.
+func (p *handshakePool) submit(conn *tlsConn, done func(conn *tlsConn)) bool {
+	select {
+	case p.slots <- struct{}{}:
+		go p.handshake(conn, done)
+		return true
+	default:
+		p.counters.rejected.Inc()
+		log.Warn().Msgf("[%s] too many concurrent TLS handshakes, reject connection from: %s", p.name, conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+}
+
+func (p *handshakePool) handshake(conn *tlsConn, done func(conn *tlsConn)) {
+	defer func() { <-p.slots }()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	err := conn.Handshake()
+	if err != nil {
+		p.countError(err)
+		log.Error().Msgf("[%s] TLS handshake error from %s: %+v", p.name, conn.RemoteAddr(), err)
+		conn.Close()
+		// TODO: notify about client error
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	p.counters.succeeded.Inc()
+	done(conn)
+}
+
+// countError Classifies the handshake error: timeout, alert sent by the client or local failure.
+func (p *handshakePool) countError(err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		p.counters.timedOut.Inc()
+		return
+	}
+	p.counters.failed.Inc()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		alert := strings.TrimPrefix(opErr.Err.Error(), "tls: ")
+		p.counters.lock.Lock()
+		p.counters.alerts[alert]++
+		p.counters.lock.Unlock()
+	}
+}
+
+func (p *handshakePool) stats() HandshakeStats {
+	p.counters.lock.Lock()
+	alerts := make(map[string]uint64, len(p.counters.alerts))
+	for alert, count := range p.counters.alerts {
+		alerts[alert] = count
+	}
+	p.counters.lock.Unlock()
+	return HandshakeStats{
+		Succeeded: p.counters.succeeded.Load(),
+		TimedOut:  p.counters.timedOut.Load(),
+		Failed:    p.counters.failed.Load(),
+		Rejected:  p.counters.rejected.Load(),
+		Alerts:    alerts,
+	}
+}
@@ -0,0 +1,89 @@
+package dynproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakePool(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %+v", err)
+	}
+	defer listener.Close()
+	established := make(chan *tlsConn, 1)
+	pool := newHandshakePool("test", 300*time.Millisecond, 1)
+	tlsConfig := testTlsConfig(t)
+	submitted := make(chan bool, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := newTlsServerConn(conn, tlsConfig)
+			if err != nil {
+				t.Errorf("can't create TLS connection: %+v", err)
+				return
+			}
+			submitted <- pool.submit(serverConn, func(conn *tlsConn) {
+				established <- conn
+			})
+		}
+	}()
+
+	// the silent client takes the only slot until the handshake times out
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	defer silent.Close()
+	if !<-submitted {
+		t.Fatalf("first handshake is rejected")
+	}
+	rejected, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	defer rejected.Close()
+	if <-submitted {
+		t.Fatalf("handshake over the limit is accepted")
+	}
+
+	// the handshake of the silent client times out and releases the slot
+	for deadline := time.Now().Add(5 * time.Second); len(pool.slots) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the client doesn't trust the self-signed certificate and sends the alert
+	_, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{})
+	if err == nil {
+		t.Fatalf("handshake with untrusted certificate succeeded")
+	}
+	<-submitted
+	// the slot is released after the server side of the handshake failed
+	for deadline := time.Now().Add(5 * time.Second); len(pool.slots) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake failed: %+v", err)
+	}
+	defer client.Close()
+	<-submitted
+	select {
+	case conn := <-established:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("established connection isn't handed over")
+	}
+
+	stats := pool.stats()
+	if stats.Succeeded != 1 || stats.TimedOut != 1 || stats.Rejected != 1 || stats.Failed != 1 {
+		t.Fatalf("unexpected handshake stats: %+v", stats)
+	}
+	if stats.Alerts["bad certificate"] != 1 {
+		t.Fatalf("alert isn't counted: %+v", stats.Alerts)
+	}
+}
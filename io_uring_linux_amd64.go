@@ -0,0 +1,955 @@
+package dynproxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioUringSqEntries = 256
+	ioUringMinCqSize = 1024
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringSetupCqSize = 1 << 3
+
+	ioringOpPollAdd     = 6
+	ioringOpPollRemove  = 7
+	ioringOpAccept      = 13
+	ioringOpAsyncCancel = 14
+	ioringOpRecv        = 27
+
+	ioringRegisterPbufRing = 22
+
+	ioSqeBufferSelect = 1 << 5
+
+	ioringEnterGetEvents = 1 << 0
+	ioringEnterExtArg    = 1 << 3
+
+	ioringPollAddMulti    = 1 << 0
+	ioringAcceptMultishot = 1 << 0
+	ioringRecvMultishot   = 1 << 1
+	ioringCqeFBuffer      = 1 << 0
+	ioringCqeFMore        = 1 << 1
+	ioringCqeBufferShift  = 16
+
+	ioringFeatNoDrop = 1 << 1
+	ioringFeatExtArg = 1 << 8
+
+	// multishot poll is available since 5.13
+	ioUringMinKernelMajor = 5
+	ioUringMinKernelMinor = 13
+	// multishot recv with the provided buffer ring is available since 6.0
+	ioUringRecvKernelMajor = 6
+	ioUringRecvKernelMinor = 0
+
+	// ioUringRecvBuffers the provided buffers of the multishot recv shared by the fds of the poller, the size of
+	// the ring must be a power of 2
+	ioUringRecvBuffers    = 256
+	ioUringRecvBufferSize = 16 * 1024
+	ioUringRecvGroup      = 0
+
+	// ioUringRemoveUserData is the user data of the poll remove and the cancel requests, the registrations
+	// never get the zero generation, so it can't be the user data of the poll or the accept
+	ioUringRemoveUserData = 0
+	// ioUringRecvTag marks the user data of the recv requests, the fds are non-negative int32
+	ioUringRecvTag = 1 << 31
+	ioUringFdMask  = ioUringRecvTag - 1
+)
+
+type ioUringSqOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type ioUringCqOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type ioUringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCpu  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        ioUringSqOffsets
+	cqOff        ioUringCqOffsets
+}
+
+type ioUringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type ioUringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type ioUringBufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+type ioUringBuf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	// resv of the first entry is the tail of the ring
+	resv uint16
+}
+
+// ioUringRecv is the completion of the multishot recv, data is the part of the provided buffer bid which isn't
+// consumed yet. The recv is finished by EOF or the error.
+type ioUringRecv struct {
+	data []byte
+	bid  uint16
+	err  error
+}
+
+type ioUringGetEventsArg struct {
+	sigmask   uint64
+	sigmaskSz uint32
+	pad       uint32
+	ts        uint64
+}
+
+// ioUringRegistration is the poll or the multishot accept of the fd, the accept is armed while the read events are polled.
+// The fd which is received by the multishot recv is polled only for the write and the error events.
+type ioUringRegistration struct {
+	generation uint32
+	events     uint32
+	accept     bool
+	// armed the accept request is running, it's finished by the error or the cancel
+	armed bool
+	// recv the bytes are received into the provided buffers, the recv is armed while the read events are polled
+	recv           bool
+	recvGeneration uint32
+	recvArmed      bool
+}
+
+func (r ioUringRegistration) userData(fd int) uint64 {
+	return uint64(r.generation)<<32 | uint64(uint32(fd))
+}
+
+func (r ioUringRegistration) recvUserData(fd int) uint64 {
+	return uint64(r.recvGeneration)<<32 | ioUringRecvTag | uint64(uint32(fd))
+}
+
+// ioUringPoller polls the fds with multishot IORING_OP_POLL_ADD requests, accepts the connections of
+// the listeners with multishot IORING_OP_ACCEPT and receives the bytes of the plain session sockets with
+// multishot IORING_OP_RECV into the ring of the provided buffers. Every registration of the fd gets a new
+// generation, so the completions of the removed or modified requests are skipped.
+type ioUringPoller struct {
+	fd              int
+	wakeupFd        int
+	eventBufferSize int
+	lock            sync.Mutex
+	sqRing          []byte
+	cqRing          []byte
+	sqesMem         []byte
+	sqHead          *uint32
+	sqTail          *uint32
+	sqMask          uint32
+	sqEntries       uint32
+	sqArray         []uint32
+	sqes            []ioUringSqe
+	sqPending       uint32
+	cqHead          *uint32
+	cqTail          *uint32
+	cqMask          uint32
+	cqes            []ioUringCqe
+	registrations   map[int]ioUringRegistration
+	generation      uint32
+	timeout         unix.Timespec
+	eventsArg       ioUringGetEventsArg
+	// accepted are the results of the multishot accepts by the listener fd, the fds or the negative errors
+	accepted map[int][]int32
+	// cancelled are the accepts and the recvs which are cancelled but could still complete with the accepted fd
+	// or the received bytes, the bytes of the paused recv are delivered, the ones of the deleted fd are dropped
+	cancelled map[uint64]bool
+	// acceptUnsupported the kernel doesn't support the multishot accept, the listeners are polled
+	acceptUnsupported bool
+	// bufRing is the ring of the provided buffers in bufMem, it's nil when the multishot recv isn't supported
+	bufRing    []ioUringBuf
+	bufRingMem []byte
+	bufMem     []byte
+	bufTail    uint16
+	// bufHeld buffers keep the received bytes which aren't consumed yet
+	bufHeld int
+	// received are the completions of the recvs by the fd, starved are the fds whose recv ran out of the buffers
+	received map[int][]ioUringRecv
+	starved  map[int]struct{}
+}
+
+// probeIoUring Checks the kernel version, the io_uring setup itself could still be forbidden (e.g. by seccomp).
+func probeIoUring() error {
+	return probeKernel(ioUringMinKernelMajor, ioUringMinKernelMinor)
+}
+
+// probeKernel Returns the error when the kernel is older than the version.
+func probeKernel(minMajor, minMinor int) error {
+	uname := &unix.Utsname{}
+	err := unix.Uname(uname)
+	if err != nil {
+		return os.NewSyscallError("uname", err)
+	}
+	release := unix.ByteSliceToString(uname.Release[:])
+	var major, minor int
+	_, err = fmt.Sscanf(release, "%d.%d", &major, &minor)
+	if err != nil {
+		return fmt.Errorf("can't parse kernel release %s: %w", release, err)
+	}
+	if major < minMajor || (major == minMajor && minor < minMinor) {
+		return fmt.Errorf("kernel %s is older than %d.%d", release, minMajor, minMinor)
+	}
+	return nil
+}
+
+func openIoUringPoller(eventsBufferSize int) (Poller, error) {
+	bufferSize := int(math.Max(float64(eventsBufferSize), defEventsBufferSize))
+	cqSize := uint32(ioUringMinCqSize)
+	for cqSize < uint32(bufferSize)*8 {
+		cqSize <<= 1
+	}
+	params := &ioUringParams{flags: ioringSetupCqSize, cqEntries: cqSize}
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, ioUringSqEntries, uintptr(unsafe.Pointer(params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	p := &ioUringPoller{
+		fd:              int(fd),
+		wakeupFd:        -1,
+		eventBufferSize: bufferSize,
+		registrations:   make(map[int]ioUringRegistration),
+		accepted:        make(map[int][]int32),
+		cancelled:       make(map[uint64]bool),
+		received:        make(map[int][]ioUringRecv),
+		starved:         make(map[int]struct{}),
+	}
+	if params.features&ioringFeatExtArg == 0 || params.features&ioringFeatNoDrop == 0 {
+		p.Close()
+		return nil, errors.New("io_uring doesn't support required features")
+	}
+	err := p.mmapRings(params)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.wakeupFd, err = openWakeupFd()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = p.Add(p.wakeupFd, true, false)
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	err = p.setupRecv()
+	if err != nil {
+		log.Warn().Msgf("multishot recv isn't available, sessions are read on the readiness: %+v", err)
+	}
+	return p, nil
+}
+
+// setupRecv Registers the ring of the provided buffers and gives all buffers to the kernel.
+func (p *ioUringPoller) setupRecv() error {
+	err := probeKernel(ioUringRecvKernelMajor, ioUringRecvKernelMinor)
+	if err != nil {
+		return err
+	}
+	ringSize := ioUringRecvBuffers * int(unsafe.Sizeof(ioUringBuf{}))
+	ringMem, err := unix.Mmap(-1, 0, ringSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	bufMem, err := unix.Mmap(-1, 0, ioUringRecvBuffers*ioUringRecvBufferSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		unix.Munmap(ringMem)
+		return os.NewSyscallError("mmap", err)
+	}
+	reg := &ioUringBufReg{
+		ringAddr:    uint64(uintptr(unsafe.Pointer(&ringMem[0]))),
+		ringEntries: ioUringRecvBuffers,
+		bgid:        ioUringRecvGroup,
+	}
+	_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(p.fd), ioringRegisterPbufRing, uintptr(unsafe.Pointer(reg)), 1, 0, 0)
+	if errno != 0 {
+		unix.Munmap(bufMem)
+		unix.Munmap(ringMem)
+		return os.NewSyscallError("io_uring_register", errno)
+	}
+	p.bufRingMem = ringMem
+	p.bufMem = bufMem
+	p.bufRing = unsafe.Slice((*ioUringBuf)(unsafe.Pointer(&ringMem[0])), ioUringRecvBuffers)
+	for bid := 0; bid < ioUringRecvBuffers; bid++ {
+		p.provideBuffer(uint16(bid))
+	}
+	return nil
+}
+
+func (p *ioUringPoller) mmapRings(params *ioUringParams) error {
+	var err error
+	sqRingSize := int(params.sqOff.array + params.sqEntries*4)
+	p.sqRing, err = unix.Mmap(p.fd, ioringOffSqRing, sqRingSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	cqRingSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(ioUringCqe{})))
+	p.cqRing, err = unix.Mmap(p.fd, ioringOffCqRing, cqRingSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	sqesSize := int(params.sqEntries * uint32(unsafe.Sizeof(ioUringSqe{})))
+	p.sqesMem, err = unix.Mmap(p.fd, ioringOffSqes, sqesSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	p.sqHead = ringUint32(p.sqRing, params.sqOff.head)
+	p.sqTail = ringUint32(p.sqRing, params.sqOff.tail)
+	p.sqMask = *ringUint32(p.sqRing, params.sqOff.ringMask)
+	p.sqEntries = *ringUint32(p.sqRing, params.sqOff.ringEntries)
+	p.sqArray = unsafe.Slice(ringUint32(p.sqRing, params.sqOff.array), params.sqEntries)
+	p.sqes = unsafe.Slice((*ioUringSqe)(unsafe.Pointer(&p.sqesMem[0])), params.sqEntries)
+	p.cqHead = ringUint32(p.cqRing, params.cqOff.head)
+	p.cqTail = ringUint32(p.cqRing, params.cqOff.tail)
+	p.cqMask = *ringUint32(p.cqRing, params.cqOff.ringMask)
+	p.cqes = unsafe.Slice((*ioUringCqe)(unsafe.Pointer(&p.cqRing[params.cqOff.cqes])), params.cqEntries)
+	return nil
+}
+
+func ringUint32(ring []byte, offset uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[offset]))
+}
+
+func (p *ioUringPoller) Name() string {
+	return IoUringPoller
+}
+
+func (p *ioUringPoller) Close() error {
+	if p.wakeupFd >= 0 {
+		unix.Close(p.wakeupFd)
+	}
+	for _, ring := range [][]byte{p.sqesMem, p.cqRing, p.sqRing, p.bufRingMem, p.bufMem} {
+		if ring != nil {
+			unix.Munmap(ring)
+		}
+	}
+	err := os.NewSyscallError("close", unix.Close(p.fd))
+	if err != nil {
+		log.Error().Msgf("got error while closing io_uring: %+v", err)
+	}
+	return err
+}
+
+func (p *ioUringPoller) Wait(timeout int, callback func(fd int, events uint32)) (int, error) {
+	if atomic.LoadUint32(p.cqTail) == *p.cqHead {
+		if timeout == nonBlocked {
+			return 0, nil
+		}
+		err := p.waitForCompletions(timeout)
+		if err == unix.EINTR || err == unix.ETIME {
+			runtime.Gosched()
+			return 0, nil
+		} else if err != nil {
+			log.Printf("error occurs in io_uring: %v", os.NewSyscallError("io_uring_enter", err))
+			return 0, err
+		}
+	}
+	count := 0
+	head := *p.cqHead
+	tail := atomic.LoadUint32(p.cqTail)
+	for ; head != tail && count < p.eventBufferSize; head++ {
+		cqe := p.cqes[head&p.cqMask]
+		atomic.StoreUint32(p.cqHead, head+1)
+		if cqe.userData == ioUringRemoveUserData {
+			continue
+		}
+		fd := int(cqe.userData & ioUringFdMask)
+		generation := uint32(cqe.userData >> 32)
+		p.lock.Lock()
+		registration, ok := p.registrations[fd]
+		if cqe.userData&ioUringRecvTag != 0 {
+			current := ok && registration.recv && registration.recvGeneration == generation
+			deliver, cancelled := p.cancelled[cqe.userData]
+			if !current && !deliver {
+				p.completeCancelled(cqe)
+				p.lock.Unlock()
+				continue
+			}
+			if cancelled && cqe.flags&ioringCqeFMore == 0 {
+				delete(p.cancelled, cqe.userData)
+			}
+			received := p.completeRecv(fd, registration, current, cqe)
+			p.lock.Unlock()
+			// the bytes of the paused recv are reported by the reader once it resumes
+			if received && registration.events&readEvents != 0 {
+				callback(fd, pollIn)
+				count++
+			}
+			continue
+		}
+		if !ok || registration.generation != generation {
+			p.completeCancelled(cqe)
+			p.lock.Unlock()
+			continue
+		}
+		if registration.accept {
+			accepted := p.completeAccept(fd, registration, cqe)
+			p.lock.Unlock()
+			if accepted {
+				callback(fd, pollIn)
+				count++
+			}
+			continue
+		}
+		if cqe.flags&ioringCqeFMore == 0 && cqe.res >= 0 {
+			// the multishot poll was terminated by the kernel, it has to be armed again
+			p.pushPollAdd(fd, registration)
+			p.resubmit(fd)
+		}
+		p.lock.Unlock()
+		events := uint32(cqe.res)
+		if cqe.res < 0 {
+			if syscall.Errno(-cqe.res) == unix.ECANCELED {
+				continue
+			}
+			log.Debug().Msgf("[%d] io_uring poll error: %v", fd, syscall.Errno(-cqe.res))
+			events = pollErr
+		}
+		if fd == p.wakeupFd {
+			drainWakeupFd(p.wakeupFd)
+			continue
+		}
+		callback(fd, events)
+		count++
+	}
+	return count, nil
+}
+
+// completeCancelled Closes the connection accepted by the cancelled accept and gives the buffer of the dropped recv
+// back to the kernel, nobody takes them anymore.
+func (p *ioUringPoller) completeCancelled(cqe ioUringCqe) {
+	if cqe.userData&ioUringRecvTag != 0 && cqe.res > 0 && cqe.flags&ioringCqeFBuffer != 0 {
+		p.provideBuffer(uint16(cqe.flags >> ioringCqeBufferShift))
+	}
+	_, ok := p.cancelled[cqe.userData]
+	if !ok {
+		return
+	}
+	if cqe.userData&ioUringRecvTag == 0 && cqe.res >= 0 {
+		unix.Close(int(cqe.res))
+	}
+	if cqe.flags&ioringCqeFMore == 0 {
+		delete(p.cancelled, cqe.userData)
+	}
+}
+
+// completeRecv Queues the received bytes of the fd, returns true when the queue was empty, so the fd has to be reported
+// as readable. The current recv is armed again when the kernel terminated it, the recv which ran out of the buffers is
+// armed once the buffers are consumed.
+func (p *ioUringPoller) completeRecv(fd int, registration ioUringRegistration, current bool, cqe ioUringCqe) bool {
+	finished := current && registration.recvArmed && cqe.flags&ioringCqeFMore == 0
+	rearm := finished
+	var recv ioUringRecv
+	switch {
+	case cqe.res > 0 && cqe.flags&ioringCqeFBuffer != 0:
+		bid := uint16(cqe.flags >> ioringCqeBufferShift)
+		offset := int(bid) * ioUringRecvBufferSize
+		recv = ioUringRecv{data: p.bufMem[offset : offset+int(cqe.res)], bid: bid}
+		p.bufHeld++
+	case cqe.res == 0:
+		recv = ioUringRecv{err: io.EOF}
+		rearm = false
+	default:
+		errno := syscall.Errno(-cqe.res)
+		switch errno {
+		case unix.ECANCELED:
+			return false
+		case unix.ENOBUFS:
+			if finished && p.bufHeld > 0 {
+				registration.recvArmed = false
+				p.registrations[fd] = registration
+				p.starved[fd] = struct{}{}
+				return false
+			}
+		case unix.EINTR, unix.EAGAIN:
+		default:
+			recv = ioUringRecv{err: os.NewSyscallError("recv", errno)}
+			rearm = false
+		}
+	}
+	if rearm {
+		p.registrations[fd] = p.armRecv(fd, registration)
+		p.resubmit(fd)
+	} else if finished {
+		registration.recvArmed = false
+		p.registrations[fd] = registration
+	}
+	if recv.data == nil && recv.err == nil {
+		return false
+	}
+	queued := p.received[fd]
+	p.received[fd] = append(queued, recv)
+	return len(queued) == 0
+}
+
+// completeAccept Keeps the result of the accept for the acceptor, returns true when the acceptor has to take it.
+// The listener falls back to polling when the kernel doesn't support the multishot accept.
+func (p *ioUringPoller) completeAccept(fd int, registration ioUringRegistration, cqe ioUringCqe) bool {
+	more := cqe.flags&ioringCqeFMore != 0
+	if cqe.res >= 0 {
+		p.accepted[fd] = append(p.accepted[fd], cqe.res)
+		if !more {
+			// the multishot accept was terminated by the kernel, it has to be armed again
+			p.pushAccept(fd, registration)
+			p.resubmit(fd)
+		}
+		return true
+	}
+	switch syscall.Errno(-cqe.res) {
+	case unix.ECANCELED:
+		return false
+	case unix.EINVAL:
+		log.Warn().Msgf("[%d] multishot accept isn't supported by io_uring, fallback to polling", fd)
+		p.acceptUnsupported = true
+		registration.accept = false
+		registration.armed = false
+		p.registrations[fd] = registration
+		p.pushPollAdd(fd, registration)
+		p.resubmit(fd)
+		return true
+	case unix.EINTR, unix.EAGAIN, unix.ECONNABORTED:
+		if !more {
+			p.pushAccept(fd, registration)
+			p.resubmit(fd)
+		}
+		return false
+	}
+	// the acceptor pauses on the error, the accept is armed again when it resumes
+	p.accepted[fd] = append(p.accepted[fd], cqe.res)
+	if !more {
+		registration.armed = false
+		p.registrations[fd] = registration
+	}
+	return true
+}
+
+func (p *ioUringPoller) waitForCompletions(timeout int) error {
+	flags := uintptr(ioringEnterGetEvents)
+	var arg unsafe.Pointer
+	var argSize uintptr
+	if timeout > 0 {
+		p.timeout = unix.NsecToTimespec(int64(timeout) * 1000 * 1000)
+		p.eventsArg = ioUringGetEventsArg{ts: uint64(uintptr(unsafe.Pointer(&p.timeout)))}
+		arg = unsafe.Pointer(&p.eventsArg)
+		argSize = unsafe.Sizeof(p.eventsArg)
+		flags |= ioringEnterExtArg
+	}
+	_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(p.fd), 0, 1, flags, uintptr(arg), argSize)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (p *ioUringPoller) Wakeup() error {
+	return writeWakeupFd(p.wakeupFd)
+}
+
+func (p *ioUringPoller) Add(fd int, read, write bool) error {
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("add io_uring poll for fd: %d read: %t write: %t", fd, read, write)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.registrations[fd]
+	if ok {
+		return os.NewSyscallError("io_uring poll add", unix.EEXIST)
+	}
+	registration := ioUringRegistration{generation: p.nextGeneration(), events: pollEvents(read, write)}
+	p.registrations[fd] = registration
+	p.pushPollAdd(fd, registration)
+	return p.submit()
+}
+
+// AddAccept Starts accepting the connections of the listener, the listener is polled when the kernel doesn't
+// support the multishot accept.
+func (p *ioUringPoller) AddAccept(fd int) error {
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("add io_uring accept for fd: %d", fd)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.registrations[fd]
+	if ok {
+		return os.NewSyscallError("io_uring accept", unix.EEXIST)
+	}
+	registration := ioUringRegistration{generation: p.nextGeneration(), events: pollEvents(true, false), accept: !p.acceptUnsupported}
+	p.registrations[fd] = p.arm(fd, registration)
+	return p.submit()
+}
+
+// TakeAccepted Returns the connections accepted for the listener and the errors of the accepts, multishot is false
+// when the connections have to be accepted by the caller on the readiness of the listener.
+func (p *ioUringPoller) TakeAccepted(fd int) (results []int32, multishot bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	results = p.accepted[fd]
+	delete(p.accepted, fd)
+	registration, ok := p.registrations[fd]
+	return results, ok && registration.accept
+}
+
+func (p *ioUringPoller) Modify(fd int, read, write bool) error {
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("modify io_uring poll for fd: %d read: %t write: %t", fd, read, write)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	old, ok := p.registrations[fd]
+	if !ok {
+		return os.NewSyscallError("io_uring poll modify", unix.ENOENT)
+	}
+	registration := ioUringRegistration{generation: p.nextGeneration(), events: pollEvents(read, write), accept: old.accept,
+		recv: old.recv, recvGeneration: old.recvGeneration, recvArmed: old.recvArmed}
+	p.pushCancel(fd, old)
+	p.registrations[fd] = p.arm(fd, registration)
+	return p.submit()
+}
+
+func (p *ioUringPoller) Delete(fd int) error {
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("delete io_uring poll for fd: %d", fd)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	old, ok := p.registrations[fd]
+	if !ok {
+		return os.NewSyscallError("io_uring poll remove", unix.ENOENT)
+	}
+	delete(p.registrations, fd)
+	p.pushCancel(fd, old)
+	for _, res := range p.accepted[fd] {
+		if res >= 0 {
+			unix.Close(int(res))
+		}
+	}
+	delete(p.accepted, fd)
+	if old.recv {
+		p.dropReceived(fd, old)
+	}
+	return p.submit()
+}
+
+// Recv Switches the reads of the registered fd to the multishot recv, false is returned when the multishot recv
+// isn't supported and the fd stays polled for the readiness.
+func (p *ioUringPoller) Recv(fd int) (bool, error) {
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("add io_uring recv for fd: %d", fd)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.bufRing == nil {
+		return false, nil
+	}
+	old, ok := p.registrations[fd]
+	if !ok {
+		return false, os.NewSyscallError("io_uring recv", unix.ENOENT)
+	}
+	if old.recv || old.accept {
+		return old.recv, nil
+	}
+	registration := ioUringRegistration{generation: p.nextGeneration(), events: old.events, recv: true}
+	p.pushCancel(fd, old)
+	p.registrations[fd] = p.arm(fd, registration)
+	return true, p.submit()
+}
+
+// PeekReceived Returns the first received bytes of the fd which aren't consumed yet, nothing is returned when
+// the recv didn't complete since the last consume. The received bytes are ended by EOF or the error of the recv.
+func (p *ioUringPoller) PeekReceived(fd int) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue := p.received[fd]
+	if len(queue) == 0 {
+		return nil, nil
+	}
+	return queue[0].data, queue[0].err
+}
+
+// ConsumeReceived Consumes n bytes returned by PeekReceived, the buffer is given back to the kernel once it's consumed.
+func (p *ioUringPoller) ConsumeReceived(fd int, n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue := p.received[fd]
+	if len(queue) == 0 || queue[0].err != nil {
+		return
+	}
+	queue[0].data = queue[0].data[n:]
+	if len(queue[0].data) > 0 {
+		return
+	}
+	p.releaseBuffer(queue[0].bid)
+	queue[0] = ioUringRecv{}
+	if len(queue) == 1 {
+		delete(p.received, fd)
+	} else {
+		p.received[fd] = queue[1:]
+	}
+	p.armStarved()
+}
+
+// dropReceived Cancels the recv of the deleted fd and gives back the buffers of the bytes nobody consumes, the late
+// completions of the paused recvs aren't delivered either, the fd could be reused by the next registration.
+func (p *ioUringPoller) dropReceived(fd int, registration ioUringRegistration) {
+	if registration.recvArmed {
+		p.cancelRecv(fd, registration, false)
+	}
+	for userData := range p.cancelled {
+		if userData&ioUringRecvTag != 0 && int(userData&ioUringFdMask) == fd {
+			p.cancelled[userData] = false
+		}
+	}
+	for _, recv := range p.received[fd] {
+		if recv.data != nil {
+			p.releaseBuffer(recv.bid)
+		}
+	}
+	delete(p.received, fd)
+	delete(p.starved, fd)
+	p.armStarved()
+}
+
+// nextGeneration Returns the generation of the new registration, it wraps around skipping the zero generation
+// of the remove requests.
+func (p *ioUringPoller) nextGeneration() uint32 {
+	p.generation++
+	if p.generation == 0 {
+		p.generation++
+	}
+	return p.generation
+}
+
+// arm Submits the request of the registration, the paused accept isn't armed. The recv is armed or cancelled when
+// the read events are enabled or disabled, the starved recv is armed once the buffers are consumed.
+func (p *ioUringPoller) arm(fd int, registration ioUringRegistration) ioUringRegistration {
+	if registration.accept {
+		if registration.events&readEvents != 0 {
+			p.pushAccept(fd, registration)
+			registration.armed = true
+		}
+		return registration
+	}
+	p.pushPollAdd(fd, registration)
+	if !registration.recv {
+		return registration
+	}
+	read := registration.events&readEvents != 0
+	if _, starved := p.starved[fd]; read && !registration.recvArmed && !starved {
+		registration = p.armRecv(fd, registration)
+	} else if !read && registration.recvArmed {
+		p.cancelRecv(fd, registration, true)
+		registration.recvArmed = false
+	}
+	return registration
+}
+
+// armRecv Submits the multishot recv of the registration with the new generation.
+func (p *ioUringPoller) armRecv(fd int, registration ioUringRegistration) ioUringRegistration {
+	registration.recvGeneration = p.nextGeneration()
+	registration.recvArmed = true
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpRecv
+	sqe.fd = int32(fd)
+	sqe.flags = ioSqeBufferSelect
+	sqe.ioprio = ioringRecvMultishot
+	sqe.bufIndex = ioUringRecvGroup
+	sqe.userData = registration.recvUserData(fd)
+	return registration
+}
+
+// cancelRecv Cancels the recv of the registration, the bytes it received before the cancel are delivered when
+// the recv is paused.
+func (p *ioUringPoller) cancelRecv(fd int, registration ioUringRegistration, deliver bool) {
+	p.cancelled[registration.recvUserData(fd)] = deliver
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpAsyncCancel
+	sqe.fd = -1
+	sqe.addr = registration.recvUserData(fd)
+	sqe.userData = ioUringRemoveUserData
+}
+
+// armStarved Arms the recvs which ran out of the buffers, it's called once the buffers are given back.
+func (p *ioUringPoller) armStarved() {
+	for fd := range p.starved {
+		delete(p.starved, fd)
+		registration, ok := p.registrations[fd]
+		if !ok || !registration.recv || registration.recvArmed || registration.events&readEvents == 0 {
+			continue
+		}
+		p.registrations[fd] = p.armRecv(fd, registration)
+		p.resubmit(fd)
+	}
+}
+
+// provideBuffer Gives the buffer to the kernel, the tail is published once the entry is written.
+func (p *ioUringPoller) provideBuffer(bid uint16) {
+	entry := &p.bufRing[p.bufTail&(ioUringRecvBuffers-1)]
+	entry.addr = uint64(uintptr(unsafe.Pointer(&p.bufMem[int(bid)*ioUringRecvBufferSize])))
+	entry.len = ioUringRecvBufferSize
+	entry.bid = bid
+	p.bufTail++
+	// the tail shares the 32-bit word with the bid of the first entry
+	word := (*uint32)(unsafe.Pointer(&p.bufRing[0].bid))
+	atomic.StoreUint32(word, uint32(p.bufRing[0].bid)|uint32(p.bufTail)<<16)
+}
+
+// releaseBuffer Gives back the buffer of the consumed or dropped bytes.
+func (p *ioUringPoller) releaseBuffer(bid uint16) {
+	p.bufHeld--
+	p.provideBuffer(bid)
+}
+
+// pushCancel Cancels the request of the registration, the connections accepted by the cancelled accept are closed.
+func (p *ioUringPoller) pushCancel(fd int, registration ioUringRegistration) {
+	if !registration.accept {
+		p.pushPollRemove(fd, registration)
+		return
+	}
+	if !registration.armed {
+		return
+	}
+	p.cancelled[registration.userData(fd)] = false
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpAsyncCancel
+	sqe.fd = -1
+	sqe.addr = registration.userData(fd)
+	sqe.userData = ioUringRemoveUserData
+}
+
+func (p *ioUringPoller) pushAccept(fd int, registration ioUringRegistration) {
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpAccept
+	sqe.fd = int32(fd)
+	sqe.ioprio = ioringAcceptMultishot
+	sqe.opFlags = unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC
+	sqe.userData = registration.userData(fd)
+}
+
+// pushPollAdd Polls the events of the registration, the read events of the received fd are left to the recv.
+func (p *ioUringPoller) pushPollAdd(fd int, registration ioUringRegistration) {
+	events := registration.events
+	if registration.recv {
+		events &^= readEvents
+	}
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpPollAdd
+	sqe.fd = int32(fd)
+	sqe.len = ioringPollAddMulti
+	sqe.opFlags = events
+	sqe.userData = registration.userData(fd)
+}
+
+func (p *ioUringPoller) pushPollRemove(fd int, registration ioUringRegistration) {
+	sqe := p.nextSqe()
+	sqe.opcode = ioringOpPollRemove
+	sqe.fd = -1
+	sqe.addr = registration.userData(fd)
+	sqe.userData = ioUringRemoveUserData
+}
+
+func (p *ioUringPoller) nextSqe() *ioUringSqe {
+	tail := *p.sqTail + p.sqPending
+	if tail-atomic.LoadUint32(p.sqHead) >= p.sqEntries {
+		err := p.submit()
+		if err != nil {
+			log.Error().Msgf("can't submit requests of full io_uring ring: %+v", err)
+		}
+		tail = *p.sqTail
+	}
+	index := tail & p.sqMask
+	sqe := &p.sqes[index]
+	*sqe = ioUringSqe{}
+	p.sqArray[index] = index
+	p.sqPending++
+	return sqe
+}
+
+// submit Submits the pushed requests and the ones left in the ring by the previous short submit.
+func (p *ioUringPoller) submit() error {
+	if p.sqPending > 0 {
+		atomic.StoreUint32(p.sqTail, *p.sqTail+p.sqPending)
+		p.sqPending = 0
+	}
+	for {
+		toSubmit := *p.sqTail - atomic.LoadUint32(p.sqHead)
+		if toSubmit == 0 {
+			return nil
+		}
+		submitted, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(p.fd), uintptr(toSubmit), 0, 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+		if submitted == 0 {
+			return fmt.Errorf("%w: %d requests are left in the ring", incompleteSubmit, toSubmit)
+		}
+	}
+}
+
+// resubmit Submits the request armed again by the completion, the fd isn't polled anymore when it fails.
+func (p *ioUringPoller) resubmit(fd int) {
+	err := p.submit()
+	if err != nil {
+		log.Error().Msgf("[%d] can't arm io_uring request again: %+v", fd, err)
+	}
+}
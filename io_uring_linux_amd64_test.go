@@ -0,0 +1,173 @@
+package dynproxy
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestIoUringGenerationWrap(t *testing.T) {
+	poller, err := openPoller(IoUringPoller, 0)
+	if err != nil || poller.Name() != IoUringPoller {
+		t.Skipf("io_uring poller isn't available: %+v", err)
+	}
+	defer poller.Close()
+	uring := poller.(*ioUringPoller)
+	fds := make([]int, 2)
+	err = unix.Pipe2(fds, unix.O_NONBLOCK|unix.O_CLOEXEC)
+	if err != nil {
+		t.Fatalf("can't open pipe: %+v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	unix.Write(fds[1], []byte("x"))
+	// the highest bit of the user data is set from 2^31, the generation wraps around at 2^32
+	for _, start := range []uint32{math.MaxInt32 - 2, math.MaxUint32 - 2} {
+		uring.generation = start
+		err = poller.Add(fds[0], true, false)
+		if err != nil {
+			t.Fatalf("can't add pipe: %+v", err)
+		}
+		for i := 0; i < 4; i++ {
+			// every modify of the readable pipe arms the new poll which reports it again
+			err = poller.Modify(fds[0], true, false)
+			if err != nil {
+				t.Fatalf("can't modify pipe: %+v", err)
+			}
+			generation := uring.registrations[fds[0]].generation
+			if generation == 0 {
+				t.Fatalf("zero generation is given to registration")
+			}
+			reported := false
+			for attempt := 0; attempt < 10 && !reported; attempt++ {
+				_, err = poller.Wait(100, func(fd int, events uint32) {
+					reported = reported || fd == fds[0]
+				})
+				if err != nil {
+					t.Fatalf("can't wait: %+v", err)
+				}
+			}
+			if !reported {
+				t.Fatalf("readable pipe isn't reported with generation %d", generation)
+			}
+		}
+		err = poller.Delete(fds[0])
+		if err != nil {
+			t.Fatalf("can't delete pipe: %+v", err)
+		}
+	}
+}
+
+func TestIoUringRecv(t *testing.T) {
+	poller, err := openPoller(IoUringPoller, 0)
+	if err != nil || poller.Name() != IoUringPoller {
+		t.Skipf("io_uring poller isn't available: %+v", err)
+	}
+	defer poller.Close()
+	uring := poller.(*ioUringPoller)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("can't open socketpair: %+v", err)
+	}
+	defer unix.Close(fds[0])
+	unix.SetNonblock(fds[0], true)
+	err = poller.Add(fds[0], true, false)
+	if err != nil {
+		t.Fatalf("can't add socket: %+v", err)
+	}
+	recv, err := uring.Recv(fds[0])
+	if err != nil {
+		t.Fatalf("can't receive socket: %+v", err)
+	}
+	if !recv {
+		t.Skipf("multishot recv isn't available")
+	}
+	// receive Takes the received bytes until want bytes are taken or the error ends them
+	receive := func(want int) (int, error) {
+		taken := 0
+		for attempt := 0; attempt < 100 && taken < want; attempt++ {
+			_, err := poller.Wait(100, func(fd int, events uint32) {})
+			if err != nil {
+				t.Fatalf("can't wait: %+v", err)
+			}
+			for taken < want {
+				data, err := uring.PeekReceived(fds[0])
+				if err != nil {
+					return taken, err
+				}
+				if len(data) == 0 {
+					break
+				}
+				taken += len(data)
+				uring.ConsumeReceived(fds[0], len(data))
+			}
+		}
+		return taken, nil
+	}
+
+	unix.Write(fds[1], []byte("hello"))
+	if n, err := receive(5); n != 5 || err != nil {
+		t.Fatalf("received %d bytes, error: %+v", n, err)
+	}
+
+	// the paused recv isn't reported, the bytes received before the cancel are kept until it resumes
+	err = poller.Modify(fds[0], false, false)
+	if err != nil {
+		t.Fatalf("can't pause socket: %+v", err)
+	}
+	unix.Write(fds[1], []byte("paused"))
+	_, err = poller.Wait(100, func(fd int, events uint32) {
+		if fd == fds[0] && events&readEvents != 0 {
+			t.Fatalf("paused socket is reported as readable")
+		}
+	})
+	if err != nil {
+		t.Fatalf("can't wait: %+v", err)
+	}
+	err = poller.Modify(fds[0], true, false)
+	if err != nil {
+		t.Fatalf("can't resume socket: %+v", err)
+	}
+	if n, err := receive(6); n != 6 || err != nil {
+		t.Fatalf("received %d bytes after resume, error: %+v", n, err)
+	}
+
+	// the recv which ran out of the buffers is armed again once they're consumed
+	size := ioUringRecvBuffers*ioUringRecvBufferSize + 1024*1024
+	done := make(chan error, 1)
+	go func() {
+		chunk := make([]byte, 64*1024)
+		var err error
+		for written := 0; written < size && err == nil; {
+			var n int
+			n, err = unix.Write(fds[1], chunk[:minInt(len(chunk), size-written)])
+			written += n
+		}
+		unix.Close(fds[1])
+		done <- err
+	}()
+	for attempt := 0; attempt < 100 && len(uring.starved) == 0; attempt++ {
+		_, err = poller.Wait(100, func(fd int, events uint32) {})
+		if err != nil {
+			t.Fatalf("can't wait: %+v", err)
+		}
+	}
+	if len(uring.starved) == 0 || uring.bufHeld != ioUringRecvBuffers {
+		t.Fatalf("recv isn't starved, held buffers: %d", uring.bufHeld)
+	}
+	n, err := receive(size + 1)
+	if n != size || err != io.EOF {
+		t.Fatalf("received %d bytes of %d, error: %+v", n, size, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("can't write socket: %+v", err)
+	}
+	err = poller.Delete(fds[0])
+	if err != nil {
+		t.Fatalf("can't delete socket: %+v", err)
+	}
+	if uring.bufHeld != 0 {
+		t.Fatalf("%d buffers aren't given back", uring.bufHeld)
+	}
+}
@@ -0,0 +1,105 @@
+package dynproxy
+
+import (
+	"go.uber.org/atomic"
+	"math"
+	"time"
+)
+
+// lagBuckets upper bounds of the lag histogram buckets, the last bucket counts the longer lags.
+var lagBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+// loopMetrics is updated by the event loop thread and read by the stats readers from the other goroutines.
+type loopMetrics struct {
+	started           time.Time
+	wakeups           *atomic.Uint64
+	events            *atomic.Uint64
+	maxEvents         *atomic.Uint64
+	busyTime          *atomic.Duration
+	maxBusyTime       *atomic.Duration
+	lag               []*atomic.Uint64
+	maxTaskQueueDepth *atomic.Int64
+	registeredFds     *atomic.Int64
+}
+
+func newLoopMetrics() *loopMetrics {
+	lag := make([]*atomic.Uint64, len(lagBuckets)+1)
+	for i := range lag {
+		lag[i] = atomic.NewUint64(0)
+	}
+	return &loopMetrics{
+		started:           time.Now(),
+		wakeups:           atomic.NewUint64(0),
+		events:            atomic.NewUint64(0),
+		maxEvents:         atomic.NewUint64(0),
+		busyTime:          atomic.NewDuration(0),
+		maxBusyTime:       atomic.NewDuration(0),
+		lag:               lag,
+		maxTaskQueueDepth: atomic.NewInt64(0),
+		registeredFds:     atomic.NewInt64(0),
+	}
+}
+
+// wakeup Records the iteration of the event loop: the number of the poll events and the time spent on processing.
+func (m *loopMetrics) wakeup(events int, busy time.Duration) {
+	m.wakeups.Inc()
+	m.events.Add(uint64(events))
+	if uint64(events) > m.maxEvents.Load() {
+		m.maxEvents.Store(uint64(events))
+	}
+	m.busyTime.Add(busy)
+	if busy > m.maxBusyTime.Load() {
+		m.maxBusyTime.Store(busy)
+	}
+}
+
+// observeLag Records the time passed since the wakeup until the start of the handler.
+func (m *loopMetrics) observeLag(lag time.Duration) {
+	for i, bound := range lagBuckets {
+		if lag <= bound {
+			m.lag[i].Inc()
+			return
+		}
+	}
+	m.lag[len(lagBuckets)].Inc()
+}
+
+func (m *loopMetrics) observeTaskQueue(depth int) {
+	if int64(depth) > m.maxTaskQueueDepth.Load() {
+		m.maxTaskQueueDepth.Store(int64(depth))
+	}
+}
+
+func (m *loopMetrics) stats(name string, taskQueueDepth int) EventLoopStats {
+	histogram := make([]LagBucket, len(m.lag))
+	for i, count := range m.lag {
+		bound := time.Duration(math.MaxInt64)
+		if i < len(lagBuckets) {
+			bound = lagBuckets[i]
+		}
+		histogram[i] = LagBucket{UpperBound: bound, Count: count.Load()}
+	}
+	return EventLoopStats{
+		Name:               name,
+		Uptime:             time.Since(m.started),
+		Wakeups:            m.wakeups.Load(),
+		Events:             m.events.Load(),
+		MaxEventsPerWakeup: m.maxEvents.Load(),
+		BusyTime:           m.busyTime.Load(),
+		MaxBusyTime:        m.maxBusyTime.Load(),
+		LagHistogram:       histogram,
+		TaskQueueDepth:     taskQueueDepth,
+		MaxTaskQueueDepth:  int(m.maxTaskQueueDepth.Load()),
+		RegisteredFds:      int(m.registeredFds.Load()),
+	}
+}
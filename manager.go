@@ -3,6 +3,13 @@ package dynproxy
 import (
 	"context"
 	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	drainCheckPeriod = 100 * time.Millisecond
+	drainLogPeriod   = time.Second
+	drainKillWait    = time.Second
 )
 
 type ContextManager struct {
@@ -11,41 +18,58 @@ type ContextManager struct {
 	handler       NetEventHandler
 	newFrontConn  chan *newConn
 	events        chan Event
-	eventLoops    *EventLoop
+	engine        Engine
+	frontends     []*Frontend
+	captures      *Captures
 }
 
-func NewContextManager(ctx context.Context) *ContextManager {
-	eventLoop, err := NewEventLoop(EventLoopConfig{
+func NewContextManager(ctx context.Context, config Config) *ContextManager {
+	engine := NewEngine(config.Global.Engine, EventLoopConfig{
 		Name:            "MainLoop",
 		EventBufferSize: 256,
 		LockOsThread:    true,
+		Poller:          config.Global.Poller,
+		Buffers: BufferConfig{
+			MinReadSize: config.Global.MinReadSize,
+			MaxReadSize: config.Global.MaxReadSize,
+		},
 	})
-	if err != nil {
-		log.Fatal().Msgf("can't init event loop: %+v", err)
-	}
 	cm := &ContextManager{
 		ctx:           ctx,
 		sessionHolder: NewMapSessionProvider(context.WithValue(ctx, "name", "session holder")),
 		handler:       NewBufferHandler(),
 		newFrontConn:  make(chan *newConn, 256),
 		events:        make(chan Event, 128),
-		eventLoops:    eventLoop,
+		engine:        engine,
+		captures:      NewCaptures(),
 	}
 	go cm.start()
-	go eventLoop.Start(cm.handler, cm.sessionHolder)
+	go engine.Start(cm.handler, cm.sessionHolder)
 	return cm
 }
 
 func (cm *ContextManager) InitFrontends(config Config) {
 	//processor := NewOcspProcessor(context.WithValue(cm.ctx, "name", "OCSP"), frConfig, cm.events)
 	for _, frConfig := range config.Frontends {
+		filters, err := NewFilterChain(frConfig.Filters)
+		if err != nil {
+			log.Error().Msgf("can't create filters %v of frontend %s: %+v", frConfig.Filters, frConfig.Name, err)
+			continue
+		}
+		socketMode, err := parseFileMode(frConfig.SocketMode)
+		if err != nil {
+			log.Error().Msgf("invalid socket mode %s of frontend %s: %+v", frConfig.SocketMode, frConfig.Name, err)
+			continue
+		}
 		frCtx := context.WithValue(cm.ctx, "name", frConfig.Name)
-		frontend := Frontend{
+		frontend := &Frontend{
 			Context:         frCtx,
 			Net:             frConfig.Net,
 			Address:         frConfig.Address,
 			Name:            frConfig.Name,
 			connChannel:     cm.newFrontConn,
+			events:          cm.events,
+			engine:          cm.engine,
 			defaultBalancer: frConfig.BackendGroup,
 			ocspProc:        NewOcspProcessor(context.WithValue(cm.ctx, "name", "OCSP"), frConfig, cm.events),
 			TlsConfig: &TlsConfig{
@@ -53,11 +77,182 @@ func (cm *ContextManager) InitFrontends(config Config) {
 				CACertPath: frConfig.TlsCACertPath,
 				CertPath:   frConfig.TlsCertPath,
 				PkPath:     frConfig.TlsPkPath},
+			HandshakeTimeout: time.Duration(frConfig.HandshakeTimeoutSec) * time.Second,
+			MaxHandshakes:    frConfig.MaxHandshakes,
+			SessionConfig: ProxySessionConfig{
+				SpliceEnabled: frConfig.SpliceEnabled,
+				ReadBudget:    frConfig.ReadBudgetBytes,
+				IdleTimeout:   time.Duration(frConfig.IdleTimeoutSec) * time.Second,
+				MaxLifetime:   time.Duration(frConfig.MaxSessionLifetimeSec) * time.Second,
+				Frontend:      frConfig.Name,
+				Captures:      cm.captures,
+				Mirror: MirrorConfig{
+					Group:         frConfig.MirrorGroup,
+					SamplePercent: frConfig.MirrorSamplePercent,
+					MaxBytes:      frConfig.MirrorMaxBytes,
+				},
+				RateLimiter: NewRateLimiter(RateLimitConfig{
+					UpstreamBytesPerSec:   frConfig.UpstreamBytesPerSec,
+					DownstreamBytesPerSec: frConfig.DownstreamBytesPerSec,
+					IdentityBytesPerSec:   frConfig.IdentityBytesPerSec,
+					IdentityKey:           SessionKey(frConfig.IdentityLimitKey),
+				}),
+			},
+			SocketBuffers: SocketBuffers{
+				RcvBuf: frConfig.SocketRcvBuf,
+				SndBuf: frConfig.SocketSndBuf,
+			},
+			UnixSocket: UnixSocketConfig{
+				Mode:  socketMode,
+				Owner: frConfig.SocketOwner,
+				Group: frConfig.SocketGroup,
+			},
+			PeerRoutes: peerRoutes(frConfig),
+			Filters:    filters,
+			Sniff:      sniffConfig(frConfig),
 		}
-		err := frontend.Listen()
+		err = frontend.Listen()
 		if err != nil {
 			log.Error().Msgf("error occurred when listening frontend socket:%+v", err)
+			continue
 		}
+		cm.frontends = append(cm.frontends, frontend)
+	}
+}
+
+// peerRoutes Returns the routes of the unix frontend by the peer credentials.
+func peerRoutes(frConfig FrontendConfig) []PeerRoute {
+	routes := make([]PeerRoute, 0, len(frConfig.PeerRoutes))
+	for _, route := range frConfig.PeerRoutes {
+		routes = append(routes, PeerRoute{Uid: route.Uid, Gid: route.Gid, Backend: route.BackendGroup})
+	}
+	return routes
+}
+
+// sniffConfig Returns the sniffing config of the frontend, nil when no rules are configured.
+func sniffConfig(frConfig FrontendConfig) *SniffConfig {
+	if len(frConfig.SniffRules) == 0 {
+		return nil
+	}
+	rules := make([]SniffRule, 0, len(frConfig.SniffRules))
+	for _, rule := range frConfig.SniffRules {
+		rules = append(rules, SniffRule{
+			Protocol:     rule.Protocol,
+			Pattern:      []byte(rule.Pattern),
+			Backend:      rule.BackendGroup,
+			TerminateTls: rule.TerminateTls,
+		})
+	}
+	return &SniffConfig{
+		Timeout:    time.Duration(frConfig.SniffTimeoutSec) * time.Second,
+		MaxPending: frConfig.MaxSniffs,
+		Rules:      rules,
+	}
+}
+
+// FrontendsStats Returns the stats of the listening frontends by name.
+func (cm *ContextManager) FrontendsStats() map[string]FrontendStats {
+	stats := make(map[string]FrontendStats, len(cm.frontends))
+	for _, frontend := range cm.frontends {
+		stats[frontend.Name] = FrontendStats{
+			Name:          frontend.Name,
+			Handshakes:    frontend.HandshakeStats(),
+			ThrottledTime: frontend.SessionConfig.RateLimiter.ThrottledTime(),
+		}
+	}
+	return stats
+}
+
+// EventLoopsStats Returns the load metrics of the event loops by name.
+func (cm *ContextManager) EventLoopsStats() map[string]EventLoopStats {
+	stats := cm.engine.Stats()
+	return map[string]EventLoopStats{stats.Name: stats}
+}
+
+// Sessions Returns the stats of the active sessions.
+func (cm *ContextManager) Sessions() []SessionStats {
+	return cm.sessionHolder.ListSessions()
+}
+
+// KillSessions Closes the active sessions which identity has the value by the key, returns the number of the killed sessions.
+func (cm *ContextManager) KillSessions(key SessionKey, value string) (int, error) {
+	return cm.sessionHolder.KillSessions(key, value)
+}
+
+// StartCapture Starts the capture of the sessions which identity has the value by the key, the active sessions
+// are captured from their next read.
+func (cm *ContextManager) StartCapture(config CaptureConfig) (string, error) {
+	capture, err := cm.captures.Start(config)
+	if err != nil {
+		return "", err
+	}
+	return capture.Id(), nil
+}
+
+func (cm *ContextManager) StopCapture(id string) error {
+	return cm.captures.Stop(id)
+}
+
+// CapturesStats Returns the stats of the running captures.
+func (cm *ContextManager) CapturesStats() []CaptureStats {
+	return cm.captures.Stats()
+}
+
+// Shutdown Stops accepting on all frontends and waits until the active sessions finish, the sessions which are
+// still active when ctx is done are killed.
+func (cm *ContextManager) Shutdown(ctx context.Context) error {
+	for _, frontend := range cm.frontends {
+		frontend.Close()
+	}
+	return drainSessions(ctx, cm.sessionHolder)
+}
+
+// drainSessions Waits until the holder has no sessions and logs how many are left, kills the rest when ctx is done.
+func drainSessions(ctx context.Context, holder SessionHolder) error {
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		sessions := holder.ListSessions()
+		if len(sessions) == 0 {
+			log.Info().Msgf("all sessions are finished")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Warn().Msgf("drain is interrupted, kill %d remaining sessions: %v", len(sessions), ctx.Err())
+			killSessions(holder, sessions)
+			waitSessionsClosed(holder, drainKillWait)
+			return ctx.Err()
+		case <-ticker.C:
+			if time.Since(lastLog) >= drainLogPeriod {
+				log.Info().Msgf("draining, %d sessions remaining", len(sessions))
+				lastLog = time.Now()
+			}
+		}
+	}
+}
+
+// KillAllSessions Closes all active sessions without waiting for the loops, returns the number of the killed sessions.
+func (cm *ContextManager) KillAllSessions() int {
+	return killSessions(cm.sessionHolder, cm.sessionHolder.ListSessions())
+}
+
+// killSessions Asks the loops to close the sessions, they are cut off right after the running handlers return.
+func killSessions(holder SessionHolder, sessions []SessionStats) int {
+	killed := 0
+	for _, stats := range sessions {
+		n, _ := holder.KillSessions(SessionById, stats.Identity.Id)
+		killed += n
+	}
+	return killed
+}
+
+// waitSessionsClosed Gives the loops the time to close the killed sessions.
+func waitSessionsClosed(holder SessionHolder, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for len(holder.ListSessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckPeriod)
 	}
 }
 
@@ -67,26 +262,33 @@ func (cm *ContextManager) start() {
 		case <-cm.ctx.Done():
 			return
 		case newConn := <-cm.newFrontConn:
-			backendConn, err := getConnByBalancerName(newConn.backend)
+			backend, backendConn, err := getConnByBalancerName(newConn.backend, cm.engine.Dial)
 			if err != nil {
 				log.Warn().Msgf("can't create any new connections to the backends: %+v", err)
+				closeFilters(newConn.sessionConfig.Filters, err)
+				newConn.frontend.Close()
 			} else {
-				session, err := NewDefaultProxySession(newConn.frontend, backendConn, cm.events)
+				sessionConfig := newConn.sessionConfig
+				sessionConfig.Backend = backend.Name
+				session, err := NewProxySession(newConn.frontend, backendConn, cm.events, sessionConfig)
 				if err != nil {
-					log.Debug().Msgf("new session: %s", session)
+					log.Warn().Msgf("can't create session of %s: %+v", newConn.frontend.RemoteAddr(), err)
+					newConn.frontend.Close()
+					backendConn.Close()
 					continue
 				}
-				cm.sessionHolder.AddSession(session)
-				err = cm.eventLoops.PollForReadAndErrors(session.GetFds()...)
-				if err != nil {
-					log.Error().Msgf("got error while attach read netpoll: %+v", err)
-				}
-				session.Init(cm.handler.GetBuffer())
+				cm.engine.Serve(session)
 			}
 		case event := <-cm.events:
 			log.Debug().Msgf("received event: %+v", event)
 			if event.Type == OcspValidationError {
-				//cm.sessionHolder.RemoveSession()
+				// the event is identified by the serial of the revoked certificate
+				killed, err := cm.sessionHolder.KillSessions(SessionByCertSerial, event.Id)
+				if err != nil {
+					log.Error().Msgf("can't kill sessions of certificate %s: %+v", event.Id, err)
+				} else if killed > 0 {
+					log.Info().Msgf("killed %d sessions of certificate %s: %s", killed, event.Id, event.Msg)
+				}
 			}
 		}
 	}
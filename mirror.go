@@ -0,0 +1,133 @@
+package dynproxy
+
+import (
+	"github.com/rs/zerolog"
+	"go.uber.org/atomic"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	// defMirrorPending max bytes queued for the shadow backend, the mirror is dropped when the shadow is slower
+	defMirrorPending   = 1024 * 1024
+	defMirrorQueueSize = 256
+	defMirrorTimeout   = 5 * time.Second
+)
+
+// MirrorConfig copies the client bytes of the sampled sessions to the backend of the shadow group. SamplePercent
+// is the share of the mirrored sessions, all sessions are mirrored when it isn't set. MaxBytes is the budget
+// of the mirrored bytes per session, zero means no limit.
+type MirrorConfig struct {
+	Group         string
+	SamplePercent int
+	MaxBytes      int64
+}
+
+// mirror is the connection of the session to the shadow backend. The session queues the copies of the client
+// bytes on its loop, the goroutine of the mirror writes them and discards the responses. The mirror is dropped
+// when the shadow can't be reached or falls behind, the primary session never waits for it.
+type mirror struct {
+	queue   chan []byte
+	pending atomic.Int64
+	failed  atomic.Bool
+	// budget and closed are used by the session loop only
+	budget int64
+	closed bool
+	logger *zerolog.Logger
+}
+
+// newMirror Starts the mirror of the session, returns nil when the session isn't sampled.
+func newMirror(config MirrorConfig, dial dialFunc, logger *zerolog.Logger) *mirror {
+	if config.Group == "" || (config.SamplePercent > 0 && rand.Intn(100) >= config.SamplePercent) {
+		return nil
+	}
+	m := &mirror{
+		queue:  make(chan []byte, defMirrorQueueSize),
+		budget: config.MaxBytes,
+		logger: logger,
+	}
+	go m.run(config.Group, dial)
+	return m
+}
+
+// write Queues the copy of the data, the mirror is closed when it's failed, behind or out of the budget.
+func (m *mirror) write(data [][]byte) {
+	if m.closed {
+		return
+	}
+	if m.failed.Load() {
+		m.close()
+		return
+	}
+	for _, buf := range data {
+		size := len(buf)
+		if m.budget > 0 && int64(size) > m.budget {
+			size = int(m.budget)
+		}
+		if m.pending.Load()+int64(size) > defMirrorPending {
+			m.logger.Warn().Msgf("shadow backend is too slow, stop mirroring")
+			m.close()
+			return
+		}
+		chunk := make([]byte, size)
+		copy(chunk, buf)
+		select {
+		case m.queue <- chunk:
+			m.pending.Add(int64(size))
+		default:
+			m.logger.Warn().Msgf("mirror queue is full, stop mirroring")
+			m.close()
+			return
+		}
+		if m.budget > 0 {
+			m.budget -= int64(size)
+			if m.budget == 0 {
+				if m.logger.Debug().Enabled() {
+					m.logger.Debug().Msgf("mirror byte budget is spent")
+				}
+				m.close()
+				return
+			}
+		}
+	}
+}
+
+// close Stops the mirror, the goroutine closes the shadow connection after the queued bytes are written.
+func (m *mirror) close() {
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+}
+
+func (m *mirror) run(group string, dial dialFunc) {
+	_, conn, err := getConnByBalancerName(group, dial)
+	if err != nil {
+		m.logger.Warn().Msgf("can't connect to shadow group %s: %+v", group, err)
+		m.failed.Store(true)
+		for range m.queue {
+		}
+		return
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	for chunk := range m.queue {
+		if m.failed.Load() {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(defMirrorTimeout))
+		_, err := conn.Write(chunk)
+		m.pending.Sub(int64(len(chunk)))
+		if err != nil {
+			m.logger.Warn().Msgf("got error while writing to shadow backend %s: %+v", conn.RemoteAddr(), err)
+			m.failed.Store(true)
+		}
+	}
+}
+
+// dialMirror Opens the blocking connection to the shadow backend, it's served by the goroutine of the mirror.
+func dialMirror(network, address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, address, timeout)
+}
@@ -0,0 +1,85 @@
+package dynproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startShadowServer Returns the listener which sends the received bytes to the channel, the responses
+// of the shadow have to be discarded by the mirror.
+func startShadowServer(t *testing.T, received chan []byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen shadow server: %+v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("shadow response"))
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestProxySessionMirror(t *testing.T) {
+	received := make(chan []byte, 1)
+	shadow := startShadowServer(t, received)
+	defer shadow.Close()
+	unavailable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %+v", err)
+	}
+	unavailable.Close()
+	balancers = map[string]*Balancer{
+		"shadow":      {Name: "shadow", Backends: []*Backend{{Name: "shadow", Net: "tcp", Address: shadow.Addr().String(), Status: enabled}}},
+		"unavailable": {Name: "unavailable", Backends: []*Backend{{Name: "unavailable", Net: "tcp", Address: unavailable.Addr().String(), Status: enabled}}},
+	}
+	defer func() {
+		balancers = nil
+	}()
+
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			for _, group := range []string{"shadow", "unavailable"} {
+				proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+					engine:  engine,
+					session: ProxySessionConfig{SpliceEnabled: true, Mirror: MirrorConfig{Group: group, MaxBytes: 8}},
+				})
+				conn, err := net.Dial("tcp", proxyAddr)
+				if err != nil {
+					t.Fatalf("can't connect to proxy: %+v", err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				for _, request := range []string{"hello", "world!"} {
+					err = roundTrip(conn, []byte(request), make([]byte, len(request)))
+					if err != nil {
+						t.Fatalf("round trip through %s mirror failed: %+v", group, err)
+					}
+				}
+				conn.Close()
+				proxy.Stop()
+			}
+			select {
+			case data := <-received:
+				// the mirror is closed when the byte budget is spent
+				if string(data) != "hellowor" {
+					t.Fatalf("unexpected mirrored bytes: %q", data)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("mirror connection isn't closed")
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package dynproxy
 
 import (
-	"golang.org/x/sys/unix"
+	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -10,18 +10,69 @@ const (
 	nonBlocked          = 0
 )
 
+const (
+	EpollPoller   = "epoll"
+	IoUringPoller = "io_uring"
+)
+
+// Readiness events reported by the pollers, the values match the epoll and poll(2) masks.
+const (
+	pollIn    = 0x1
+	pollPri   = 0x2
+	pollOut   = 0x4
+	pollErr   = 0x8
+	pollHup   = 0x10
+	pollRdHup = 0x2000
+
+	readEvents   = pollIn | pollPri
+	writeEvents  = pollOut
+	errorEvents  = pollErr | pollHup | pollRdHup
+	hangupEvents = pollHup | pollRdHup
+)
+
 type PollerConfig struct {
 	EventBufferSize int
 	EventQueueSize  int
 }
 
-type Poller struct {
-	eventBufferSize int
-	eventQueueSize  int
-	fd              int
-	lockOSThread    bool
-	events          []unix.EpollEvent
-	timeout         int
+// Poller waits for readiness of the registered fds. The fds are polled in edge triggered mode and
+// error events are always reported.
+type Poller interface {
+	// Wait Waits up to timeout msec (blocked or nonBlocked) and calls the callback for every ready fd
+	Wait(timeout int, callback func(fd int, events uint32)) (int, error)
+	// Add Starts polling of the fd
+	Add(fd int, read, write bool) error
+	// Modify Changes the polled events of the fd
+	Modify(fd int, read, write bool) error
+	// Delete Stops polling of the fd
+	Delete(fd int) error
+	// Wakeup Interrupts the Wait, it's safe to call it from any goroutine
+	Wakeup() error
+	//
+	Close() error
+	//
+	Name() string
+}
+
+// acceptPoller is the poller which accepts the connections of the listeners itself, the listener is reported
+// as readable when the accepted connections are ready to be taken.
+type acceptPoller interface {
+	// AddAccept Starts accepting the connections of the listening fd
+	AddAccept(fd int) error
+	// TakeAccepted Returns the accepted fds and the negative errors of the accepts, multishot is false when
+	// the listener is polled instead and the caller accepts the connections itself
+	TakeAccepted(fd int) (results []int32, multishot bool)
+}
+
+// recvPoller is the poller which receives the bytes of the stream sockets itself, the fd is reported as readable
+// when the received bytes are ready to be taken.
+type recvPoller interface {
+	// Recv Starts receiving the bytes of the registered fd, false is returned when the fd stays polled for the readiness
+	Recv(fd int) (bool, error)
+	// PeekReceived Returns the received bytes which aren't consumed yet and the error which ends them (io.EOF)
+	PeekReceived(fd int) ([]byte, error)
+	// ConsumeReceived Consumes n of the received bytes returned by PeekReceived
+	ConsumeReceived(fd int, n int)
 }
 
 type SocketEvent struct {
@@ -32,3 +83,30 @@ type SocketEvent struct {
 type PollDesc struct {
 	FD int
 }
+
+// openPoller Opens the poller by name, epoll is used when the io_uring isn't supported by the kernel.
+func openPoller(name string, eventsBufferSize int) (Poller, error) {
+	if name == IoUringPoller {
+		if err := probeIoUring(); err != nil {
+			log.Warn().Msgf("io_uring poller isn't available, fallback to epoll: %+v", err)
+		} else {
+			poller, err := openIoUringPoller(eventsBufferSize)
+			if err == nil {
+				return poller, nil
+			}
+			log.Warn().Msgf("can't open io_uring poller, fallback to epoll: %+v", err)
+		}
+	}
+	return openEpollPoller(eventsBufferSize)
+}
+
+func pollEvents(read, write bool) uint32 {
+	events := uint32(errorEvents)
+	if read {
+		events |= readEvents
+	}
+	if write {
+		events |= writeEvents
+	}
+	return events
+}
@@ -0,0 +1,17 @@
+//go:build linux && !amd64
+
+package dynproxy
+
+// The raw pollers are implemented only for amd64, the goroutine engine serves the sessions on the other architectures.
+
+func probeIoUring() error {
+	return unsupportedPoller
+}
+
+func openIoUringPoller(eventsBufferSize int) (Poller, error) {
+	return nil, unsupportedPoller
+}
+
+func openEpollPoller(eventsBufferSize int) (Poller, error) {
+	return nil, unsupportedPoller
+}
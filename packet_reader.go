@@ -0,0 +1,123 @@
+package dynproxy
+
+import (
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+)
+
+const (
+	packetReadBatch = 64
+	// maxDatagramSize the largest UDP payload
+	maxDatagramSize = 64 * 1024
+)
+
+// packetReader reads the datagrams of the listening UDP socket on the event loop thread.
+type packetReader struct {
+	name     string
+	fd       int
+	loop     *EventLoop
+	onPacket func(data []byte, addr *net.UDPAddr)
+	buf      []byte
+	closed   bool
+}
+
+// read Reads the batch of the pending datagrams, the rest is read on the next loop iteration.
+func (r *packetReader) read() {
+	if r.closed {
+		return
+	}
+	for i := 0; i < packetReadBatch; i++ {
+		n, sa, err := unix.Recvfrom(r.fd, r.buf, unix.MSG_DONTWAIT)
+		switch err {
+		case nil:
+			addr := sockaddrToUdpAddr(sa)
+			if addr != nil {
+				r.onPacket(r.buf[:n], addr)
+			}
+		case unix.EAGAIN:
+			return
+		case unix.EINTR, unix.ECONNREFUSED:
+			continue
+		default:
+			log.Error().Msgf("[%s] got error while reading datagram: %+v", r.name, os.NewSyscallError("recvfrom", err))
+			return
+		}
+	}
+	// edge triggered poller doesn't report the socket again while it isn't drained
+	r.loop.Execute(r.read)
+}
+
+func (r *packetReader) close() {
+	r.closed = true
+	err := r.loop.DeletePoll(r.fd)
+	if err != nil {
+		log.Error().Msgf("[%s] error occurs while detaching packet listener from netpoll: %v", r.name, err)
+	}
+	unix.Close(r.fd)
+}
+
+// ListenPacket Opens the non-blocking datagram socket which is read on the event loop thread.
+func (el *EventLoop) ListenPacket(name, network, address string, onPacket func(data []byte, addr *net.UDPAddr)) (PacketListener, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, unsupportedNetwork
+	}
+	fd, addr, err := listenUdp(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r := &packetReader{
+		name:     name,
+		fd:       fd,
+		loop:     el,
+		onPacket: onPacket,
+		buf:      make([]byte, maxDatagramSize),
+	}
+	el.Execute(func() {
+		err := el.PollForRead(fd)
+		if err != nil {
+			log.Error().Msgf("[%s] can't poll packet listener: %+v", name, err)
+			r.closed = true
+			unix.Close(fd)
+			return
+		}
+		el.packetReaders[fd] = r
+		r.read()
+	})
+	return &loopPacketListener{loopListener: loopListener{loop: el, fd: fd, addr: addr}, reader: r}, nil
+}
+
+type loopPacketListener struct {
+	loopListener
+	reader *packetReader
+}
+
+// WriteTo Sends the datagram from the listening socket, it's called on the event loop thread, so it doesn't race with close.
+func (l *loopPacketListener) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if l.reader.closed {
+		return 0, net.ErrClosed
+	}
+	var sa unix.Sockaddr
+	if l.addr.(*net.UDPAddr).IP.To4() == nil {
+		// IPv4 clients of the IPv6 socket are addressed by the mapped addresses
+		sa6 := &unix.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	} else {
+		_, sa = ipSockaddr(addr.IP, addr.Port)
+	}
+	for {
+		err := unix.Sendto(l.fd, data, unix.MSG_DONTWAIT, sa)
+		switch err {
+		case nil:
+			return len(data), nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		default:
+			return 0, os.NewSyscallError("sendto", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dynproxy
+
+import (
+	"go.uber.org/atomic"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits of the frontend in bytes per second, zero disables the limit. Upstream is the direction
+// from the client to the backend. The identity limit is shared by all sessions with the same value of IdentityKey.
+type RateLimitConfig struct {
+	UpstreamBytesPerSec   int
+	DownstreamBytesPerSec int
+	IdentityBytesPerSec   int
+	// IdentityKey is client_ip or cert_subject, the sessions without the value aren't limited by identity
+	IdentityKey SessionKey
+}
+
+// RateLimiter keeps the identity buckets of the frontend and counts the time the sessions were throttled.
+type RateLimiter struct {
+	config    RateLimitConfig
+	lock      sync.Mutex
+	buckets   map[string]*identityBucket
+	throttled atomic.Duration
+}
+
+type identityBucket struct {
+	bucket   *tokenBucket
+	sessions int
+}
+
+// NewRateLimiter Returns nil when no limits are set, so the sessions don't check the buckets at all.
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.UpstreamBytesPerSec <= 0 && config.DownstreamBytesPerSec <= 0 && config.IdentityBytesPerSec <= 0 {
+		return nil
+	}
+	if config.IdentityKey == "" {
+		config.IdentityKey = SessionByClientIp
+	}
+	return &RateLimiter{
+		config:  config,
+		buckets: make(map[string]*identityBucket),
+	}
+}
+
+// ThrottledTime Returns the total time the reads of the sessions were paused by the limits.
+func (l *RateLimiter) ThrottledTime() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.throttled.Load()
+}
+
+// acquire Returns the bucket shared by the sessions of the identity, it's released when the session is closed.
+func (l *RateLimiter) acquire(identity SessionIdentity) *tokenBucket {
+	value := identity.Get(l.config.IdentityKey)
+	if l.config.IdentityBytesPerSec <= 0 || value == "" {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[value]
+	if !ok {
+		b = &identityBucket{bucket: newTokenBucket(l.config.IdentityBytesPerSec)}
+		b.bucket.lock = &sync.Mutex{}
+		l.buckets[value] = b
+	}
+	b.sessions++
+	return b.bucket
+}
+
+func (l *RateLimiter) release(identity SessionIdentity) {
+	value := identity.Get(l.config.IdentityKey)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[value]
+	if !ok {
+		return
+	}
+	b.sessions--
+	if b.sessions <= 0 {
+		delete(l.buckets, value)
+	}
+}
+
+// tokenBucket allows rate bytes per second with bursts up to one second of the rate. The bucket of the session
+// direction is used on the loop of the session only, the identity bucket is guarded by the lock.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   *sync.Mutex
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// available Returns the bytes which can be read now.
+func (b *tokenBucket) available(now time.Time) int {
+	if b.lock != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return 0
+	}
+	return int(b.tokens)
+}
+
+// take Spends the bytes which were read, the shared bucket could go below zero when the sessions read concurrently.
+func (b *tokenBucket) take(now time.Time, n int) {
+	if b.lock != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// delay Returns the time until n bytes can be read, n is cut to the burst.
+func (b *tokenBucket) delay(now time.Time, n int) time.Duration {
+	if b.lock != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+	}
+	b.refill(now)
+	missing := math.Min(float64(n), b.rate) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
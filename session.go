@@ -1,14 +1,21 @@
 package dynproxy
 
 import (
+	"crypto/tls"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"net"
+	"strconv"
 )
 
 type Session interface {
 	//
-	Init(buffer []byte) error
+	Init(controller LoopController) error
 	//
-	ProcessRead(fd int, buffer []byte) error
+	ProcessRead(fd int) error
+	//
+	ProcessWrite(fd int) error
 	//
 	GetConnByFd(fd int) net.Conn
 	//
@@ -19,8 +26,168 @@ type Session interface {
 	GetId() string
 	//
 	GetStats() SessionStats
+	// GetIdentity Returns the fields the session is looked up by in the registry
+	GetIdentity() SessionIdentity
+	// Logger Returns the logger which adds the identity of the session to every line
+	Logger() *zerolog.Logger
+}
+
+// SessionIdentity is who is connected through the session, the TLS fields are set for the TLS frontends,
+// CertSerial and CertSubject are set for the clients authenticated by the certificates. The peer credentials
+// are set for the clients connected over the unix sockets.
+type SessionIdentity struct {
+	Id          string
+	Frontend    string
+	Backend     string
+	ClientAddr  string
+	ClientIp    string
+	TlsVersion  string
+	CipherSuite string
+	ServerName  string
+	CertSerial  string
+	CertSubject string
+	PeerPid     string
+	PeerUid     string
+	PeerGid     string
+}
+
+// Get Returns the value of the identity field by the key.
+func (i SessionIdentity) Get(key SessionKey) string {
+	switch key {
+	case SessionById:
+		return i.Id
+	case SessionByFrontend:
+		return i.Frontend
+	case SessionByBackend:
+		return i.Backend
+	case SessionByClientIp:
+		return i.ClientIp
+	case SessionByCertSerial:
+		return i.CertSerial
+	case SessionByCertSubject:
+		return i.CertSubject
+	case SessionByPeerUid:
+		return i.PeerUid
+	case SessionByPeerGid:
+		return i.PeerGid
+	}
+	return ""
+}
+
+// identityField is the field of the identity by the name it has in the logs and the events.
+type identityField struct {
+	name  string
+	value string
+}
+
+// fields Returns the identity fields in the fixed order, the empty fields are skipped.
+func (i SessionIdentity) fields() []identityField {
+	fields := make([]identityField, 0, 12)
+	for _, field := range []identityField{
+		{"session", i.Id},
+		{"frontend", i.Frontend},
+		{"backend", i.Backend},
+		{"client", i.ClientAddr},
+		{"tls_version", i.TlsVersion},
+		{"cipher_suite", i.CipherSuite},
+		{"server_name", i.ServerName},
+		{"cert_serial", i.CertSerial},
+		{"cert_subject", i.CertSubject},
+		{"peer_pid", i.PeerPid},
+		{"peer_uid", i.PeerUid},
+		{"peer_gid", i.PeerGid},
+	} {
+		if field.value != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// metaData Returns the identity fields as the metadata of the events.
+func (i SessionIdentity) metaData() map[string]interface{} {
+	metaData := make(map[string]interface{})
+	for _, field := range i.fields() {
+		metaData[field.name] = field.value
+	}
+	return metaData
+}
+
+// logger Returns the logger with the identity in its context.
+func (i SessionIdentity) logger() zerolog.Logger {
+	context := log.With()
+	for _, field := range i.fields() {
+		context = context.Str(field.name, field.value)
+	}
+	return context.Logger()
+}
+
+// closeReasonRecorder is implemented by the sessions which report the reason they were closed with in their stats.
+type closeReasonRecorder interface {
+	recordCloseReason(reason error)
+}
+
+// recordCloseReason Keeps the first reason the session is closed with, the sessions closed already aren't touched.
+func recordCloseReason(session Session, reason error) {
+	if reason == closedSession {
+		return
+	}
+	if recorder, ok := session.(closeReasonRecorder); ok {
+		recorder.recordCloseReason(reason)
+	}
+}
+
+// isTimeout Returns true when the session is closed by its own timer, it's the normal way to finish the session.
+func isTimeout(reason error) bool {
+	return reason == idleTimeout || reason == lifetimeExpired || reason == lingerTimeout
+}
+
+// closedByProxy Returns true when the session is closed by the timer or killed by the operator, not by the failure.
+func closedByProxy(reason error) bool {
+	return isTimeout(reason) || reason == killedSession
+}
+
+// newSessionIdentity Returns the identity of the client connection, the certificate is taken from the TLS connection
+// and the peer credentials from the unix socket.
+func newSessionIdentity(id string, conn net.Conn) SessionIdentity {
+	identity := SessionIdentity{Id: id, ClientAddr: conn.RemoteAddr().String()}
+	host, _, err := net.SplitHostPort(identity.ClientAddr)
+	if err == nil {
+		identity.ClientIp = host
+	}
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		cred, err := GetPeerCredentials(conn)
+		if err == nil {
+			identity.PeerPid = strconv.Itoa(int(cred.Pid))
+			identity.PeerUid = strconv.FormatUint(uint64(cred.Uid), 10)
+			identity.PeerGid = strconv.FormatUint(uint64(cred.Gid), 10)
+		}
+	}
+	if c, ok := conn.(*tlsConn); ok {
+		state := c.ConnectionState()
+		identity.TlsVersion = tlsVersionName(state.Version)
+		identity.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		identity.ServerName = state.ServerName
+		certs := state.PeerCertificates
+		if len(certs) > 0 {
+			// the serial is formatted as the OCSP events report it
+			identity.CertSerial = certs[0].SerialNumber.String()
+			identity.CertSubject = certs[0].Subject.String()
+		}
+	}
+	return identity
 }
 
-func generateId(src, dst net.Conn) string {
-	return src.RemoteAddr().String() + "<->" + dst.RemoteAddr().String()
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
 }
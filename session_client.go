@@ -1,16 +1,20 @@
 package dynproxy
 
 import (
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net"
 )
 
 type clientSession struct {
-	id        string
-	fd        int
-	conn      net.Conn
-	eventChan chan Event
-	handler   func(src, dst net.Conn, data []byte) error
+	id         string
+	controller LoopController
+	fd         int
+	conn       net.Conn
+	eventChan  chan Event
+	identity   SessionIdentity
+	logger     zerolog.Logger
+	handler    func(src, dst net.Conn, data []byte) error
 }
 
 func NewEchoClientSession(conn net.Conn, eventChan chan Event) (Session, error) {
@@ -22,25 +26,36 @@ func NewClientSession(conn net.Conn, eventChan chan Event, handler func(src, dst
 	if err != nil {
 		return nil, err
 	}
+	identity := newSessionIdentity(newSessionId(), conn)
 	return &clientSession{
-		id:        generateId(conn, conn),
+		id:        identity.Id,
 		fd:        fd,
 		conn:      conn,
 		eventChan: eventChan,
+		identity:  identity,
+		logger:    identity.logger(),
 		handler:   handler,
 	}, nil
 }
-func (s *clientSession) Init(buffer []byte) error {
-	return s.ProcessRead(s.fd, buffer)
+func (s *clientSession) Init(controller LoopController) error {
+	s.controller = controller
+	return s.ProcessRead(s.fd)
 }
 
-func (s *clientSession) ProcessRead(fd int, buffer []byte) error {
-	if log.Debug().Enabled() {
-		log.Debug().Msgf("[%d] read event from stream: %s", s.fd, s.id)
+func (s *clientSession) ProcessRead(fd int) error {
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("[%d] read event from stream", s.fd)
 	}
+	buffers := s.controller.Buffers()
+	buffer := buffers.Get(defMinReadSize)
+	defer buffers.Put(buffer)
 	return s.handler(s.conn, s.conn, buffer)
 }
 
+func (s *clientSession) ProcessWrite(fd int) error {
+	return nil
+}
+
 func (s *clientSession) GetConnByFd(fd int) net.Conn {
 	return s.conn
 }
@@ -58,7 +73,15 @@ func (s *clientSession) GetId() string {
 }
 
 func (s *clientSession) GetStats() SessionStats {
-	return SessionStats{}
+	return SessionStats{Identity: s.identity}
+}
+
+func (s *clientSession) GetIdentity() SessionIdentity {
+	return s.identity
+}
+
+func (s *clientSession) Logger() *zerolog.Logger {
+	return &s.logger
 }
 
 func echo(src, dst net.Conn, buffer []byte) error {
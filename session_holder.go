@@ -10,62 +10,108 @@ import (
 type NetEventHandler interface {
 	// ReadEvent Handle read events received from polling
 	ReadEvent(session Session, fd int) error
+	// WriteEvent Handle write readiness events received from polling
+	WriteEvent(session Session, fd int) error
 	// ErrorEvent Handle error events received from polling
 	ErrorEvent(session Session, errors []error) error
+}
+
+// SessionKey is the identity field the sessions are looked up by.
+type SessionKey string
+
+const (
+	SessionById          SessionKey = "id"
+	SessionByFrontend    SessionKey = "frontend"
+	SessionByBackend     SessionKey = "backend"
+	SessionByClientIp    SessionKey = "client_ip"
+	SessionByCertSerial  SessionKey = "cert_serial"
+	SessionByCertSubject SessionKey = "cert_subject"
+	SessionByPeerUid     SessionKey = "peer_uid"
+	SessionByPeerGid     SessionKey = "peer_gid"
+)
+
+var sessionKeys = []SessionKey{SessionById, SessionByFrontend, SessionByBackend, SessionByClientIp, SessionByCertSerial, SessionByCertSubject,
+	SessionByPeerUid, SessionByPeerGid}
 
-	GetBuffer() []byte
+func (k SessionKey) valid() bool {
+	for _, key := range sessionKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
 }
 
 type SessionHolder interface {
 	FindSessionByFd(fd int) (Session, error)
-	AddSession(session Session)
+	// AddSession Registers the session served by the controller, the session is killed through its controller
+	AddSession(session Session, controller LoopController)
 	RemoveSession(session Session)
+	// FindSessions Returns the sessions which identity has the value by the key
+	FindSessions(key SessionKey, value string) ([]Session, error)
+	// ListSessions Returns the stats of the registered sessions
+	ListSessions() []SessionStats
+	// KillSessions Closes the sessions which identity has the value by the key, returns the number of the killed sessions.
+	// The sessions are closed by their loops, so they're cut off right after the running handlers return.
+	KillSessions(key SessionKey, value string) (int, error)
 }
 
+// NewBufferHandler Returns the handler which passes the events to the sessions, the sessions borrow the
+// buffers from the pool of the event loop.
 func NewBufferHandler() NetEventHandler {
-	return &bufferHandler{
-		bb: make([]byte, 4096),
-	}
+	return &bufferHandler{}
 }
 
 type bufferHandler struct {
-	bb []byte
 }
 
 func (h *bufferHandler) ReadEvent(session Session, fd int) error {
 	if session == nil {
 		return noSessionFound
 	}
-	return session.ProcessRead(fd, h.bb)
+	return session.ProcessRead(fd)
 }
 
-func (h *bufferHandler) ErrorEvent(session Session, errors []error) error {
-	if session != nil {
-		err := session.Close()
-		if err != nil {
-			log.Error().Msgf("got error while close session: %+v", err)
-		}
+func (h *bufferHandler) WriteEvent(session Session, fd int) error {
+	if session == nil {
+		return noSessionFound
 	}
-	return closedSession
+	return session.ProcessWrite(fd)
 }
-func (h *bufferHandler) GetBuffer() []byte {
-	return h.bb
+
+// ErrorEvent Returns the error of the event, the loop records it as the close reason and closes the session.
+func (h *bufferHandler) ErrorEvent(session Session, errors []error) error {
+	if session == nil {
+		return noSessionFound
+	}
+	if len(errors) > 0 {
+		return errors[0]
+	}
+	return pollError
 }
 
 func NewMapSessionProvider(ctx context.Context) SessionHolder {
 	sessionHolder := &mapSessionHolder{
-		ctx:      ctx,
-		lock:     &sync.RWMutex{},
-		sessions: make(map[int]Session),
+		ctx:         ctx,
+		lock:        &sync.RWMutex{},
+		sessions:    make(map[int]Session),
+		controllers: make(map[Session]LoopController),
+		index:       make(map[SessionKey]map[string]map[Session]struct{}),
+	}
+	for _, key := range sessionKeys {
+		sessionHolder.index[key] = make(map[string]map[Session]struct{})
 	}
 	go sessionHolder.init()
 	return sessionHolder
 }
 
 type mapSessionHolder struct {
-	ctx      context.Context
-	lock     *sync.RWMutex
-	sessions map[int]Session
+	ctx         context.Context
+	lock        *sync.RWMutex
+	sessions    map[int]Session
+	controllers map[Session]LoopController
+	// index keeps the sessions by the values of their identity, the empty values aren't indexed
+	index map[SessionKey]map[string]map[Session]struct{}
 }
 
 func (sp *mapSessionHolder) FindSessionByFd(fd int) (Session, error) {
@@ -78,13 +124,27 @@ func (sp *mapSessionHolder) FindSessionByFd(fd int) (Session, error) {
 	return nil, noSessionFound
 }
 
-func (sp *mapSessionHolder) AddSession(session Session) {
+func (sp *mapSessionHolder) AddSession(session Session, controller LoopController) {
 	sp.lock.Lock()
 	defer sp.lock.Unlock()
 	fds := session.GetFds()
 	for _, fd := range fds {
 		sp.sessions[fd] = session
 	}
+	sp.controllers[session] = controller
+	identity := session.GetIdentity()
+	for _, key := range sessionKeys {
+		value := identity.Get(key)
+		if value == "" {
+			continue
+		}
+		sessions, ok := sp.index[key][value]
+		if !ok {
+			sessions = make(map[Session]struct{})
+			sp.index[key][value] = sessions
+		}
+		sessions[session] = struct{}{}
+	}
 }
 
 func (sp *mapSessionHolder) RemoveSession(session Session) {
@@ -94,6 +154,69 @@ func (sp *mapSessionHolder) RemoveSession(session Session) {
 	for _, fd := range fds {
 		delete(sp.sessions, fd)
 	}
+	delete(sp.controllers, session)
+	identity := session.GetIdentity()
+	for _, key := range sessionKeys {
+		value := identity.Get(key)
+		sessions := sp.index[key][value]
+		delete(sessions, session)
+		if len(sessions) == 0 {
+			delete(sp.index[key], value)
+		}
+	}
+}
+
+func (sp *mapSessionHolder) FindSessions(key SessionKey, value string) ([]Session, error) {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	index, ok := sp.index[key]
+	if !ok {
+		return nil, unknownSessionKey
+	}
+	sessions := make([]Session, 0, len(index[value]))
+	for session := range index[value] {
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (sp *mapSessionHolder) ListSessions() []SessionStats {
+	sp.lock.RLock()
+	defer sp.lock.RUnlock()
+	stats := make([]SessionStats, 0, len(sp.controllers))
+	for session := range sp.controllers {
+		stats = append(stats, session.GetStats())
+	}
+	return stats
+}
+
+func (sp *mapSessionHolder) KillSessions(key SessionKey, value string) (int, error) {
+	sessions, err := sp.FindSessions(key, value)
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		sp.kill(session)
+	}
+	return len(sessions), nil
+}
+
+// kill Closes the session on its loop, the session could be closed by itself before the task runs.
+func (sp *mapSessionHolder) kill(session Session) {
+	sp.lock.RLock()
+	controller, ok := sp.controllers[session]
+	sp.lock.RUnlock()
+	if !ok {
+		return
+	}
+	controller.Execute(func() {
+		sp.lock.RLock()
+		_, ok := sp.controllers[session]
+		sp.lock.RUnlock()
+		if ok {
+			controller.CloseSession(session, killedSession)
+		}
+	})
 }
 
 func (sp *mapSessionHolder) init() {
@@ -0,0 +1,74 @@
+package dynproxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockford alphabet of the session ids, it doesn't have the letters which could be confused with the digits
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// sessionIds generates ULID-style ids: 48 bits of the unix time in ms and 80 random bits encoded to 26 chars.
+// The ids sort by creation time, the random part is incremented within the same ms, so they stay monotonic.
+var sessionIds = &idGenerator{}
+
+type idGenerator struct {
+	lock    sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+func newSessionId() string {
+	return sessionIds.next(time.Now())
+}
+
+func (g *idGenerator) next(now time.Time) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	ms := uint64(now.UnixMilli())
+	if ms > g.lastMs {
+		g.lastMs = ms
+		g.seed(now)
+	} else if !g.increment() {
+		// the random part overflows within the ms, the next ms is borrowed to stay monotonic
+		g.lastMs++
+		g.seed(now)
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], g.lastMs<<16)
+	copy(id[6:], g.entropy[:])
+	return encodeId(id)
+}
+
+func (g *idGenerator) seed(now time.Time) {
+	_, err := rand.Read(g.entropy[:])
+	if err != nil {
+		binary.BigEndian.PutUint64(g.entropy[2:], uint64(now.UnixNano()))
+	}
+}
+
+// increment Adds one to the random part, returns false when it overflows.
+func (g *idGenerator) increment() bool {
+	for i := len(g.entropy) - 1; i >= 0; i-- {
+		g.entropy[i]++
+		if g.entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeId Encodes 128 bits to 26 chars by 5 bits, the first char keeps the 3 highest bits.
+func encodeId(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,44 @@
+package dynproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionId(t *testing.T) {
+	generator := &idGenerator{}
+	now := time.UnixMilli(1700000000000)
+	prev := generator.next(now)
+	for i := 0; i < 1000; i++ {
+		// the ids of the same ms and of the clock moved back keep growing
+		id := generator.next(now.Add(-time.Duration(i%3) * time.Millisecond))
+		if len(id) != 26 || id <= prev {
+			t.Fatalf("id %s isn't greater than %s", id, prev)
+		}
+		prev = id
+	}
+	later := generator.next(now.Add(time.Millisecond))
+	if later[:10] == prev[:10] || later <= prev {
+		t.Fatalf("id %s of the next ms doesn't sort after %s", later, prev)
+	}
+	if encoded := encodeId([16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}); encoded != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("unexpected encoding of the max id: %s", encoded)
+	}
+}
+
+func TestSessionIdentityFields(t *testing.T) {
+	identity := SessionIdentity{Id: "id", Frontend: "front", Backend: "back", ClientAddr: "127.0.0.1:1", PeerUid: "0"}
+	expected := []string{"session", "frontend", "backend", "client", "peer_uid"}
+	// the order of the fields in the log lines doesn't change from session to session
+	for i := 0; i < 10; i++ {
+		fields := identity.fields()
+		if len(fields) != len(expected) {
+			t.Fatalf("unexpected fields: %+v", fields)
+		}
+		for j, field := range fields {
+			if field.name != expected[j] {
+				t.Fatalf("unexpected field %s at %d: %+v", field.name, j, fields)
+			}
+		}
+	}
+}
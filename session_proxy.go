@@ -1,97 +1,436 @@
 package dynproxy
 
 import (
-	"github.com/rs/zerolog/log"
+	"crypto/tls"
+	"errors"
+	"github.com/rs/zerolog"
+	"go.uber.org/atomic"
+	"golang.org/x/sys/unix"
+	"io"
+	"math"
 	"net"
+	"os"
 	"time"
 )
 
+const (
+	defHalfCloseLinger = 30 * time.Second
+	defReadBudget      = 256 * 1024
+	// minThrottle the shortest pause of the throttled reads, so the session doesn't wake up for a few bytes
+	minThrottle = time.Millisecond
+)
+
 type proxySession struct {
-	id        string
-	backendFd int
-	frontFd   int
-	backend   net.Conn
-	frontend  net.Conn
-	eventChan chan Event
-	stats     *proxySessionStats
+	id          string
+	identity    SessionIdentity
+	logger      zerolog.Logger
+	backend     *sessionPeer
+	frontend    *sessionPeer
+	eventChan   chan Event
+	stats       *proxySessionStats
+	controller  LoopController
+	linger      time.Duration
+	lingerTimer *Timer
+	// connecting is the backend connection in progress, the frontend isn't read until it's connected
+	connecting   *fdConn
+	connectTimer *Timer
+	// idleTimeout closes the session without data in both directions, maxLifetime closes it regardless of activity
+	idleTimeout   time.Duration
+	idleTimer     *Timer
+	maxLifetime   time.Duration
+	lifetimeTimer *Timer
+	// limiter owns identityBucket which is shared by the sessions of the same identity
+	limiter        *RateLimiter
+	identityBucket *tokenBucket
+	// capture is the stream of the running capture which matched the session at captureVersion of the captures
+	captures       *Captures
+	captureVersion uint64
+	capture        *captureStream
+	mirror         *mirror
+	filters        []Filter
+	// filterBuf joins the buffers of one read for the filters, it's reused by the next reads
+	filterBuf  []byte
+	readBudget int
+	buffers    *BufferPool
+	// vector is reused for the buffers of one read
+	vector [][]byte
 }
 
+// proxySessionStats counters of the session, they're read by the registry from the other goroutines
 type proxySessionStats struct {
-	LastActivityTime   int64
-	TotalSentBytes     uint64
-	TotalReceivedBytes uint64
+	LastActivityTime   atomic.Int64
+	TotalSentBytes     atomic.Uint64
+	TotalReceivedBytes atomic.Uint64
+	ThrottledTime      atomic.Duration
+	DroppedDatagrams   atomic.Uint64
+	// CloseReason is recorded on the loop of the session once it's closed
+	CloseReason atomic.Error
+}
+
+// recordCloseReason Keeps the first reason, it's called only by the loop of the session.
+func (s *proxySessionStats) recordCloseReason(reason error) {
+	if s.CloseReason.Load() == nil {
+		s.CloseReason.Store(reason)
+	}
+}
+
+// sessionPeer is one side of the proxy session, out keeps the bytes pending to be written to this side.
+type sessionPeer struct {
+	fd         int
+	connType   ConnType
+	conn       net.Conn
+	out        *writeBuffer
+	readPaused bool
+	writeArmed bool
+	// readDone the peer finished sending, writeDone the write side toward the peer is shut down
+	readDone  bool
+	writeDone bool
+	// pipe moves the bytes toward the peer when splice is enabled
+	pipe *splicePipe
+	// tls is set for TLS peers, out keeps the ciphertext for them
+	tls *tls.Conn
+	// recv the bytes of the peer are received by the poller of the loop, the session takes them instead of reading the fd
+	recv bool
+	// window bytes read by one syscall, it grows while the peer sends faster than it's read and shrinks when it's idle
+	window int
+	// bucket limits the bytes read from the peer, the reads are paused by the throttle timer while it's empty
+	bucket        *tokenBucket
+	throttled     bool
+	throttleTimer *Timer
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type ProxySessionConfig struct {
+	// SpliceEnabled moves the data of plain TCP sessions between the sockets with splice(2)
+	SpliceEnabled bool
+	// ReadBudget max bytes read from one side per wakeup, the rest is read on the next loop iteration
+	ReadBudget int
+	// IdleTimeout and MaxLifetime close the session on expiration, zero disables the timeout
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// Frontend and Backend names of the session ends, the session is looked up by them in the registry
+	Frontend string
+	Backend  string
+	// RateLimiter limits the bandwidth of the sessions of the frontend, nil disables the limits
+	RateLimiter *RateLimiter
+	// Captures writes the plaintext of the matched sessions to the pcapng files
+	Captures *Captures
+	// Mirror copies the client bytes to the shadow backend, the mirrored sessions don't use splice
+	Mirror MirrorConfig
+	// Filters of the session created by the filter chain of the frontend, the filtered sessions don't use splice
+	Filters []Filter
 }
 
 func NewDefaultProxySession(frontConn net.Conn, srvConn net.Conn, eventChan chan Event) (Session, error) {
-	return NewProxySession(frontConn, srvConn, eventChan)
+	return NewProxySession(frontConn, srvConn, eventChan, ProxySessionConfig{})
+}
+
+// NewProxySession Returns the session of the connections, the filters of the config are closed when the session can't be created.
+func NewProxySession(frontConn net.Conn, backendConn net.Conn, eventChan chan Event, config ProxySessionConfig) (Session, error) {
+	session, err := newProxySession(frontConn, backendConn, eventChan, config)
+	if err != nil {
+		closeFilters(config.Filters, err)
+		return nil, err
+	}
+	return session, nil
 }
 
-func NewProxySession(frontConn net.Conn, backendConn net.Conn, eventChan chan Event) (Session, error) {
-	frontFd, _, err := ConnToFileDesc(frontConn)
+func newProxySession(frontConn net.Conn, backendConn net.Conn, eventChan chan Event, config ProxySessionConfig) (*proxySession, error) {
+	frontFd, frontType, err := ConnToFileDesc(frontConn)
 	if err != nil {
 		return nil, err
 	}
-	backendFd, _, err := ConnToFileDesc(backendConn)
+	backendFd, backendType, err := ConnToFileDesc(backendConn)
 	if err != nil {
 		return nil, err
 	}
-	return &proxySession{
-		id:        generateId(frontConn, backendConn),
-		frontFd:   frontFd,
-		frontend:  frontConn,
-		backendFd: backendFd,
-		backend:   backendConn,
-		eventChan: eventChan,
-		stats:     &proxySessionStats{},
-	}, nil
+	frontend, err := newSessionPeer(frontFd, frontType, frontConn)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := newSessionPeer(backendFd, backendType, backendConn)
+	if err != nil {
+		return nil, err
+	}
+	id := newSessionId()
+	identity := newSessionIdentity(id, frontConn)
+	identity.Frontend = config.Frontend
+	identity.Backend = config.Backend
+	session := &proxySession{
+		id:          id,
+		identity:    identity,
+		logger:      identity.logger(),
+		frontend:    frontend,
+		backend:     backend,
+		eventChan:   eventChan,
+		stats:       &proxySessionStats{},
+		linger:      defHalfCloseLinger,
+		idleTimeout: config.IdleTimeout,
+		maxLifetime: config.MaxLifetime,
+		readBudget:  config.ReadBudget,
+		captures:    config.Captures,
+		filters:     config.Filters,
+	}
+	for _, filter := range session.filters {
+		err = filter.OnBackendSelected(identity, backendConn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.readBudget <= 0 {
+		session.readBudget = defReadBudget
+	}
+	if config.RateLimiter != nil {
+		session.limiter = config.RateLimiter
+		frontend.bucket = newTokenBucket(config.RateLimiter.config.UpstreamBytesPerSec)
+		backend.bucket = newTokenBucket(config.RateLimiter.config.DownstreamBytesPerSec)
+		session.identityBucket = config.RateLimiter.acquire(identity)
+	}
+	session.mirror = newMirror(config.Mirror, dialMirror, &session.logger)
+	if config.SpliceEnabled && isStream(frontType) && isStream(backendType) && session.mirror == nil && len(session.filters) == 0 {
+		session.enableSplice()
+	}
+	return session, nil
+}
+
+// isStream Returns true for the plain stream sockets which can be spliced.
+func isStream(connType ConnType) bool {
+	return connType == TCP || connType == UNIX
+}
+
+// enableSplice Opens the pipe pair of the session, the session stays on the copy path if pipes aren't available.
+func (s *proxySession) enableSplice() {
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		pipe, err := newSplicePipe()
+		if err != nil {
+			s.logger.Warn().Msgf("can't open splice pipe, fallback to copy: %+v", err)
+			s.closePipes()
+			return
+		}
+		peer.pipe = pipe
+	}
+}
+
+// enableRecv Lets the poller of the loop receive the bytes of the plain stream peers, the spliced sessions
+// move the bytes in the kernel and read the sockets themselves.
+func (s *proxySession) enableRecv() {
+	receiver, ok := s.controller.(recvController)
+	if !ok || s.frontend.pipe != nil {
+		return
+	}
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		if peer.tls == nil && isStream(peer.connType) {
+			peer.recv = receiver.RecvFd(peer.fd)
+		}
+	}
+}
+
+func newSessionPeer(fd int, connType ConnType, conn net.Conn) (*sessionPeer, error) {
+	peer := &sessionPeer{
+		fd:       fd,
+		connType: connType,
+		conn:     conn,
+	}
+	if connType != TLS {
+		peer.out = newWriteBuffer(defWriteHighWaterMark, defWriteLowWaterMark)
+		return peer, nil
+	}
+	tlsConn, ok := conn.(*tlsConn)
+	if !ok {
+		return nil, unsupportedTlsConn
+	}
+	peer.tls = tlsConn.Conn
+	peer.out = tlsConn.transport.out
+	return peer, nil
+}
+
+func (s *proxySession) Init(controller LoopController) error {
+	s.start(controller)
+	s.frontend.window = s.buffers.minReadSize
+	s.backend.window = s.buffers.minReadSize
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		if peer.tls != nil {
+			peer.conn.(*tlsConn).transport.setLoopMode()
+		}
+	}
+	if conn, ok := s.backend.conn.(*fdConn); ok && conn.connecting {
+		return s.waitConnect(conn)
+	}
+	return s.readPeers()
+}
+
+// start Attaches the session to the controller and starts the timers of the session.
+func (s *proxySession) start(controller LoopController) {
+	s.controller = controller
+	s.buffers = controller.Buffers()
+	s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+	if s.idleTimeout > 0 {
+		s.idleTimer = controller.Schedule(s.idleTimeout, s.checkIdle)
+	}
+	if s.maxLifetime > 0 {
+		s.lifetimeTimer = controller.Schedule(s.maxLifetime, func() {
+			s.expire(lifetimeExpired)
+		})
+	}
 }
 
-func (s *proxySession) Init(buffer []byte) error {
-	err := s.ProcessRead(s.frontFd, buffer)
+// readPeers Starts proxying of the connected peers, the bytes which came before are read right away.
+func (s *proxySession) readPeers() error {
+	s.enableRecv()
+	err := s.ProcessRead(s.frontend.fd)
 	if err != nil {
 		return err
 	}
-	err = s.ProcessRead(s.backendFd, buffer)
+	return s.ProcessRead(s.backend.fd)
+}
+
+// waitConnect Polls the backend for the end of the connect and stops polling the frontend meanwhile. The session is
+// closed by the connect timeout when the backend doesn't answer, the other sessions of the loop aren't blocked.
+func (s *proxySession) waitConnect(conn *fdConn) error {
+	s.connecting = conn
+	err := s.controller.ModifyPoll(s.frontend.fd, false, false)
 	if err != nil {
 		return err
 	}
+	err = s.controller.ModifyPoll(s.backend.fd, false, true)
+	if err != nil {
+		return err
+	}
+	if conn.connectTimeout > 0 {
+		s.connectTimer = s.controller.Schedule(conn.connectTimeout, func() {
+			s.connectTimer = nil
+			s.expire(connectTimeout)
+		})
+	}
 	return nil
 }
 
-func (s *proxySession) ProcessRead(fd int, buffer []byte) error {
-	if fd == s.frontFd {
-		return s.copyFromFrontend(buffer)
+// finishConnect Starts proxying once the backend is connected, the connect error closes the session.
+func (s *proxySession) finishConnect() error {
+	connected, err := s.connecting.finishConnect()
+	if err != nil || !connected {
+		return err
+	}
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("[%d] backend is connected", s.backend.fd)
+	}
+	s.connecting = nil
+	if s.connectTimer != nil {
+		s.controller.CancelTimer(s.connectTimer)
+		s.connectTimer = nil
+	}
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		err = s.updatePoll(peer)
+		if err != nil {
+			return err
+		}
+	}
+	return s.readPeers()
+}
+
+func (s *proxySession) ProcessRead(fd int) error {
+	if s.connecting != nil {
+		return s.processConnect(fd)
+	}
+	var err error
+	if fd == s.frontend.fd {
+		err = s.copy(s.frontend, s.backend)
 	} else {
-		return s.copyFromBackend(buffer)
+		err = s.copy(s.backend, s.frontend)
 	}
+	if err != nil {
+		return err
+	}
+	return s.checkFinished()
+}
+
+// processConnect Handles the events of the session which waits for the backend, the frontend events are left
+// until the session starts, it reads the frontend then.
+func (s *proxySession) processConnect(fd int) error {
+	if fd != s.backend.fd {
+		return nil
+	}
+	err := s.finishConnect()
+	if err != nil {
+		return err
+	}
+	return s.checkFinished()
+}
+
+func (s *proxySession) ProcessWrite(fd int) error {
+	if s.connecting != nil {
+		return s.processConnect(fd)
+	}
+	var err error
+	if fd == s.frontend.fd {
+		err = s.flush(s.frontend, s.backend)
+	} else {
+		err = s.flush(s.backend, s.frontend)
+	}
+	if err != nil {
+		return err
+	}
+	return s.checkFinished()
 }
 
 func (s *proxySession) GetConnByFd(fd int) net.Conn {
-	if fd == s.frontFd {
-		return s.frontend
+	if fd == s.frontend.fd {
+		return s.frontend.conn
 	}
-	return s.backend
+	return s.backend.conn
 }
 
 func (s *proxySession) Close() error {
-	err := s.frontend.Close()
+	for _, timer := range []*Timer{s.connectTimer, s.lingerTimer, s.idleTimer, s.lifetimeTimer, s.frontend.throttleTimer, s.backend.throttleTimer} {
+		if timer != nil {
+			s.controller.CancelTimer(timer)
+		}
+	}
+	if s.identityBucket != nil {
+		s.limiter.release(s.identity)
+		s.identityBucket = nil
+	}
+	if s.mirror != nil {
+		s.mirror.close()
+	}
+	if len(s.filters) > 0 {
+		stats := s.GetStats()
+		for _, filter := range s.filters {
+			filter.OnClose(stats)
+		}
+		s.filters = nil
+	}
+	s.closePipes()
+	err := s.frontend.conn.Close()
 	if err != nil {
-		log.Debug().Msgf("closed frontend session error: %+v", err)
+		s.logger.Debug().Msgf("closed frontend session error: %+v", err)
 	}
-	if s.backend != nil {
-		err = s.backend.Close()
+	if s.backend.conn != nil {
+		err = s.backend.conn.Close()
 		if err != nil {
-			log.Debug().Msgf("closed backend session error: %+v", err)
+			s.logger.Debug().Msgf("closed backend session error: %+v", err)
 		}
 	}
-	if log.Debug().Enabled() {
-		log.Debug().Msgf("closed session: %+v", s)
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("closed session, sent: %d received: %d", s.stats.TotalSentBytes.Load(), s.stats.TotalReceivedBytes.Load())
 	}
 	return err
 }
 
+func (s *proxySession) closePipes() {
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		if peer.pipe != nil {
+			peer.pipe.close()
+			peer.pipe = nil
+		}
+	}
+}
+
 func (s *proxySession) GetFds() []int {
-	return []int{s.frontFd, s.backendFd}
+	return []int{s.frontend.fd, s.backend.fd}
 }
 
 func (s *proxySession) GetId() string {
@@ -100,50 +439,705 @@ func (s *proxySession) GetId() string {
 
 func (s *proxySession) GetStats() SessionStats {
 	return SessionStats{
-		LastActivityTime:   s.stats.LastActivityTime,
-		TotalSentBytes:     s.stats.TotalSentBytes,
-		TotalReceivedBytes: s.stats.TotalReceivedBytes,
+		LastActivityTime:   s.stats.LastActivityTime.Load(),
+		TotalSentBytes:     s.stats.TotalSentBytes.Load(),
+		TotalReceivedBytes: s.stats.TotalReceivedBytes.Load(),
+		CloseReason:        s.stats.CloseReason.Load(),
+		ThrottledTime:      s.stats.ThrottledTime.Load(),
+		Identity:           s.identity,
 	}
 }
 
-func (s *proxySession) copyFromFrontend(buffer []byte) error {
-	read, err := s.frontend.Read(buffer)
+func (s *proxySession) recordCloseReason(reason error) {
+	s.stats.recordCloseReason(reason)
+}
+
+func (s *proxySession) GetIdentity() SessionIdentity {
+	return s.identity
+}
+
+func (s *proxySession) Logger() *zerolog.Logger {
+	return &s.logger
+}
+
+// copy Moves the available bytes from src to dst until src is drained or the read budget is spent. Edge triggered
+// poller doesn't report the bytes left in the socket again, so the session is put on the ready list of the loop.
+func (s *proxySession) copy(src, dst *sessionPeer) error {
+	s.refreshCapture()
+	budget := s.readBudget
+	for !src.readDone && !src.readPaused && !src.throttled {
+		if budget <= 0 {
+			if s.controller != nil {
+				s.controller.Ready(s, src.fd)
+			}
+			return nil
+		}
+		limit := s.allowance(src)
+		if limit == 0 {
+			return s.throttle(src)
+		}
+		read, err := s.copyOnce(src, dst, limit)
+		if err != nil {
+			return err
+		}
+		if read == 0 {
+			break
+		}
+		budget -= read
+	}
+	if s.readBudget-budget < src.window/4 {
+		src.window = s.buffers.shrinkWindow(src.window)
+	}
+	return nil
+}
+
+// copyOnce Moves one chunk up to limit bytes from src to dst, via the splice pipe of dst when it's enabled.
+// Returns 0 when src is drained.
+func (s *proxySession) copyOnce(src, dst *sessionPeer, limit int) (int, error) {
+	if dst.pipe != nil {
+		read, err := s.splice(src, dst, minInt(limit, spliceChunkSize))
+		if err != spliceUnsupported {
+			return read, err
+		}
+		s.logger.Warn().Msgf("[%d] splice isn't supported, fallback to copy", src.fd)
+		s.disableSplice()
+	}
+	if src.recv {
+		return s.copyReceived(src, dst, limit)
+	}
+	size := minInt(limit, src.window)
+	buffers := s.buffers.GetVector(size, s.vector[:0])
+	read, err := s.copyBuffers(src, dst, trimVector(buffers, size))
+	s.buffers.PutVector(buffers)
+	s.vector = buffers[:0]
+	return read, err
+}
+
+// copyBuffers Reads src into the borrowed buffers and writes them to dst, the rest of the data is copied to the pending buffer of dst.
+func (s *proxySession) copyBuffers(src, dst *sessionPeer, buffers [][]byte) (int, error) {
+	read, err := src.read(buffers)
+	if err == io.EOF {
+		return 0, s.halfClose(src, dst)
+	}
 	if err != nil {
-		log.Printf("got error while reading data from:%+v, error: %+v", s.frontend.RemoteAddr(), err)
-		return err
+		s.logger.Printf("got error while reading data from:%+v, error: %+v", src.conn.RemoteAddr(), err)
+		return 0, err
+	}
+	if src.tls != nil {
+		// TLS layer could answer to the post-handshake messages
+		err = s.armWrite(src)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if read == 0 {
+		return 0, nil
+	}
+	if read >= src.window {
+		src.window = s.buffers.growWindow(src.window)
+	}
+	return s.forward(src, dst, read, trimVector(buffers, read))
+}
+
+// copyReceived Moves the bytes received by the poller from src to dst, the buffer of the poller is consumed once
+// the bytes are written or copied to the pending buffer of dst. Returns 0 when nothing is received yet.
+func (s *proxySession) copyReceived(src, dst *sessionPeer, limit int) (int, error) {
+	receiver := s.controller.(recvController)
+	data, err := receiver.PeekReceived(src.fd)
+	if err == io.EOF {
+		return 0, s.halfClose(src, dst)
+	}
+	if err != nil {
+		s.logger.Printf("got error while receiving data from:%+v, error: %+v", src.conn.RemoteAddr(), err)
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	data = data[:minInt(limit, len(data))]
+	s.vector = append(s.vector[:0], data)
+	read, err := s.forward(src, dst, len(data), s.vector)
+	s.vector[0] = nil
+	s.vector = s.vector[:0]
+	receiver.ConsumeReceived(src.fd, len(data))
+	return read, err
+}
+
+// forward Passes the bytes read from src through the capture, the filters and the mirror and writes them to dst.
+func (s *proxySession) forward(src, dst *sessionPeer, read int, data [][]byte) (int, error) {
+	s.countRead(src, read)
+	if s.capture != nil {
+		s.captureData(src, data)
+	}
+	var err error
+	if len(s.filters) > 0 {
+		data, err = s.filterData(src, data)
+		if err != nil || len(data) == 0 {
+			return read, err
+		}
+	}
+	if s.mirror != nil && src == s.frontend {
+		s.mirror.write(data)
+	}
+	write, err := s.write(dst, src, data)
+	if err != nil {
+		s.logger.Printf("got error while writing data to:%+v error: %+v", dst.conn.RemoteAddr(), err)
+		return 0, err
+	}
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("read %d bytes from: %s and write %d bytes to %s", read, src.conn.RemoteAddr().String(), write, dst.conn.RemoteAddr().String())
+	}
+	return read, nil
+}
+
+// splice Moves the available bytes from src to dst through the pipe in kernel space. The pipe of dst
+// acts as pending buffer, src stops reading until the pipe is drained.
+func (s *proxySession) splice(src, dst *sessionPeer, size int) (int, error) {
+	read, err := dst.pipe.spliceFrom(src.fd, size)
+	if err == io.EOF {
+		return 0, s.halfClose(src, dst)
+	}
+	if err != nil {
+		if err != spliceUnsupported {
+			s.logger.Printf("got error while splicing data from:%+v, error: %+v", src.conn.RemoteAddr(), err)
+		}
+		return 0, err
 	}
 	if read > 0 {
-		write, err := s.backend.Write(buffer[:read])
+		s.countRead(src, read)
+		err = s.flush(dst, src)
 		if err != nil {
-			log.Printf("got error while writing data to:%+v error: %+v", s.backend.RemoteAddr(), err)
+			return 0, err
+		}
+		if s.logger.Debug().Enabled() {
+			s.logger.Debug().Msgf("spliced %d bytes from: %s to %s, pending: %d", read, src.conn.RemoteAddr().String(), dst.conn.RemoteAddr().String(), dst.pipe.pending)
+		}
+		if dst.pipe.pending > 0 && !src.readPaused {
+			src.readPaused = true
+			return read, s.updatePoll(src)
+		}
+	}
+	return read, nil
+}
+
+// write Writes data to dst or keeps the rest in the pending buffer of dst, src stops reading while dst is above high water mark.
+// TLS peer encrypts the whole data at once, the ciphertext which can't be written stays in its pending buffer.
+func (s *proxySession) write(dst, src *sessionPeer, data [][]byte) (int, error) {
+	written := 0
+	if dst.out.Len() == 0 || dst.tls != nil {
+		n, err := dst.write(data)
+		if err != nil {
+			return 0, err
+		}
+		s.countWritten(dst, n)
+		written = n
+	}
+	skip := written
+	for _, buf := range data {
+		if skip >= len(buf) {
+			skip -= len(buf)
+			continue
+		}
+		dst.out.Append(buf[skip:])
+		skip = 0
+	}
+	if dst.out.Len() > 0 {
+		err := s.armWrite(dst)
+		if err != nil {
+			return written, err
+		}
+		if dst.out.AboveHighWater() && !src.readPaused {
+			if s.logger.Debug().Enabled() {
+				s.logger.Debug().Msgf("[%d] pause reading, %d bytes pending to fd: %d", src.fd, dst.out.Len(), dst.fd)
+			}
+			src.readPaused = true
+			err := s.updatePoll(src)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// armWrite Enables write readiness notifications while the peer has pending bytes.
+func (s *proxySession) armWrite(peer *sessionPeer) error {
+	if peer.writeArmed || s.pending(peer) == 0 {
+		return nil
+	}
+	peer.writeArmed = true
+	return s.updatePoll(peer)
+}
+
+// flush Writes the pending bytes of dst on write readiness and resumes reading from src below low water mark.
+func (s *proxySession) flush(dst, src *sessionPeer) error {
+	for dst.out.Len() > 0 {
+		n, err := writeFd(dst.fd, dst.out.Bytes())
+		if err != nil {
+			s.logger.Printf("got error while writing data to:%+v error: %+v", dst.conn.RemoteAddr(), err)
 			return err
 		}
-		if log.Debug().Enabled() {
-			log.Debug().Msgf("read %d bytes from: %s and write %d bytes to %s", read, s.frontend.RemoteAddr().String(), write, s.backend.RemoteAddr().String())
+		if n == 0 {
+			break
+		}
+		// the plain bytes of TLS peer are counted when they are encrypted
+		if dst.tls == nil {
+			s.countWritten(dst, n)
+		}
+		dst.out.Consume(n)
+	}
+	if dst.out.Len() == 0 && dst.pipe != nil && dst.pipe.pending > 0 {
+		n, err := dst.pipe.spliceTo(dst.fd)
+		if err != nil {
+			s.logger.Printf("got error while splicing data to:%+v error: %+v", dst.conn.RemoteAddr(), err)
+			return err
 		}
-		s.stats.LastActivityTime = time.Now().UnixMilli()
-		s.stats.TotalReceivedBytes += uint64(read)
+		s.countWritten(dst, n)
+	}
+	pending := s.pending(dst)
+	if (pending > 0) != dst.writeArmed {
+		dst.writeArmed = pending > 0
+		err := s.updatePoll(dst)
+		if err != nil {
+			return err
+		}
+	}
+	if pending == 0 && src.readDone {
+		return s.shutdownWrite(dst)
+	}
+	if src.readPaused && dst.out.BelowLowWater() && (dst.pipe == nil || dst.pipe.pending == 0) {
+		if s.logger.Debug().Enabled() {
+			s.logger.Debug().Msgf("[%d] resume reading, %d bytes pending to fd: %d", src.fd, pending, dst.fd)
+		}
+		src.readPaused = false
+		if (src.tls != nil || src.recv) && s.controller != nil {
+			// the decrypted data could be left in TLS layer and the received bytes in the poller, the socket won't report them
+			s.controller.Ready(s, src.fd)
+		}
+		return s.updatePoll(src)
 	}
 	return nil
 }
 
-func (s *proxySession) copyFromBackend(buffer []byte) error {
-	read, err := s.backend.Read(buffer)
+// pending Returns the number of bytes waiting to be written to the peer.
+func (s *proxySession) pending(peer *sessionPeer) int {
+	pending := peer.out.Len()
+	if peer.pipe != nil {
+		pending += peer.pipe.pending
+	}
+	return pending
+}
+
+// halfClose Stops the src->dst direction after src finished sending, dst write side is shut down once the pending bytes are flushed.
+func (s *proxySession) halfClose(src, dst *sessionPeer) error {
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("[%d] peer finished sending, %d bytes pending to fd: %d", src.fd, s.pending(dst), dst.fd)
+	}
+	src.readDone = true
+	s.startLinger()
+	// level triggered pollers would report EOF again
+	err := s.updatePoll(src)
 	if err != nil {
-		log.Printf("got error while reading data from:%+v, error: %+v", s.backend.RemoteAddr(), err)
 		return err
 	}
-	if read > 0 {
-		write, err := s.frontend.Write(buffer[:read])
+	if len(s.filters) > 0 {
+		err = s.flushFilters(src, dst)
 		if err != nil {
-			log.Printf("got error while writing data to:%+v error: %+v", s.frontend.RemoteAddr(), err)
 			return err
 		}
-		if log.Debug().Enabled() {
-			log.Debug().Msgf("read %d bytes from: %s and write %d bytes to %s", read, s.backend.RemoteAddr().String(), write, s.frontend.RemoteAddr().String())
+	}
+	if s.pending(dst) == 0 {
+		return s.shutdownWrite(dst)
+	}
+	return nil
+}
+
+func (s *proxySession) shutdownWrite(peer *sessionPeer) error {
+	if peer.writeDone {
+		return nil
+	}
+	peer.writeDone = true
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("[%d] shutdown write side", peer.fd)
+	}
+	if peer.tls != nil {
+		// close_notify is the half-close of TLS, it's flushed like the application data
+		err := peer.tls.CloseWrite()
+		if err != nil {
+			return err
 		}
-		s.stats.LastActivityTime = time.Now().UnixMilli()
-		s.stats.TotalSentBytes += uint64(write)
+		return s.armWrite(peer)
+	}
+	cw, ok := peer.conn.(closeWriter)
+	if ok {
+		return cw.CloseWrite()
+	}
+	return os.NewSyscallError("shutdown", unix.Shutdown(peer.fd, unix.SHUT_WR))
+}
+
+// checkFinished The session is finished when both directions are finished and nothing is left to write.
+func (s *proxySession) checkFinished() error {
+	if s.frontend.readDone && s.frontend.writeDone && s.backend.readDone && s.backend.writeDone &&
+		s.pending(s.frontend) == 0 && s.pending(s.backend) == 0 {
+		return finishedSession
 	}
 	return nil
 }
+
+// startLinger Limits the time the session stays half-closed, the event loop closes the session on expiration.
+func (s *proxySession) startLinger() {
+	if s.lingerTimer != nil || s.linger <= 0 || s.controller == nil {
+		return
+	}
+	s.lingerTimer = s.controller.Schedule(s.linger, func() {
+		s.expire(lingerTimeout)
+	})
+}
+
+// checkIdle Closes the session which didn't move any data for the idle timeout, the timer is rescheduled
+// for the rest of the timeout otherwise, so the data path doesn't touch the timer.
+func (s *proxySession) checkIdle() {
+	idle := time.Since(time.UnixMilli(s.stats.LastActivityTime.Load()))
+	if idle >= s.idleTimeout {
+		s.expire(idleTimeout)
+		return
+	}
+	s.idleTimer = s.controller.Schedule(s.idleTimeout-idle, s.checkIdle)
+}
+
+// expire Closes the session by the timeout, the reason is reported by the timeout event.
+func (s *proxySession) expire(reason error) {
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("%v", reason)
+	}
+	if s.eventChan != nil {
+		select {
+		case s.eventChan <- genSessionTimeoutEvent(s.identity, reason):
+		default:
+			s.logger.Warn().Msgf("event channel is full, drop timeout event of session")
+		}
+	}
+	s.controller.CloseSession(s, reason)
+}
+
+// disableSplice Moves the bytes left in the pipes to the write buffers and switches the session to the copy path.
+func (s *proxySession) disableSplice() {
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		if peer.pipe != nil {
+			err := peer.pipe.drainTo(peer.out)
+			if err != nil {
+				s.logger.Error().Msgf("[%d] got error while draining splice pipe: %+v", peer.fd, err)
+			}
+			peer.pipe.close()
+			peer.pipe = nil
+		}
+	}
+}
+
+func (s *proxySession) countRead(src *sessionPeer, n int) {
+	now := time.Now()
+	s.stats.LastActivityTime.Store(now.UnixMilli())
+	for _, bucket := range []*tokenBucket{src.bucket, s.identityBucket} {
+		if bucket != nil {
+			bucket.take(now, n)
+		}
+	}
+	if src == s.frontend {
+		s.stats.TotalReceivedBytes.Add(uint64(n))
+	}
+}
+
+func (s *proxySession) countWritten(dst *sessionPeer, n int) {
+	if n > 0 {
+		s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+	}
+	if dst == s.frontend {
+		s.stats.TotalSentBytes.Add(uint64(n))
+	}
+}
+
+func (s *proxySession) updatePoll(peer *sessionPeer) error {
+	if s.controller == nil {
+		return nil
+	}
+	return s.controller.ModifyPoll(peer.fd, !peer.readPaused && !peer.readDone && !peer.throttled, peer.writeArmed)
+}
+
+// filterData Passes the data read from src through the filters, the result is empty when a filter dropped the data.
+func (s *proxySession) filterData(src *sessionPeer, data [][]byte) ([][]byte, error) {
+	direction := Upstream
+	if src == s.backend {
+		direction = Downstream
+	}
+	buf := data[0]
+	if len(data) > 1 {
+		if s.filterBuf == nil {
+			s.filterBuf = make([]byte, 0, s.buffers.maxReadSize)
+		}
+		buf = s.filterBuf[:0]
+		for _, b := range data {
+			buf = append(buf, b...)
+		}
+		s.filterBuf = buf[:0]
+	}
+	var err error
+	for _, filter := range s.filters {
+		buf, err = filter.OnData(direction, buf)
+		if err != nil || len(buf) == 0 {
+			return nil, err
+		}
+	}
+	return [][]byte{buf}, nil
+}
+
+// flushFilters Writes to dst the bytes the filters keep when src finished sending.
+func (s *proxySession) flushFilters(src, dst *sessionPeer) error {
+	buf, err := s.filtersRest(src)
+	if err != nil || len(buf) == 0 {
+		return err
+	}
+	data := [][]byte{buf}
+	if s.mirror != nil && src == s.frontend {
+		s.mirror.write(data)
+	}
+	_, err = s.write(dst, src, data)
+	return err
+}
+
+// filtersRest Returns the bytes the filters keep when src finished sending, every filter gets the bytes flushed
+// by the previous ones followed by the end of the stream.
+func (s *proxySession) filtersRest(src *sessionPeer) ([]byte, error) {
+	direction := Upstream
+	if src == s.backend {
+		direction = Downstream
+	}
+	var buf []byte
+	for _, filter := range s.filters {
+		var flushed []byte
+		if len(buf) > 0 {
+			data, err := filter.OnData(direction, buf)
+			if err != nil {
+				return nil, err
+			}
+			flushed = append(flushed, data...)
+		}
+		data, err := filter.OnData(direction, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(flushed, data...)
+	}
+	return buf, nil
+}
+
+// refreshCapture Attaches the running capture which matches the session when the captures are changed. The splice
+// path is disabled while the session is captured, so the payload passes the user space.
+func (s *proxySession) refreshCapture() {
+	if s.captures == nil {
+		return
+	}
+	version := s.captures.version.Load()
+	if version == s.captureVersion {
+		return
+	}
+	s.captureVersion = version
+	capture := s.captures.match(s.identity)
+	if capture == nil {
+		s.capture = nil
+		return
+	}
+	if s.capture != nil && s.capture.capture == capture {
+		return
+	}
+	s.capture = newCaptureStream(capture, s.frontend.conn.RemoteAddr(), s.backend.conn.RemoteAddr())
+	if s.frontend.pipe != nil || s.backend.pipe != nil {
+		s.disableSplice()
+	}
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("session is captured by %s", capture.id)
+	}
+}
+
+// captureData Writes the payload read from src to the capture, the stream is detached when the capture is stopped.
+func (s *proxySession) captureData(src *sessionPeer, data [][]byte) {
+	for _, buf := range data {
+		if !s.capture.write(src == s.frontend, buf) {
+			s.capture = nil
+			return
+		}
+	}
+}
+
+// allowance Returns the bytes which can be read from src by the rate limits. The bucket which refilled less than
+// the min window doesn't allow the read, so the throttled session doesn't read a few bytes per syscall.
+func (s *proxySession) allowance(src *sessionPeer) int {
+	limit := math.MaxInt32
+	now := time.Now()
+	for _, bucket := range []*tokenBucket{src.bucket, s.identityBucket} {
+		if bucket != nil {
+			available := bucket.available(now)
+			if available < minInt(s.buffers.minReadSize, int(bucket.rate)) {
+				return 0
+			}
+			limit = minInt(limit, available)
+		}
+	}
+	return limit
+}
+
+// throttle Pauses the reads of src until its buckets allow the read of the min window, the socket keeps the data
+// meanwhile. The timer resumes the reads, the data which arrived during the pause isn't reported by the edge
+// triggered poller, so src is put on the ready list.
+func (s *proxySession) throttle(src *sessionPeer) error {
+	wait := s.throttleDelay(src)
+	src.throttled = true
+	src.throttleTimer = s.controller.Schedule(wait, func() {
+		src.throttleTimer = nil
+		src.throttled = false
+		s.controller.Ready(s, src.fd)
+		err := s.updatePoll(src)
+		if err != nil {
+			s.controller.CloseSession(s, err)
+		}
+	})
+	return s.updatePoll(src)
+}
+
+// throttleDelay Returns the pause of the reads of src until its buckets allow the read of the min window.
+func (s *proxySession) throttleDelay(src *sessionPeer) time.Duration {
+	now := time.Now()
+	wait := minThrottle
+	for _, bucket := range []*tokenBucket{src.bucket, s.identityBucket} {
+		if bucket != nil {
+			if delay := bucket.delay(now, s.buffers.minReadSize); delay > wait {
+				wait = delay
+			}
+		}
+	}
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("[%d] throttle reading for %s", src.fd, wait)
+	}
+	s.stats.ThrottledTime.Add(wait)
+	s.limiter.throttled.Add(wait)
+	return wait
+}
+
+// read Reads the socket into all buffers with readv(2), TLS and unknown connections fill only the first buffer.
+func (p *sessionPeer) read(buffers [][]byte) (int, error) {
+	if p.tls != nil {
+		n, err := p.tls.Read(buffers[0])
+		if errors.Is(err, errWouldBlock) {
+			return 0, nil
+		}
+		return n, err
+	}
+	if !isStream(p.connType) {
+		return p.conn.Read(buffers[0])
+	}
+	if len(buffers) == 1 {
+		return readFd(p.fd, buffers[0])
+	}
+	return readvFd(p.fd, buffers)
+}
+
+func (p *sessionPeer) write(data [][]byte) (int, error) {
+	if p.tls == nil && isStream(p.connType) {
+		if len(data) == 1 {
+			return writeFd(p.fd, data[0])
+		}
+		return writevFd(p.fd, data)
+	}
+	var w io.Writer = p.conn
+	if p.tls != nil {
+		w = p.tls
+	}
+	written := 0
+	for _, buf := range data {
+		n, err := w.Write(buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// streams Returns the directions of the session served by the goroutine engine, the peers are read and written
+// with the blocking I/O of their connections, the splice pipes aren't used.
+func (s *proxySession) streams(controller LoopController) []goStream {
+	s.closePipes()
+	s.start(controller)
+	for _, peer := range []*sessionPeer{s.frontend, s.backend} {
+		// the handshake deadline of TLS connections
+		peer.conn.SetDeadline(time.Time{})
+	}
+	return []goStream{s.stream(s.frontend, s.backend), s.stream(s.backend, s.frontend)}
+}
+
+func (s *proxySession) stream(src, dst *sessionPeer) goStream {
+	return goStream{
+		src: src.conn,
+		dst: &streamWriter{session: s, peer: dst},
+		forward: func(data []byte) ([]byte, time.Duration, error) {
+			return s.forwardStream(src, data)
+		},
+		end: func() error {
+			err := s.shutdownWrite(dst)
+			if err != nil {
+				return err
+			}
+			return s.checkFinished()
+		},
+	}
+}
+
+// forwardStream Passes the bytes read from src through the capture, the filters and the mirror like the loop does,
+// the end of src flushes the filters. The delay pauses the reads of src while its buckets are empty.
+func (s *proxySession) forwardStream(src *sessionPeer, data []byte) ([]byte, time.Duration, error) {
+	s.refreshCapture()
+	if data == nil {
+		src.readDone = true
+		s.startLinger()
+		out, err := s.filtersRest(src)
+		if err == nil && len(out) > 0 && s.mirror != nil && src == s.frontend {
+			s.mirror.write([][]byte{out})
+		}
+		return out, 0, err
+	}
+	s.countRead(src, len(data))
+	out := [][]byte{data}
+	if s.capture != nil {
+		s.captureData(src, out)
+	}
+	var err error
+	if len(s.filters) > 0 {
+		out, err = s.filterData(src, out)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(out) > 0 && s.mirror != nil && src == s.frontend {
+		s.mirror.write(out)
+	}
+	delay := time.Duration(0)
+	if s.allowance(src) == 0 {
+		delay = s.throttleDelay(src)
+	}
+	if len(out) == 0 {
+		return nil, delay, nil
+	}
+	return out[0], delay, nil
+}
+
+// streamWriter writes the stream to the peer, the written bytes are counted by the atomic stats of the session,
+// so it doesn't take the session lock.
+type streamWriter struct {
+	session *proxySession
+	peer    *sessionPeer
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	n, err := w.peer.conn.Write(data)
+	w.session.countWritten(w.peer, n)
+	return n, err
+}
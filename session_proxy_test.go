@@ -0,0 +1,1039 @@
+package dynproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPollers = []string{EpollPoller, IoUringPoller}
+
+// testEngines the event loop with every poller and the goroutine engine
+var testEngines = []string{EpollPoller, IoUringPoller, GoroutineEngine}
+
+func startEchoServer(t testing.TB) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen echo server: %+v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+type testProxyConfig struct {
+	// engine is the goroutine engine or the event loop with the poller of the same name
+	engine  string
+	session ProxySessionConfig
+	buffers SocketBuffers
+	// tls serves the frontend connections over TLS when it's set
+	tls    *tls.Config
+	events chan Event
+	// holder registers the sessions, the new holder is used when it isn't set
+	holder SessionHolder
+	// filters creates the filters of every accepted connection like the frontend does
+	filters FilterChain
+	// connectTimeout of the backend connections, one second when it isn't set
+	connectTimeout time.Duration
+}
+
+// startTestProxy Starts the engine which proxies every accepted connection to the backend address.
+func startTestProxy(t testing.TB, backendAddr string, config testProxyConfig) (string, Engine) {
+	engineName := config.engine
+	tlsConfig := config.tls
+	var engine Engine
+	if engineName == GoroutineEngine {
+		engine = NewGoroutineEngine(EventLoopConfig{Name: "TestEngine"})
+	} else {
+		eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: engineName})
+		if err != nil {
+			t.Fatalf("can't create event loop: %+v", err)
+		}
+		if eventLoop.PollerName() != engineName {
+			eventLoop.Stop()
+			t.Skipf("%s poller isn't available", engineName)
+		}
+		engine = eventLoop
+	}
+	holder := config.holder
+	if holder == nil {
+		holder = NewMapSessionProvider(context.Background())
+	}
+	handler := NewBufferHandler()
+	go engine.Start(handler, holder)
+
+	accepted := make(chan net.Conn, 64)
+	listener, err := engine.Accept("TestFrontend", "tcp", "127.0.0.1:0", func(conn net.Conn) {
+		accepted <- conn
+	})
+	if err != nil {
+		t.Fatalf("can't listen frontend: %+v", err)
+	}
+	go func() {
+		for frontConn := range accepted {
+			if tlsConfig != nil {
+				tlsConn, err := newTlsServerConn(frontConn, tlsConfig)
+				if err != nil {
+					t.Errorf("can't create TLS connection: %+v", err)
+					frontConn.Close()
+					continue
+				}
+				err = tlsConn.Handshake()
+				if err != nil {
+					t.Errorf("TLS handshake failed: %+v", err)
+					frontConn.Close()
+					continue
+				}
+				frontConn = tlsConn
+			}
+			connectTimeout := config.connectTimeout
+			if connectTimeout == 0 {
+				connectTimeout = time.Second
+			}
+			backendConn, err := engine.Dial("tcp", backendAddr, connectTimeout)
+			if err != nil {
+				t.Errorf("can't connect to backend: %+v", err)
+				frontConn.Close()
+				continue
+			}
+			setSocketOptions(frontConn, config.buffers)
+			setSocketOptions(backendConn, config.buffers)
+			sessionConfig := config.session
+			sessionConfig.Filters, err = config.filters.accept(frontConn)
+			if err != nil {
+				frontConn.Close()
+				backendConn.Close()
+				continue
+			}
+			session, err := NewProxySession(frontConn, backendConn, config.events, sessionConfig)
+			if err != nil {
+				t.Errorf("can't create proxy session: %+v", err)
+				continue
+			}
+			engine.Serve(session)
+		}
+	}()
+	return listener.Addr().String(), engine
+}
+
+// forEachProxy Runs the test for every engine with copy and splice data paths.
+func forEachProxy(t *testing.T, test func(t *testing.T, proxyAddr string)) {
+	for _, engine := range testEngines {
+		for _, splice := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/splice=%t", engine, splice), func(t *testing.T) {
+				backend := startEchoServer(t)
+				defer backend.Close()
+				frontendAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+					engine:  engine,
+					session: ProxySessionConfig{SpliceEnabled: splice},
+				})
+				defer proxy.Stop()
+				test(t, frontendAddr)
+			})
+		}
+	}
+}
+
+func roundTrip(conn net.Conn, request, response []byte) error {
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(request, response) {
+		return fmt.Errorf("response %q doesn't match request %q", response, request)
+	}
+	return nil
+}
+
+func TestProxySessionEcho(t *testing.T) {
+	forEachProxy(t, func(t *testing.T, proxyAddr string) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("can't connect to proxy: %+v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		response := make([]byte, 1024)
+		for i := 0; i < 100; i++ {
+			request := bytes.Repeat([]byte{byte(i)}, len(response))
+			err := roundTrip(conn, request, response)
+			if err != nil {
+				t.Fatalf("round trip %d failed: %+v", i, err)
+			}
+		}
+	})
+}
+
+func TestProxySessionHalfClose(t *testing.T) {
+	forEachProxy(t, func(t *testing.T, proxyAddr string) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("can't connect to proxy: %+v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		err = roundTrip(conn, []byte("hello"), make([]byte, 5))
+		if err != nil {
+			t.Fatalf("round trip failed: %+v", err)
+		}
+		err = conn.(*net.TCPConn).CloseWrite()
+		if err != nil {
+			t.Fatalf("can't close write side: %+v", err)
+		}
+		// backend closes the connection after EOF, the proxy has to propagate it back
+		rest, err := io.ReadAll(conn)
+		if err != nil || len(rest) > 0 {
+			t.Fatalf("expected EOF, got %q: %+v", rest, err)
+		}
+	})
+}
+
+// expectTimeout Waits until the proxy closes the connection and reports the timeout event.
+func expectTimeout(t *testing.T, conn net.Conn, events chan Event, reason error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("connection isn't closed by %v: %+v", reason, err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != SessionTimeout || event.Err != reason {
+			t.Fatalf("expected %v timeout event, got: %+v", reason, event)
+		}
+		if event.MetaData["session"] != event.Id || event.MetaData["client"] != conn.LocalAddr().String() {
+			t.Fatalf("event doesn't carry session identity: %+v", event.MetaData)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v timeout event isn't emitted", reason)
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			holder := NewMapSessionProvider(context.Background())
+			frontendAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{Frontend: "TestFrontend", Backend: "TestBackend"},
+				holder:  holder,
+			})
+			defer proxy.Stop()
+
+			var conns []net.Conn
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", frontendAddr)
+				if err != nil {
+					t.Fatalf("can't connect to proxy: %+v", err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				err = roundTrip(conn, []byte("ping"), make([]byte, 4))
+				if err != nil {
+					t.Fatalf("round trip failed: %+v", err)
+				}
+				conns = append(conns, conn)
+			}
+			sessions, err := holder.FindSessions(SessionByClientIp, "127.0.0.1")
+			if err != nil || len(sessions) != 2 {
+				t.Fatalf("expected 2 sessions of the client, got %d: %+v", len(sessions), err)
+			}
+			var id string
+			for _, stats := range holder.ListSessions() {
+				if stats.Identity.ClientAddr == conns[0].LocalAddr().String() {
+					id = stats.Identity.Id
+				}
+				if stats.Identity.Backend != "TestBackend" {
+					t.Fatalf("unexpected identity: %+v", stats.Identity)
+				}
+			}
+
+			killed, err := holder.KillSessions(SessionById, id)
+			if err != nil || killed != 1 {
+				t.Fatalf("expected 1 killed session, got %d: %+v", killed, err)
+			}
+			_, err = io.ReadAll(conns[0])
+			if err != nil {
+				t.Fatalf("killed session isn't closed: %+v", err)
+			}
+			err = roundTrip(conns[1], []byte("pong"), make([]byte, 4))
+			if err != nil {
+				t.Fatalf("round trip of the other session failed: %+v", err)
+			}
+
+			killed, err = holder.KillSessions(SessionByFrontend, "TestFrontend")
+			if err != nil || killed != 1 {
+				t.Fatalf("expected 1 killed session, got %d: %+v", killed, err)
+			}
+			_, err = io.ReadAll(conns[1])
+			if err != nil {
+				t.Fatalf("killed session isn't closed: %+v", err)
+			}
+			// the session is removed from the registry right after its connections are closed
+			for deadline := time.Now().Add(time.Second); len(holder.ListSessions()) > 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("killed sessions are still registered: %+v", holder.ListSessions())
+				}
+			}
+			_, err = holder.KillSessions("unknown", "")
+			if err != unknownSessionKey {
+				t.Fatalf("expected unknown key error, got: %+v", err)
+			}
+			// the reason is kept in the stats of the closed sessions whatever closed them
+			for _, session := range sessions {
+				if reason := session.GetStats().CloseReason; reason != killedSession {
+					t.Fatalf("unexpected close reason of killed session: %+v", reason)
+				}
+			}
+			conn, err := net.Dial("tcp", frontendAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = roundTrip(conn, []byte("ping"), make([]byte, 4))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+			finished, err := holder.FindSessions(SessionByClientIp, "127.0.0.1")
+			if err != nil || len(finished) != 1 {
+				t.Fatalf("expected 1 session of the client, got %d: %+v", len(finished), err)
+			}
+			if reason := finished[0].GetStats().CloseReason; reason != nil {
+				t.Fatalf("open session has close reason: %+v", reason)
+			}
+			conn.Close()
+			for deadline := time.Now().Add(5 * time.Second); len(holder.ListSessions()) > 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if reason := finished[0].GetStats().CloseReason; reason != finishedSession {
+				t.Fatalf("unexpected close reason of finished session: %+v", reason)
+			}
+		})
+	}
+}
+
+func TestDrainSessions(t *testing.T) {
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			holder := NewMapSessionProvider(context.Background())
+			proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{engine: engine, holder: holder})
+			defer proxy.Stop()
+			var conns []net.Conn
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", proxyAddr)
+				if err != nil {
+					t.Fatalf("can't connect to proxy: %+v", err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				err = roundTrip(conn, []byte("ping"), make([]byte, 4))
+				if err != nil {
+					t.Fatalf("round trip failed: %+v", err)
+				}
+				conns = append(conns, conn)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			drained := make(chan error, 1)
+			go func() {
+				drained <- drainSessions(ctx, holder)
+			}()
+			// the finished session leaves the drain, the active one is killed by the deadline
+			conns[0].Close()
+			err := roundTrip(conns[1], []byte("pong"), make([]byte, 4))
+			if err != nil {
+				t.Fatalf("session is cut while draining: %+v", err)
+			}
+			err = <-drained
+			if err != context.DeadlineExceeded {
+				t.Fatalf("expected drain deadline, got: %+v", err)
+			}
+			_, err = io.ReadAll(conns[1])
+			if err != nil {
+				t.Fatalf("remaining session isn't killed: %+v", err)
+			}
+			err = drainSessions(context.Background(), holder)
+			if err != nil {
+				t.Fatalf("drain without sessions failed: %+v", err)
+			}
+		})
+	}
+}
+
+func TestProxySessionTimeouts(t *testing.T) {
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			events := make(chan Event, 16)
+			frontendAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{IdleTimeout: 200 * time.Millisecond, MaxLifetime: time.Second},
+				events:  events,
+			})
+			defer proxy.Stop()
+
+			idle, err := net.Dial("tcp", frontendAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer idle.Close()
+			err = roundTrip(idle, []byte("ping"), make([]byte, 4))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+			expectTimeout(t, idle, events, idleTimeout)
+
+			// the activity postpones the idle timeout, but not the max lifetime
+			active, err := net.Dial("tcp", frontendAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer active.Close()
+			started := time.Now()
+			for time.Since(started) < 900*time.Millisecond {
+				err = roundTrip(active, []byte("ping"), make([]byte, 4))
+				if err != nil {
+					t.Fatalf("active session is closed after %s: %+v", time.Since(started), err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			expectTimeout(t, active, events, lifetimeExpired)
+		})
+	}
+}
+
+// startSilentBackend Returns the address of the listener which doesn't answer the new connections, its accept
+// queue is filled, so the kernel drops the SYNs of the next connections.
+func startSilentBackend(t *testing.T) string {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("can't open socket: %+v", err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err == nil {
+		err = unix.Listen(fd, 0)
+	}
+	if err != nil {
+		t.Fatalf("can't listen socket: %+v", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("can't get socket address: %+v", err)
+	}
+	addr := sockaddrToTcpAddr(sa).String()
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 16 {
+			t.Skipf("accept queue of the silent backend isn't limited")
+		}
+	}
+}
+
+func TestProxySessionConnectTimeout(t *testing.T) {
+	for _, poller := range testPollers {
+		t.Run(poller, func(t *testing.T) {
+			backendAddr := startSilentBackend(t)
+			events := make(chan Event, 16)
+			frontendAddr, proxy := startTestProxy(t, backendAddr, testProxyConfig{
+				engine:         poller,
+				events:         events,
+				connectTimeout: 300 * time.Millisecond,
+			})
+			defer proxy.Stop()
+
+			// the loop doesn't wait for the backend
+			started := time.Now()
+			conn, err := proxy.Dial("tcp", backendAddr, 300*time.Millisecond)
+			if err != nil {
+				t.Fatalf("can't start connecting backend: %+v", err)
+			}
+			conn.Close()
+			if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+				t.Fatalf("dial waits for the backend %s", elapsed)
+			}
+
+			client, err := net.Dial("tcp", frontendAddr)
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer client.Close()
+			expectTimeout(t, client, events, connectTimeout)
+		})
+	}
+}
+
+// countOpenFds Counts the open fds except pipes, the echo server copies with splice(2) and the runtime pools its pipes.
+func countOpenFds(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("can't read open fds: %+v", err)
+	}
+	count := 0
+	for _, fd := range fds {
+		link, err := os.Readlink("/proc/self/fd/" + fd.Name())
+		if err == nil && !strings.HasPrefix(link, "pipe:") {
+			count++
+		}
+	}
+	return count
+}
+
+// echoThrough Sends the payload through the proxy and reads it back, returns the time it took.
+func echoThrough(t *testing.T, proxyAddr string, size int) time.Duration {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Errorf("can't connect to proxy: %+v", err)
+		return 0
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	started := time.Now()
+	go conn.Write(make([]byte, size))
+	_, err = io.ReadFull(conn, make([]byte, size))
+	if err != nil {
+		t.Errorf("can't read echo: %+v", err)
+	}
+	return time.Since(started)
+}
+
+func TestProxySessionRateLimit(t *testing.T) {
+	const rate = 64 * 1024
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			// the bucket starts with one second of the rate, so 2x rate takes a second
+			limiter := NewRateLimiter(RateLimitConfig{UpstreamBytesPerSec: rate})
+			proxyAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{RateLimiter: limiter},
+				// the small socket buffers are slower than the limit
+				buffers: SocketBuffers{RcvBuf: -1, SndBuf: -1},
+			})
+			defer proxy.Stop()
+			if elapsed := echoThrough(t, proxyAddr, 2*rate); elapsed < 900*time.Millisecond {
+				t.Fatalf("session isn't throttled: %s", elapsed)
+			}
+			if limiter.ThrottledTime() == 0 {
+				t.Fatalf("throttled time isn't reported")
+			}
+
+			// two sessions of the same client share the identity limit
+			limiter = NewRateLimiter(RateLimitConfig{IdentityBytesPerSec: rate, IdentityKey: SessionByClientIp})
+			proxyAddr, proxy = startTestProxy(t, backend.Addr().String(), testProxyConfig{
+				engine:  engine,
+				session: ProxySessionConfig{RateLimiter: limiter, SpliceEnabled: true},
+				buffers: SocketBuffers{RcvBuf: -1, SndBuf: -1},
+			})
+			defer proxy.Stop()
+			started := time.Now()
+			done := make(chan struct{})
+			for i := 0; i < 2; i++ {
+				go func() {
+					echoThrough(t, proxyAddr, rate/2)
+					done <- struct{}{}
+				}()
+			}
+			<-done
+			<-done
+			if elapsed := time.Since(started); elapsed < 900*time.Millisecond {
+				t.Fatalf("sessions aren't throttled by identity: %s", elapsed)
+			}
+			// the sessions release the bucket when they're closed after the clients
+			for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+				limiter.lock.Lock()
+				buckets := len(limiter.buckets)
+				limiter.lock.Unlock()
+				if buckets == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("identity buckets aren't released: %d", buckets)
+				}
+			}
+		})
+	}
+}
+
+func TestProxySessionFdLeak(t *testing.T) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+	forEachProxy(t, func(t *testing.T, frontendAddr string) {
+		// the first session warms up the proxy, e.g. the accept reserve fd is opened
+		conn, err := net.Dial("tcp", frontendAddr)
+		if err != nil {
+			t.Fatalf("can't connect to proxy: %+v", err)
+		}
+		err = roundTrip(conn, []byte("ping"), make([]byte, 4))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("round trip failed: %+v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		baseline := countOpenFds(t)
+
+		const sessions, workers = 2000, 8
+		errs := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				for i := 0; i < sessions/workers; i++ {
+					conn, err := net.Dial("tcp", frontendAddr)
+					if err != nil {
+						errs <- err
+						return
+					}
+					conn.SetDeadline(time.Now().Add(5 * time.Second))
+					err = roundTrip(conn, []byte("ping"), make([]byte, 4))
+					conn.Close()
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}()
+		}
+		for w := 0; w < workers; w++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("session failed: %+v", err)
+			}
+		}
+		// the sessions are closed asynchronously after the clients are gone
+		open := countOpenFds(t)
+		for deadline := time.Now().Add(10 * time.Second); open > baseline && time.Now().Before(deadline); open = countOpenFds(t) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if open > baseline {
+			t.Fatalf("%d fds are leaked after %d sessions", open-baseline, sessions)
+		}
+	})
+}
+
+func TestProxySessionSlowConsumer(t *testing.T) {
+	forEachProxy(t, func(t *testing.T, proxyAddr string) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("can't connect to proxy: %+v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		// 8K socket buffers of the proxy keep the transfer slow, so the payload is kept small
+		request := make([]byte, 256*1024)
+		for i := range request {
+			request[i] = byte(i % 251)
+		}
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(request)
+			writeErr <- err
+		}()
+		// the client reads slower than it writes, so the proxy has to pause reading instead of buffering everything
+		response := make([]byte, len(request))
+		for read := 0; read < len(response); {
+			end := read + 16*1024
+			if end > len(response) {
+				end = len(response)
+			}
+			n, err := io.ReadFull(conn, response[read:end])
+			if err != nil {
+				t.Fatalf("read failed after %d bytes: %+v", read+n, err)
+			}
+			read += n
+			if read < len(response)/4 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if err := <-writeErr; err != nil {
+			t.Fatalf("write failed: %+v", err)
+		}
+		if !bytes.Equal(request, response) {
+			t.Fatalf("response doesn't match request")
+		}
+	})
+}
+
+// testTlsConfig Returns the server config with the self-signed certificate.
+func testTlsConfig(t testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dynproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("can't create certificate: %+v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestProxySessionTls(t *testing.T) {
+	tlsConfig := testTlsConfig(t)
+	for _, engine := range testEngines {
+		t.Run(engine, func(t *testing.T) {
+			backend := startEchoServer(t)
+			defer backend.Close()
+			frontendAddr, proxy := startTestProxy(t, backend.Addr().String(), testProxyConfig{engine: engine, tls: tlsConfig})
+			defer proxy.Stop()
+			conn, err := tls.Dial("tcp", frontendAddr, &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("can't connect to proxy: %+v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			response := make([]byte, 1024)
+			for i := 0; i < 100; i++ {
+				request := bytes.Repeat([]byte{byte(i)}, len(response))
+				err := roundTrip(conn, request, response)
+				if err != nil {
+					t.Fatalf("round trip %d failed: %+v", i, err)
+				}
+			}
+			// records bigger than the read buffer are left partially decrypted in the TLS layer
+			request := make([]byte, 64*1024)
+			for i := range request {
+				request[i] = byte(i % 251)
+			}
+			go conn.Write(request)
+			response = make([]byte, len(request))
+			_, err = io.ReadFull(conn, response)
+			if err != nil || !bytes.Equal(request, response) {
+				t.Fatalf("bulk round trip failed: %+v", err)
+			}
+			err = conn.CloseWrite()
+			if err != nil {
+				t.Fatalf("can't close write side: %+v", err)
+			}
+			rest, err := io.ReadAll(conn)
+			if err != nil || len(rest) > 0 {
+				t.Fatalf("expected EOF, got %q: %+v", rest, err)
+			}
+		})
+	}
+}
+
+func benchmarkProxySession(b *testing.B, engine string, size int, buffers SocketBuffers) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+	backend := startEchoServer(b)
+	defer backend.Close()
+	frontendAddr, proxy := startTestProxy(b, backend.Addr().String(), testProxyConfig{engine: engine, buffers: buffers})
+	defer proxy.Stop()
+	conn, err := net.Dial("tcp", frontendAddr)
+	if err != nil {
+		b.Fatalf("can't connect to proxy: %+v", err)
+	}
+	defer conn.Close()
+	request := bytes.Repeat([]byte{1}, size)
+	response := make([]byte, len(request))
+	b.SetBytes(int64(len(request)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := roundTrip(conn, request, response)
+		if err != nil {
+			b.Fatalf("round trip failed: %+v", err)
+		}
+	}
+}
+
+func BenchmarkProxySessionEpoll(b *testing.B) {
+	benchmarkProxySession(b, EpollPoller, 1024, SocketBuffers{})
+}
+
+func BenchmarkProxySessionIoUring(b *testing.B) {
+	benchmarkProxySession(b, IoUringPoller, 1024, SocketBuffers{})
+}
+
+func BenchmarkProxySessionGoroutine(b *testing.B) {
+	benchmarkProxySession(b, GoroutineEngine, 1024, SocketBuffers{})
+}
+
+// BenchmarkProxySessionBulk the socket buffers are tuned by the kernel and the read window grows,
+// so the request is moved by a few vectored reads and writes.
+func BenchmarkProxySessionBulk(b *testing.B) {
+	benchmarkProxySession(b, EpollPoller, 256*1024, SocketBuffers{RcvBuf: -1, SndBuf: -1})
+}
+
+// pollController records the polled events, the timers and the close of the session driven by the test instead of the loop.
+type pollController struct {
+	buffers *BufferPool
+	read    map[int]bool
+	timers  []*Timer
+	closed  error
+}
+
+func (c *pollController) ModifyPoll(fd int, read, write bool) error {
+	c.read[fd] = read
+	return nil
+}
+
+func (c *pollController) Schedule(delay time.Duration, callback func()) *Timer {
+	timer := &Timer{callback: callback}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (c *pollController) CancelTimer(timer *Timer) {
+}
+
+func (c *pollController) CloseSession(session Session, reason error) {
+	c.closed = reason
+}
+
+func (c *pollController) Ready(session Session, fd int) {
+}
+
+func (c *pollController) Execute(task func()) {
+	task()
+}
+
+func (c *pollController) Buffers() *BufferPool {
+	return c.buffers
+}
+
+// tcpPair Returns the connected client and server ends.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %+v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("can't connect: %+v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("can't accept: %+v", err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestProxySessionBackpressure(t *testing.T) {
+	client, frontConn := tcpPair(t)
+	defer client.Close()
+	backendConn, server := tcpPair(t)
+	defer server.Close()
+	// the small kernel buffers keep the backlog of the slow backend in the write buffer of the session
+	backendConn.SetWriteBuffer(4096)
+	server.SetReadBuffer(4096)
+	created, err := NewProxySession(frontConn, backendConn, nil, ProxySessionConfig{})
+	if err != nil {
+		t.Fatalf("can't create session: %+v", err)
+	}
+	session := created.(*proxySession)
+	defer session.Close()
+	maxReadSize := 16 * 1024
+	controller := &pollController{buffers: NewBufferPool(BufferConfig{MaxReadSize: maxReadSize}), read: make(map[int]bool)}
+	frontFd, backendFd := session.frontend.fd, session.backend.fd
+	paused := func() bool {
+		read, ok := controller.read[frontFd]
+		return ok && !read
+	}
+
+	request := make([]byte, 4*1024*1024)
+	go client.Write(request)
+	err = session.Init(controller)
+	if err != nil {
+		t.Fatalf("can't init session: %+v", err)
+	}
+	out := session.backend.out
+	for deadline := time.Now().Add(5 * time.Second); !paused() && time.Now().Before(deadline); {
+		err = session.ProcessRead(frontFd)
+		if err != nil {
+			t.Fatalf("can't read frontend: %+v", err)
+		}
+	}
+	// the reading is paused right after the buffer crossed the high water mark
+	if !paused() || out.Len() < defWriteHighWaterMark || out.Len() >= defWriteHighWaterMark+maxReadSize {
+		t.Fatalf("reading isn't paused at the high water mark: paused=%t pending=%d", paused(), out.Len())
+	}
+	if cap(out.buf) > 2*(defWriteHighWaterMark+maxReadSize) {
+		t.Fatalf("write buffer grows beyond the limit: %d", cap(out.buf))
+	}
+
+	// the slow reader drains the backlog, the reading stays paused until the low water mark
+	chunk := make([]byte, 2048)
+	received := 0
+	sawHysteresis := false
+	for deadline := time.Now().Add(5 * time.Second); paused() && time.Now().Before(deadline); {
+		// the write readiness isn't polled, so the session is flushed whether the reader got anything or not
+		server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, err := server.Read(chunk)
+		if err != nil && !os.IsTimeout(err) {
+			t.Fatalf("backend read failed: %+v", err)
+		}
+		received += n
+		err = session.ProcessWrite(backendFd)
+		if err != nil {
+			t.Fatalf("can't flush backend: %+v", err)
+		}
+		if paused() && out.Len() < defWriteHighWaterMark && out.Len() > defWriteLowWaterMark {
+			sawHysteresis = true
+		}
+	}
+	if paused() || !sawHysteresis {
+		t.Fatalf("reading isn't resumed at the low water mark: paused=%t pending=%d", paused(), out.Len())
+	}
+	if out.Len() > defWriteLowWaterMark {
+		t.Fatalf("reading is resumed above the low water mark: %d", out.Len())
+	}
+	if received == 0 || received > len(request) {
+		t.Fatalf("unexpected received bytes: %d", received)
+	}
+}
+
+func TestProxySessionLinger(t *testing.T) {
+	client, frontConn := tcpPair(t)
+	defer client.Close()
+	backendConn, server := tcpPair(t)
+	defer server.Close()
+	created, err := NewProxySession(frontConn, backendConn, nil, ProxySessionConfig{})
+	if err != nil {
+		t.Fatalf("can't create session: %+v", err)
+	}
+	session := created.(*proxySession)
+	defer session.Close()
+	controller := &pollController{buffers: NewBufferPool(BufferConfig{}), read: make(map[int]bool)}
+	err = session.Init(controller)
+	if err != nil {
+		t.Fatalf("can't init session: %+v", err)
+	}
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	for deadline := time.Now().Add(5 * time.Second); !session.frontend.readDone && time.Now().Before(deadline); {
+		err = session.ProcessRead(session.frontend.fd)
+		if err != nil {
+			t.Fatalf("can't read frontend: %+v", err)
+		}
+	}
+	if !session.frontend.readDone || controller.read[session.frontend.fd] {
+		t.Fatalf("EOF of client isn't handled")
+	}
+	// the half-close reaches the backend after the data
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(server)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected data before EOF %q: %+v", data, err)
+	}
+	if err = session.checkFinished(); err != nil {
+		t.Fatalf("half-closed session is finished: %+v", err)
+	}
+
+	// the backend never finishes, the session is closed by the linger timer of the loop
+	if len(controller.timers) != 1 || controller.timers[0] != session.lingerTimer {
+		t.Fatalf("linger isn't scheduled on the loop: %d timers", len(controller.timers))
+	}
+	controller.timers[0].callback()
+	if controller.closed != lingerTimeout {
+		t.Fatalf("session isn't closed by the linger timeout: %+v", controller.closed)
+	}
+}
+
+func TestProxySessionSpliceStats(t *testing.T) {
+	request := make([]byte, 128*1024)
+	rand.Read(request)
+	var counted []SessionStats
+	for _, splice := range []bool{false, true} {
+		client, frontConn := tcpPair(t)
+		defer client.Close()
+		backendConn, server := tcpPair(t)
+		defer server.Close()
+		go io.Copy(server, server)
+		created, err := NewProxySession(frontConn, backendConn, nil, ProxySessionConfig{SpliceEnabled: splice})
+		if err != nil {
+			t.Fatalf("can't create session: %+v", err)
+		}
+		session := created.(*proxySession)
+		defer session.Close()
+		if splice && session.frontend.pipe == nil {
+			t.Skipf("splice pipes aren't available")
+		}
+		err = session.Init(&pollController{buffers: NewBufferPool(BufferConfig{}), read: make(map[int]bool)})
+		if err != nil {
+			t.Fatalf("can't init session: %+v", err)
+		}
+		client.SetDeadline(time.Now().Add(30 * time.Second))
+		go client.Write(request)
+		response := make([]byte, len(request))
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(client, response)
+			done <- err
+		}()
+		// the test drives the session instead of the loop, every fd is processed on every iteration
+		for received := false; !received; {
+			select {
+			case err = <-done:
+				received = true
+				if err != nil || !bytes.Equal(request, response) {
+					t.Fatalf("response doesn't match request with splice=%t: %+v", splice, err)
+				}
+			default:
+				for _, fd := range session.GetFds() {
+					if err = session.ProcessRead(fd); err != nil {
+						t.Fatalf("can't read with splice=%t: %+v", splice, err)
+					}
+					if err = session.ProcessWrite(fd); err != nil {
+						t.Fatalf("can't write with splice=%t: %+v", splice, err)
+					}
+				}
+			}
+		}
+		stats := session.GetStats()
+		if stats.TotalReceivedBytes != uint64(len(request)) || stats.TotalSentBytes != uint64(len(request)) {
+			t.Fatalf("unexpected counters with splice=%t: received %d sent %d", splice, stats.TotalReceivedBytes, stats.TotalSentBytes)
+		}
+		counted = append(counted, stats)
+	}
+	if counted[0].TotalReceivedBytes != counted[1].TotalReceivedBytes || counted[0].TotalSentBytes != counted[1].TotalSentBytes {
+		t.Fatalf("splice and copy count different bytes: %+v %+v", counted[0], counted[1])
+	}
+}
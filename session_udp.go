@@ -0,0 +1,387 @@
+package dynproxy
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defUdpIdleTimeout = 60 * time.Second
+	// maxPendingUdpSessions bounds the sessions which are connecting to the backends at once
+	maxPendingUdpSessions = 256
+	// maxPendingDatagrams the datagrams of the client received while its session is created
+	maxPendingDatagrams = 16
+)
+
+// datagramBuffers the replies are read into the buffers of the largest datagram size, the loop pool classes can be smaller
+var datagramBuffers = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, maxDatagramSize)
+	},
+}
+
+// udpSession is the virtual session of one client address of the UDP frontend. The frontend reads the datagrams
+// of the client from the listening socket and sends them to the connected socket of the backend, the session reads
+// the replies and sends them back from the listening socket. The session is closed on the idle timeout.
+type udpSession struct {
+	id          string
+	identity    SessionIdentity
+	logger      zerolog.Logger
+	listener    PacketListener
+	clientAddr  *net.UDPAddr
+	backendFd   int
+	backendConn net.Conn
+	eventChan   chan Event
+	stats       *proxySessionStats
+	controller  LoopController
+	idleTimeout time.Duration
+	idleTimer   *Timer
+	// lock guards closed against the sends of the frontend which aren't run on the loop of the session
+	lock    sync.RWMutex
+	closed  bool
+	onClose func()
+}
+
+func newUdpSession(listener PacketListener, clientAddr *net.UDPAddr, backendConn net.Conn, eventChan chan Event, config ProxySessionConfig) (*udpSession, error) {
+	backendFd, _, err := ConnToFileDesc(backendConn)
+	if err != nil {
+		return nil, err
+	}
+	id := newSessionId()
+	identity := SessionIdentity{
+		Id:         id,
+		Frontend:   config.Frontend,
+		Backend:    config.Backend,
+		ClientAddr: clientAddr.String(),
+		ClientIp:   clientAddr.IP.String(),
+	}
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defUdpIdleTimeout
+	}
+	return &udpSession{
+		id:          id,
+		identity:    identity,
+		logger:      identity.logger(),
+		listener:    listener,
+		clientAddr:  clientAddr,
+		backendFd:   backendFd,
+		backendConn: backendConn,
+		eventChan:   eventChan,
+		stats:       &proxySessionStats{},
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+func (s *udpSession) Init(controller LoopController) error {
+	s.controller = controller
+	s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+	s.idleTimer = controller.Schedule(s.idleTimeout, s.checkIdle)
+	return s.ProcessRead(s.backendFd)
+}
+
+// forward Sends the datagram of the client to the backend, it's called by the frontend from any goroutine.
+// The datagram is dropped when the socket buffer of the backend is full.
+func (s *udpSession) forward(data []byte) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return closedSession
+	}
+	for {
+		_, err := unix.Write(s.backendFd, data)
+		switch err {
+		case nil:
+			s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+			s.stats.TotalReceivedBytes.Add(uint64(len(data)))
+			return nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN, unix.ECONNREFUSED:
+			// the backend port was unreachable for the previous datagram, the next ones can be received
+			s.stats.DroppedDatagrams.Inc()
+			return nil
+		default:
+			return os.NewSyscallError("write", err)
+		}
+	}
+}
+
+// ProcessRead Sends the replies of the backend to the client until the socket is drained or the batch is read.
+func (s *udpSession) ProcessRead(fd int) error {
+	buf := datagramBuffers.Get().([]byte)
+	defer datagramBuffers.Put(buf)
+	for i := 0; i < packetReadBatch; i++ {
+		n, err := unix.Read(s.backendFd, buf)
+		switch err {
+		case nil:
+		case unix.EINTR, unix.ECONNREFUSED:
+			continue
+		case unix.EAGAIN:
+			return nil
+		default:
+			return os.NewSyscallError("read", err)
+		}
+		sent, err := s.listener.WriteTo(buf[:n], s.clientAddr)
+		if errors.Is(err, net.ErrClosed) {
+			// the frontend is closed, the replies can't be sent anymore
+			return finishedSession
+		}
+		if err != nil {
+			return err
+		}
+		if sent == 0 && n > 0 {
+			s.stats.DroppedDatagrams.Inc()
+			continue
+		}
+		s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+		s.stats.TotalSentBytes.Add(uint64(sent))
+	}
+	s.controller.Ready(s, s.backendFd)
+	return nil
+}
+
+// streams Returns the replies of the backend as the only direction of the session served by the goroutine engine,
+// the datagrams of the client are still sent by the frontend.
+func (s *udpSession) streams(controller LoopController) []goStream {
+	s.controller = controller
+	s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+	s.idleTimer = controller.Schedule(s.idleTimeout, s.checkIdle)
+	return []goStream{{
+		src: &udpReplyReader{conn: s.backendConn},
+		dst: &udpReplyWriter{session: s},
+		forward: func(data []byte) ([]byte, time.Duration, error) {
+			return data, 0, nil
+		},
+		end: func() error {
+			return finishedSession
+		},
+		bufferSize: maxDatagramSize,
+	}}
+}
+
+// udpReplyReader reads the replies of the backend, the errors of the datagrams which were sent to the unreachable
+// port don't stop the reads.
+type udpReplyReader struct {
+	conn net.Conn
+}
+
+func (r *udpReplyReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := r.conn.Read(buf)
+		if !errors.Is(err, unix.ECONNREFUSED) {
+			return n, err
+		}
+	}
+}
+
+// udpReplyWriter sends every reply as the datagram to the client, the datagram which doesn't fit the socket buffer
+// of the listener is dropped.
+type udpReplyWriter struct {
+	session *udpSession
+}
+
+func (w *udpReplyWriter) Write(data []byte) (int, error) {
+	s := w.session
+	sent, err := s.listener.WriteTo(data, s.clientAddr)
+	if errors.Is(err, net.ErrClosed) {
+		// the frontend is closed, the replies can't be sent anymore
+		return 0, finishedSession
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sent == 0 {
+		s.stats.DroppedDatagrams.Inc()
+		return len(data), nil
+	}
+	s.stats.LastActivityTime.Store(time.Now().UnixMilli())
+	s.stats.TotalSentBytes.Add(uint64(sent))
+	return sent, nil
+}
+
+func (s *udpSession) ProcessWrite(fd int) error {
+	return nil
+}
+
+func (s *udpSession) GetConnByFd(fd int) net.Conn {
+	return s.backendConn
+}
+
+func (s *udpSession) GetFds() []int {
+	return []int{s.backendFd}
+}
+
+func (s *udpSession) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	if s.idleTimer != nil {
+		s.controller.CancelTimer(s.idleTimer)
+	}
+	if s.onClose != nil {
+		s.onClose()
+	}
+	return s.backendConn.Close()
+}
+
+func (s *udpSession) GetId() string {
+	return s.id
+}
+
+func (s *udpSession) GetStats() SessionStats {
+	return SessionStats{
+		LastActivityTime:   s.stats.LastActivityTime.Load(),
+		TotalSentBytes:     s.stats.TotalSentBytes.Load(),
+		TotalReceivedBytes: s.stats.TotalReceivedBytes.Load(),
+		DroppedDatagrams:   s.stats.DroppedDatagrams.Load(),
+		CloseReason:        s.stats.CloseReason.Load(),
+		Identity:           s.identity,
+	}
+}
+
+func (s *udpSession) recordCloseReason(reason error) {
+	s.stats.recordCloseReason(reason)
+}
+
+func (s *udpSession) GetIdentity() SessionIdentity {
+	return s.identity
+}
+
+func (s *udpSession) Logger() *zerolog.Logger {
+	return &s.logger
+}
+
+// checkIdle Closes the session which didn't move any datagrams for the idle timeout.
+func (s *udpSession) checkIdle() {
+	idle := time.Since(time.UnixMilli(s.stats.LastActivityTime.Load()))
+	if idle < s.idleTimeout {
+		s.idleTimer = s.controller.Schedule(s.idleTimeout-idle, s.checkIdle)
+		return
+	}
+	s.idleTimer = nil
+	if s.logger.Debug().Enabled() {
+		s.logger.Debug().Msgf("%v", idleTimeout)
+	}
+	if s.eventChan != nil {
+		select {
+		case s.eventChan <- genSessionTimeoutEvent(s.identity, idleTimeout):
+		default:
+			s.logger.Warn().Msgf("event channel is full, drop timeout event of session")
+		}
+	}
+	s.controller.CloseSession(s, idleTimeout)
+}
+
+// udpRelay maps the client addresses of the UDP frontend to their sessions, a new session is created
+// for the first datagram of the client with the backend selected by the balancer. The backend is dialed
+// in its own goroutine, so the name resolution doesn't block the reading thread.
+type udpRelay struct {
+	frontend *Frontend
+	lock     sync.Mutex
+	// listener is set once the engine opened the socket, the datagrams received before are dropped
+	listener PacketListener
+	sessions map[string]*udpSession
+	// pending keeps the datagrams of the clients whose sessions are created
+	pending map[string][][]byte
+}
+
+func newUdpRelay(frontend *Frontend) *udpRelay {
+	return &udpRelay{
+		frontend: frontend,
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string][][]byte),
+	}
+}
+
+func (r *udpRelay) setListener(listener PacketListener) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.listener = listener
+}
+
+// handlePacket Forwards the datagram of the client to its session, it's called by the engine for every datagram.
+// The datagrams of the new client are queued until its session is created.
+func (r *udpRelay) handlePacket(data []byte, addr *net.UDPAddr) {
+	key := addr.String()
+	r.lock.Lock()
+	session, ok := r.sessions[key]
+	if ok {
+		r.lock.Unlock()
+		r.forward(session, data)
+		return
+	}
+	defer r.lock.Unlock()
+	queue, ok := r.pending[key]
+	switch {
+	case ok && len(queue) < maxPendingDatagrams:
+		r.pending[key] = append(queue, append([]byte(nil), data...))
+	case ok:
+		if log.Debug().Enabled() {
+			log.Debug().Msgf("[%s] session of %s isn't created yet, drop datagram", r.frontend.Name, addr)
+		}
+	case r.listener == nil:
+	case len(r.pending) >= maxPendingUdpSessions:
+		log.Warn().Msgf("[%s] too many sessions are created, drop datagram from: %s", r.frontend.Name, addr)
+	default:
+		r.pending[key] = [][]byte{append([]byte(nil), data...)}
+		go r.newSession(key, addr, r.listener)
+	}
+}
+
+func (r *udpRelay) forward(session *udpSession, data []byte) {
+	err := session.forward(data)
+	if err != nil && err != closedSession {
+		session.logger.Warn().Msgf("got error while sending datagram to backend: %+v", err)
+	}
+}
+
+// newSession Connects the session of the client to the backend and sends the queued datagrams through it.
+func (r *udpRelay) newSession(key string, addr *net.UDPAddr, listener PacketListener) {
+	f := r.frontend
+	session, err := r.connect(key, addr, listener)
+	r.lock.Lock()
+	queue := r.pending[key]
+	delete(r.pending, key)
+	if err != nil {
+		r.lock.Unlock()
+		log.Warn().Msgf("[%s] can't create session of %s: %+v", f.Name, addr, err)
+		return
+	}
+	r.sessions[key] = session
+	// the queued datagrams are sent before the ones which find the session in the map
+	for _, data := range queue {
+		r.forward(session, data)
+	}
+	r.lock.Unlock()
+	f.engine.Serve(session)
+}
+
+func (r *udpRelay) connect(key string, addr *net.UDPAddr, listener PacketListener) (*udpSession, error) {
+	f := r.frontend
+	backend, backendConn, err := getConnByBalancerName(f.defaultBalancer, f.engine.Dial)
+	if err != nil {
+		return nil, err
+	}
+	sessionConfig := f.SessionConfig
+	sessionConfig.Backend = backend.Name
+	session, err := newUdpSession(listener, addr, backendConn, f.events, sessionConfig)
+	if err != nil {
+		backendConn.Close()
+		return nil, err
+	}
+	session.onClose = func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.sessions[key] == session {
+			delete(r.sessions, key)
+		}
+	}
+	return session, nil
+}
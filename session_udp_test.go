@@ -0,0 +1,129 @@
+package dynproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUdpEchoServer Returns the socket which sends every datagram back to the sender.
+func startUdpEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("can't listen UDP echo server: %+v", err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUdpFrontend(t *testing.T) {
+	backend := startUdpEchoServer(t)
+	defer backend.Close()
+	balancers = map[string]*Balancer{
+		"udp": {Name: "udp", Backends: []*Backend{{Name: "udp-echo", Net: "udp", Address: backend.LocalAddr().String(), Status: enabled}}},
+	}
+	defer func() {
+		balancers = nil
+	}()
+
+	for _, engineName := range testEngines {
+		t.Run(engineName, func(t *testing.T) {
+			var engine Engine
+			if engineName == GoroutineEngine {
+				engine = NewGoroutineEngine(EventLoopConfig{Name: "TestEngine"})
+			} else {
+				eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: engineName})
+				if err != nil {
+					t.Fatalf("can't create event loop: %+v", err)
+				}
+				if eventLoop.PollerName() != engineName {
+					eventLoop.Stop()
+					t.Skipf("%s poller isn't available", engineName)
+				}
+				engine = eventLoop
+			}
+			holder := NewMapSessionProvider(context.Background())
+			go engine.Start(NewBufferHandler(), holder)
+			defer engine.Stop()
+			events := make(chan Event, 4)
+			frontend := &Frontend{
+				Name:            "TestFrontend",
+				Net:             "udp",
+				Address:         "127.0.0.1:0",
+				defaultBalancer: "udp",
+				events:          events,
+				engine:          engine,
+				SessionConfig:   ProxySessionConfig{Frontend: "TestFrontend", IdleTimeout: 300 * time.Millisecond},
+			}
+			err := frontend.Listen()
+			if err != nil {
+				t.Fatalf("can't listen frontend: %+v", err)
+			}
+			defer frontend.Close()
+
+			// every client address gets its own session
+			for _, request := range []string{"hello", "world!"} {
+				conn, err := net.Dial("udp", frontend.Addr().String())
+				if err != nil {
+					t.Fatalf("can't connect to frontend: %+v", err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				// the datagrams sent while the session is created are queued
+				for i := 0; i < 2; i++ {
+					_, err = conn.Write([]byte(request))
+					if err != nil {
+						t.Fatalf("can't send datagram: %+v", err)
+					}
+				}
+				for i := 0; i < 2; i++ {
+					reply := make([]byte, maxDatagramSize)
+					n, err := conn.Read(reply)
+					if err != nil || string(reply[:n]) != request {
+						t.Fatalf("unexpected reply %q: %+v", reply[:n], err)
+					}
+				}
+			}
+			sessions := holder.ListSessions()
+			if len(sessions) != 2 {
+				t.Fatalf("expected 2 sessions, got: %d", len(sessions))
+			}
+			for _, stats := range sessions {
+				if stats.Identity.Backend != "udp-echo" || stats.TotalReceivedBytes != stats.TotalSentBytes || stats.TotalSentBytes == 0 || stats.DroppedDatagrams > 0 {
+					t.Fatalf("unexpected session stats: %+v", stats)
+				}
+			}
+
+			// the sessions expire on the idle timeout
+			for i := 0; i < 2; i++ {
+				select {
+				case event := <-events:
+					if event.Type != SessionTimeout {
+						t.Fatalf("unexpected event: %+v", event)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("session isn't expired")
+				}
+			}
+			for deadline := time.Now().Add(5 * time.Second); len(holder.ListSessions()) > 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			frontend.relay.lock.Lock()
+			left := len(frontend.relay.sessions)
+			frontend.relay.lock.Unlock()
+			if left > 0 || len(holder.ListSessions()) > 0 {
+				t.Fatalf("expired sessions aren't removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package dynproxy
+
+import (
+	"bytes"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	defSniffTimeout = 3 * time.Second
+	defMaxSniffs    = 256
+	// defSniffPeekSize is enough for the built-in protocols, the longer user patterns increase it
+	defSniffPeekSize = 16
+	// sniffRetryPeriod the socket stays readable while the peeked bytes are pending, so the next bytes are polled
+	sniffRetryPeriod = 10 * time.Millisecond
+)
+
+// Protocols recognized by the sniffing, ProtocolAny matches every connection including the ones
+// which send nothing until the timeout, e.g. the server-first protocols.
+const (
+	ProtocolTls   = "tls"
+	ProtocolHttp  = "http"
+	ProtocolSsh   = "ssh"
+	ProtocolProxy = "proxy"
+	ProtocolAny   = "any"
+)
+
+// SniffRule routes the connections of the built-in protocol, or the ones which start with the Pattern when it's set,
+// then Protocol is just the name of the user-defined protocol. Backend is the group of the matched connections, the default group of the frontend is used when it isn't set.
+// TerminateTls makes the frontend run the TLS handshake before proxying.
+type SniffRule struct {
+	Protocol     string
+	Pattern      []byte
+	Backend      string
+	TerminateTls bool
+}
+
+// SniffConfig enables the protocol sniffing of the frontend. The rules are checked in order against the first
+// bytes of the connection, the connection which doesn't match any of them is closed.
+type SniffConfig struct {
+	Timeout    time.Duration
+	MaxPending int
+	Rules      []SniffRule
+}
+
+type sniffResult int
+
+const (
+	sniffMismatch sniffResult = iota
+	sniffMatch
+	sniffMore
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+var sshPrefix = [][]byte{[]byte("SSH-")}
+var proxyPrefixes = [][]byte{
+	[]byte("PROXY "),
+	{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A},
+}
+
+// tlsHello is the handshake record of SSL 3 or TLS 1.x which carries ClientHello
+var tlsHello = []struct {
+	offset int
+	value  byte
+}{{0, 0x16}, {1, 0x03}, {5, 0x01}}
+
+func (r *SniffRule) match(data []byte) sniffResult {
+	if len(r.Pattern) > 0 {
+		return matchPrefix(data, r.Pattern)
+	}
+	switch r.Protocol {
+	case ProtocolTls:
+		for _, b := range tlsHello {
+			if len(data) <= b.offset {
+				return sniffMore
+			}
+			if data[b.offset] != b.value {
+				return sniffMismatch
+			}
+		}
+		return sniffMatch
+	case ProtocolHttp:
+		return matchPrefixes(data, httpMethods)
+	case ProtocolSsh:
+		return matchPrefixes(data, sshPrefix)
+	case ProtocolProxy:
+		return matchPrefixes(data, proxyPrefixes)
+	case ProtocolAny:
+		return sniffMatch
+	}
+	return sniffMismatch
+}
+
+func (r *SniffRule) valid() bool {
+	if len(r.Pattern) > 0 {
+		return true
+	}
+	switch r.Protocol {
+	case ProtocolTls, ProtocolHttp, ProtocolSsh, ProtocolProxy, ProtocolAny:
+		return true
+	}
+	return false
+}
+
+func matchPrefix(data, prefix []byte) sniffResult {
+	if len(data) < len(prefix) {
+		if bytes.HasPrefix(prefix, data) {
+			return sniffMore
+		}
+		return sniffMismatch
+	}
+	if bytes.HasPrefix(data, prefix) {
+		return sniffMatch
+	}
+	return sniffMismatch
+}
+
+func matchPrefixes(data []byte, prefixes [][]byte) sniffResult {
+	result := sniffMismatch
+	for _, prefix := range prefixes {
+		switch matchPrefix(data, prefix) {
+		case sniffMatch:
+			return sniffMatch
+		case sniffMore:
+			result = sniffMore
+		}
+	}
+	return result
+}
+
+// sniff Returns the first matched rule, more is true when the earlier rule needs more bytes to decide.
+// The final check treats the rules which need more bytes as mismatched.
+func sniff(rules []SniffRule, data []byte, final bool) (rule *SniffRule, more bool) {
+	for i := range rules {
+		switch rules[i].match(data) {
+		case sniffMatch:
+			return &rules[i], false
+		case sniffMore:
+			if !final {
+				return nil, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// sniffer peeks at the first bytes of the accepted connections in the bounded number of goroutines. The bytes
+// are left in the socket, so the connection is served from the start by the TLS handshake or by the session.
+type sniffer struct {
+	name     string
+	timeout  time.Duration
+	rules    []SniffRule
+	peekSize int
+	slots    chan struct{}
+	done     func(conn net.Conn, rule *SniffRule)
+}
+
+func newSniffer(name string, config SniffConfig, done func(conn net.Conn, rule *SniffRule)) (*sniffer, error) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defSniffTimeout
+	}
+	maxPending := config.MaxPending
+	if maxPending <= 0 {
+		maxPending = defMaxSniffs
+	}
+	peekSize := defSniffPeekSize
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if !rule.valid() {
+			return nil, unknownProtocol
+		}
+		if len(rule.Pattern) > peekSize {
+			peekSize = len(rule.Pattern)
+		}
+	}
+	return &sniffer{
+		name:     name,
+		timeout:  timeout,
+		rules:    config.Rules,
+		peekSize: peekSize,
+		slots:    make(chan struct{}, maxPending),
+		done:     done,
+	}, nil
+}
+
+// submit Starts the sniffing of the connection, the connection is closed when too many connections are sniffed.
+func (s *sniffer) submit(conn net.Conn) {
+	select {
+	case s.slots <- struct{}{}:
+		go s.detect(conn)
+	default:
+		log.Warn().Msgf("[%s] too many connections are sniffed, reject connection from: %s", s.name, conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+func (s *sniffer) detect(conn net.Conn) {
+	defer func() { <-s.slots }()
+	rule, err := s.peek(conn)
+	if err != nil {
+		log.Info().Msgf("[%s] can't sniff connection from %s: %+v", s.name, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if rule == nil {
+		log.Info().Msgf("[%s] connection from %s doesn't match any protocol", s.name, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if log.Debug().Enabled() {
+		log.Debug().Msgf("[%s] connection from %s is sniffed as %s", s.name, conn.RemoteAddr(), rule.Protocol)
+	}
+	s.done(conn, rule)
+}
+
+// peek Peeks at the pending bytes of the connection until the rule is matched, the peek buffer is full or the timeout expires.
+func (s *sniffer) peek(conn net.Conn) (*SniffRule, error) {
+	fd, _, err := ConnToFileDesc(conn)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, s.peekSize)
+	deadline := time.Now().Add(s.timeout)
+	n := 0
+	for {
+		rule, more := sniff(s.rules, buf[:n], n == len(buf))
+		if !more {
+			return rule, nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			rule, _ = sniff(s.rules, buf[:n], true)
+			return rule, nil
+		}
+		if n == 0 {
+			err = waitReadable(fd, left)
+		} else {
+			time.Sleep(minDuration(sniffRetryPeriod, left))
+		}
+		if err != nil {
+			return nil, err
+		}
+		var peeked int
+		peeked, _, err = unix.Recvfrom(fd, buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		switch {
+		case err == unix.EAGAIN || err == unix.EINTR:
+			err = nil
+		case err != nil:
+			return nil, os.NewSyscallError("recvfrom", err)
+		case peeked == 0:
+			return nil, io.EOF
+		default:
+			n = peeked
+		}
+	}
+}
+
+// waitReadable Waits until the fd is readable or the timeout expires, the expired timeout isn't an error.
+func waitReadable(fd int, timeout time.Duration) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	_, err := unix.Poll(fds, int((timeout+time.Millisecond-1)/time.Millisecond))
+	if err != nil && err != unix.EINTR {
+		return os.NewSyscallError("poll", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package dynproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniff(t *testing.T) {
+	rules := []SniffRule{
+		{Protocol: ProtocolTls},
+		{Protocol: ProtocolHttp},
+		{Protocol: ProtocolSsh},
+		{Protocol: ProtocolProxy},
+		{Protocol: "redis", Pattern: []byte("*1\r\n")},
+	}
+	tests := []struct {
+		data     string
+		final    bool
+		protocol string
+		more     bool
+	}{
+		{data: "\x16\x03\x01\x02\x00\x01", protocol: ProtocolTls},
+		{data: "\x16\x03\x01", more: true},
+		{data: "\x16\x03\x01\x02\x00\x02"},
+		{data: "GET / HTTP/1.1\r\n", protocol: ProtocolHttp},
+		{data: "OPTI", more: true},
+		{data: "OPTI", final: true},
+		{data: "SSH-2.0-OpenSSH\r\n", protocol: ProtocolSsh},
+		{data: "PROXY TCP4 ", protocol: ProtocolProxy},
+		{data: "\r\n\r\n\x00\r\nQUIT\n\x21", protocol: ProtocolProxy},
+		{data: "*1\r\n$4\r\nPING\r\n", protocol: "redis"},
+		{data: "HELLO"},
+	}
+	for _, test := range tests {
+		rule, more := sniff(rules, []byte(test.data), test.final)
+		protocol := ""
+		if rule != nil {
+			protocol = rule.Protocol
+		}
+		if protocol != test.protocol || more != test.more {
+			t.Errorf("%q is sniffed as %q, more: %v", test.data, protocol, more)
+		}
+	}
+	_, err := newSniffer("test", SniffConfig{Rules: []SniffRule{{Protocol: "redis"}}}, nil)
+	if err != unknownProtocol {
+		t.Fatalf("expected unknown protocol error, got: %+v", err)
+	}
+}
+
+func TestFrontendSniff(t *testing.T) {
+	for _, engineName := range testEngines {
+		t.Run(engineName, func(t *testing.T) {
+			var engine Engine
+			if engineName == GoroutineEngine {
+				engine = NewGoroutineEngine(EventLoopConfig{Name: "TestEngine"})
+			} else {
+				eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: engineName})
+				if err != nil {
+					t.Fatalf("can't create event loop: %+v", err)
+				}
+				if eventLoop.PollerName() != engineName {
+					eventLoop.Stop()
+					t.Skipf("%s poller isn't available", engineName)
+				}
+				engine = eventLoop
+			}
+			go engine.Start(NewBufferHandler(), NewMapSessionProvider(context.Background()))
+			defer engine.Stop()
+			connChannel := make(chan *newConn, 4)
+			frontend := &Frontend{
+				Name:            "TestFrontend",
+				Net:             "tcp",
+				Address:         "127.0.0.1:0",
+				defaultBalancer: "default",
+				connChannel:     connChannel,
+				engine:          engine,
+				Sniff: &SniffConfig{
+					Timeout: 300 * time.Millisecond,
+					Rules: []SniffRule{
+						{Protocol: ProtocolHttp, Backend: "web"},
+						{Protocol: ProtocolSsh, Backend: "ssh"},
+						{Protocol: ProtocolAny},
+					},
+				},
+			}
+			err := frontend.Listen()
+			if err != nil {
+				t.Fatalf("can't listen frontend: %+v", err)
+			}
+			defer frontend.Close()
+
+			tests := []struct {
+				chunks  []string
+				backend string
+			}{
+				{chunks: []string{"GET / HTTP/1.1\r\n"}, backend: "web"},
+				// the partial banner waits for the next bytes
+				{chunks: []string{"SS", "H-2.0-client\r\n"}, backend: "ssh"},
+				// the silent client is routed by the fallback rule after the timeout
+				{chunks: []string{""}, backend: "default"},
+			}
+			for _, test := range tests {
+				conn, err := net.Dial("tcp", frontend.Addr().String())
+				if err != nil {
+					t.Fatalf("can't connect to frontend: %+v", err)
+				}
+				sent := ""
+				for _, chunk := range test.chunks {
+					conn.Write([]byte(chunk))
+					sent += chunk
+					time.Sleep(50 * time.Millisecond)
+				}
+				select {
+				case accepted := <-connChannel:
+					if accepted.backend != test.backend {
+						t.Fatalf("%q is routed to %s instead of %s", sent, accepted.backend, test.backend)
+					}
+					// the sniffed bytes aren't consumed
+					accepted.frontend.SetDeadline(time.Now().Add(5 * time.Second))
+					data := make([]byte, len(sent))
+					_, err = io.ReadFull(accepted.frontend, data)
+					if err != nil || string(data) != sent {
+						t.Fatalf("unexpected bytes %q after sniffing: %+v", data, err)
+					}
+					accepted.frontend.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q isn't routed", sent)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
@@ -7,7 +7,16 @@ import (
 	"syscall"
 )
 
-func setSocketOptions(conn net.Conn) int {
+const defSocketBufferSize = 8192
+
+// SocketBuffers sizes of the kernel socket buffers, zero keeps the default of the proxy
+// and negative size leaves the buffer to the kernel autotuning.
+type SocketBuffers struct {
+	RcvBuf int
+	SndBuf int
+}
+
+func setSocketOptions(conn net.Conn, buffers SocketBuffers) int {
 	fd, connType, err := ConnToFileDesc(conn)
 	if err != nil {
 		log.Error().Msgf("error occur while getting file descriptor from connection:%+v", err)
@@ -15,28 +24,27 @@ func setSocketOptions(conn net.Conn) int {
 	}
 	switch connType {
 	case TCP:
-		setTcpSocketOptions(fd)
+		setTcpSocketOptions(fd, buffers)
 	case TLS:
-		setTlsSocketOptions(fd)
+		if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+			setSocketBuffers(fd, buffers)
+			break
+		}
+		setTlsSocketOptions(fd, buffers)
+	case UDP, UNIX:
+		setSocketBuffers(fd, buffers)
 	case UNKNOWN:
 		log.Error().Msg("error occur while setting socket options for unknown connection type")
 	}
 	return fd
 }
 
-func setTcpSocketOptions(fd int) {
+func setTcpSocketOptions(fd int, buffers SocketBuffers) {
 	err := unix.SetNonblock(fd, true)
 	if err != nil {
 		log.Error().Msgf("got error while setting socket options O_NONBLOCK: %+v", err)
 	}
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 8192)
-	if err != nil {
-		log.Error().Msgf("got error while setting socket options SO_RCVBUF: %+v", err)
-	}
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 8192)
-	if err != nil {
-		log.Error().Msgf("got error while setting socket options SO_SNDBUF: %+v", err)
-	}
+	setSocketBuffers(fd, buffers)
 	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
 	if err != nil {
 		log.Error().Msgf("got error while setting socket options SO_REUSEADDR: %+v", err)
@@ -55,19 +63,12 @@ func setTcpSocketOptions(fd int) {
 	}
 }
 
-func setTlsSocketOptions(fd int) {
+func setTlsSocketOptions(fd int, buffers SocketBuffers) {
 	err := unix.SetNonblock(fd, true)
 	if err != nil {
 		log.Error().Msgf("got error while setting socket options O_NONBLOCK: %+v", err)
 	}
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 8192)
-	if err != nil {
-		log.Error().Msgf("got error while setting socket options SO_RCVBUF: %+v", err)
-	}
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 8192)
-	if err != nil {
-		log.Error().Msgf("got error while setting socket options SO_SNDBUF: %+v", err)
-	}
+	setSocketBuffers(fd, buffers)
 	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU, 0)
 	if err != nil {
 		log.Error().Msgf("got error while setting socket options SO_INCOMING_CPU: %+v", err)
@@ -89,3 +90,21 @@ func setTlsSocketOptions(fd int) {
 		log.Error().Msgf("got error while setting socket options SO_LINGER: %+v", err)
 	}
 }
+
+func setSocketBuffers(fd int, buffers SocketBuffers) {
+	setSocketBuffer(fd, syscall.SO_RCVBUF, "SO_RCVBUF", buffers.RcvBuf)
+	setSocketBuffer(fd, syscall.SO_SNDBUF, "SO_SNDBUF", buffers.SndBuf)
+}
+
+func setSocketBuffer(fd int, option int, name string, size int) {
+	if size < 0 {
+		return
+	}
+	if size == 0 {
+		size = defSocketBufferSize
+	}
+	err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, option, size)
+	if err != nil {
+		log.Error().Msgf("got error while setting socket options %s: %+v", name, err)
+	}
+}
@@ -0,0 +1,96 @@
+package dynproxy
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+const (
+	spliceChunkSize = 64 * 1024
+	spliceFlags     = unix.SPLICE_F_MOVE | unix.SPLICE_F_NONBLOCK
+)
+
+// splicePipe keeps the bytes of one session direction in kernel space between splice(2) calls.
+type splicePipe struct {
+	r       int
+	w       int
+	pending int
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	var fds [2]int
+	err := unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	return &splicePipe{r: fds[0], w: fds[1]}, nil
+}
+
+// spliceFrom Moves up to size available bytes of the socket into the pipe, returns io.EOF when the peer finished sending.
+func (p *splicePipe) spliceFrom(fd int, size int) (int, error) {
+	for {
+		n, err := unix.Splice(fd, nil, p.w, nil, size, spliceFlags)
+		switch err {
+		case nil:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			p.pending += int(n)
+			return int(n), nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		case unix.EINVAL, unix.ENOSYS:
+			return 0, spliceUnsupported
+		default:
+			return 0, os.NewSyscallError("splice", err)
+		}
+	}
+}
+
+// spliceTo Moves the pending bytes of the pipe to the socket until the pipe is empty or the socket is full.
+func (p *splicePipe) spliceTo(fd int) (int, error) {
+	written := 0
+	for p.pending > 0 {
+		n, err := unix.Splice(p.r, nil, fd, nil, p.pending, spliceFlags)
+		switch err {
+		case nil:
+			p.pending -= int(n)
+			written += int(n)
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return written, nil
+		default:
+			return written, os.NewSyscallError("splice", err)
+		}
+	}
+	return written, nil
+}
+
+// drainTo Reads the pending bytes of the pipe to the write buffer.
+func (p *splicePipe) drainTo(buffer *writeBuffer) error {
+	chunk := make([]byte, 4096)
+	for p.pending > 0 {
+		n, err := unix.Read(p.r, chunk)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+		if n == 0 {
+			break
+		}
+		buffer.Append(chunk[:n])
+		p.pending -= n
+	}
+	return nil
+}
+
+func (p *splicePipe) close() {
+	unix.Close(p.r)
+	unix.Close(p.w)
+}
@@ -1,5 +1,7 @@
 package dynproxy
 
+import "time"
+
 type StatsManager struct {
 	MemoryUsage int32
 	CPUUsage    float32
@@ -9,8 +11,30 @@ type StatsManager struct {
 }
 
 type ActiveStats struct {
-	FrontendsStats map[string]FrontendStats
-	BalancersStats map[string]BalancerStats
+	FrontendsStats  map[string]FrontendStats
+	BalancersStats  map[string]BalancerStats
+	EventLoopsStats map[string]EventLoopStats
+}
+
+// EventLoopStats load of the event loop, the loop is saturated when BusyTime grows as fast as Uptime.
+// LagHistogram counts the handlers by the time passed since the poller woke up until the handler start.
+type EventLoopStats struct {
+	Name               string
+	Uptime             time.Duration
+	Wakeups            uint64
+	Events             uint64
+	MaxEventsPerWakeup uint64
+	BusyTime           time.Duration
+	MaxBusyTime        time.Duration
+	LagHistogram       []LagBucket
+	TaskQueueDepth     int
+	MaxTaskQueueDepth  int
+	RegisteredFds      int
+}
+
+type LagBucket struct {
+	UpperBound time.Duration
+	Count      uint64
 }
 
 type FrontendStats struct {
@@ -21,13 +45,32 @@ type FrontendStats struct {
 	TotalSentBytes     uint64
 	TotalReceivedBytes uint64
 	Bandwidth          float64
+	Handshakes         HandshakeStats
+	// ThrottledTime total time the reads of the sessions were paused by the rate limits
+	ThrottledTime time.Duration
+}
+
+// HandshakeStats outcomes of the TLS handshakes, Alerts counts the alerts received from the clients by description.
+type HandshakeStats struct {
+	Succeeded uint64
+	TimedOut  uint64
+	Failed    uint64
+	Rejected  uint64
+	Alerts    map[string]uint64
 }
 
 type SessionStats struct {
 	Name               string
+	Identity           SessionIdentity
 	LastActivityTime   int64
 	TotalSentBytes     uint64
 	TotalReceivedBytes uint64
+	// CloseReason is the error the session was closed with, nil while it's open
+	CloseReason error
+	// ThrottledTime the reads of the session were paused by the rate limits
+	ThrottledTime time.Duration
+	// DroppedDatagrams the datagrams of the UDP session which weren't sent because the socket buffer was full
+	DroppedDatagrams uint64
 }
 
 type BalancerStats struct {
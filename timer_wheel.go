@@ -0,0 +1,222 @@
+package dynproxy
+
+import (
+	"time"
+)
+
+const (
+	defTimerTick = 10 * time.Millisecond
+	wheelLevels  = 4
+	wheelBits    = 6
+	wheelSlots   = 1 << wheelBits
+	wheelMask    = wheelSlots - 1
+	// wheelRange the number of ticks covered by all levels, farther timers are cascaded more than once
+	wheelRange = 1 << (wheelBits * wheelLevels)
+)
+
+// Timer is scheduled by the event loop, the callback runs on the event loop thread.
+type Timer struct {
+	expires  uint64
+	callback func()
+	list     *timerList
+	prev     *Timer
+	next     *Timer
+	// timer is used instead of the wheel by the goroutine engine
+	timer *time.Timer
+}
+
+// Active Returns true until the timer is fired or cancelled.
+func (t *Timer) Active() bool {
+	return t != nil && (t.list != nil || t.timer != nil)
+}
+
+type timerList struct {
+	head *Timer
+}
+
+func (l *timerList) push(t *Timer) {
+	t.list = l
+	t.prev = nil
+	t.next = l.head
+	if l.head != nil {
+		l.head.prev = t
+	}
+	l.head = t
+}
+
+func (l *timerList) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.head = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.list, t.prev, t.next = nil, nil, nil
+}
+
+func (l *timerList) take() *Timer {
+	head := l.head
+	l.head = nil
+	return head
+}
+
+// timerWheel is a hierarchical timer wheel: every level has 64 slots and each slot of the level covers
+// 64 slots of the previous level. Timers of the upper levels are cascaded down as the time goes.
+// It isn't thread safe and is used only by the event loop thread.
+type timerWheel struct {
+	tick    time.Duration
+	start   time.Time
+	current uint64
+	count   int
+	slots   [wheelLevels][wheelSlots]timerList
+}
+
+func newTimerWheel(tick time.Duration, now time.Time) *timerWheel {
+	if tick <= 0 {
+		tick = defTimerTick
+	}
+	return &timerWheel{
+		tick:  tick,
+		start: now,
+	}
+}
+
+func (w *timerWheel) schedule(now time.Time, delay time.Duration, callback func()) *Timer {
+	if delay < 0 {
+		delay = 0
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	timer := &Timer{
+		// rounded up, so the timer never fires before the delay
+		expires:  uint64((elapsed + delay + w.tick - 1) / w.tick),
+		callback: callback,
+	}
+	w.add(timer)
+	w.count++
+	return timer
+}
+
+func (w *timerWheel) cancel(timer *Timer) {
+	if timer.Active() {
+		timer.list.remove(timer)
+		w.count--
+	}
+}
+
+func (w *timerWheel) add(timer *Timer) {
+	if timer.expires < w.current {
+		timer.expires = w.current
+	}
+	delta := timer.expires - w.current
+	expires := timer.expires
+	if delta >= wheelRange {
+		expires = w.current + wheelRange - 1
+		delta = wheelRange - 1
+	}
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	slot := (expires >> (wheelBits * level)) & wheelMask
+	w.slots[level][slot].push(timer)
+}
+
+// advance Fires the expired timers, returns the number of fired timers.
+func (w *timerWheel) advance(now time.Time) int {
+	target := w.ticks(now)
+	if w.count == 0 {
+		if target >= w.current {
+			w.current = target + 1
+		}
+		return 0
+	}
+	fired := 0
+	for tick := w.current; tick <= target && w.count > 0; tick++ {
+		w.current = tick
+		if tick&wheelMask == 0 {
+			w.cascade(tick)
+		}
+		timer := w.slots[0][tick&wheelMask].take()
+		// timers scheduled by the callbacks must not get into the slot being fired
+		w.current = tick + 1
+		for timer != nil {
+			next := timer.next
+			timer.list, timer.prev, timer.next = nil, nil, nil
+			w.count--
+			fired++
+			timer.callback()
+			timer = next
+		}
+	}
+	if target >= w.current {
+		w.current = target + 1
+	}
+	return fired
+}
+
+func (w *timerWheel) cascade(tick uint64) {
+	for level := 1; level < wheelLevels; level++ {
+		index := (tick >> (wheelBits * level)) & wheelMask
+		timer := w.slots[level][index].take()
+		for timer != nil {
+			next := timer.next
+			w.add(timer)
+			timer = next
+		}
+		if index != 0 {
+			break
+		}
+	}
+}
+
+// nextTimeout Returns msec until the nearest timer or cascade of the timers, blocked when there are no timers.
+func (w *timerWheel) nextTimeout(now time.Time) int {
+	if w.count == 0 {
+		return blocked
+	}
+	next := w.nextTick()
+	deadline := w.start.Add(time.Duration(next) * w.tick)
+	timeout := deadline.Sub(now)
+	if timeout <= 0 {
+		return nonBlocked
+	}
+	return int((timeout + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (w *timerWheel) nextTick() uint64 {
+	next := w.current + wheelRange
+	for i := uint64(0); i < wheelSlots; i++ {
+		tick := w.current + i
+		if w.slots[0][tick&wheelMask].head != nil {
+			next = tick
+			break
+		}
+	}
+	for level := 1; level < wheelLevels; level++ {
+		shift := uint64(wheelBits * level)
+		base := w.current >> shift
+		for i := uint64(1); i <= wheelSlots; i++ {
+			if w.slots[level][(base+i)&wheelMask].head != nil {
+				cascadeTick := (base + i) << shift
+				if cascadeTick < next {
+					next = cascadeTick
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+func (w *timerWheel) ticks(now time.Time) uint64 {
+	elapsed := now.Sub(w.start)
+	if elapsed < 0 {
+		return 0
+	}
+	return uint64(elapsed / w.tick)
+}
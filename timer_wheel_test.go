@@ -0,0 +1,64 @@
+package dynproxy
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTimerWheelFiresInOrder(t *testing.T) {
+	start := time.Now()
+	wheel := newTimerWheel(10*time.Millisecond, start)
+	delays := []time.Duration{0, 5 * time.Millisecond, 700 * time.Millisecond, 3 * time.Second, 50 * time.Second, 2 * time.Hour}
+	fired := make(map[int]time.Duration)
+	for i, delay := range delays {
+		i, delay := i, delay
+		wheel.schedule(start, delay, func() {
+			fired[i] = delay
+		})
+	}
+	now := start
+	for len(fired) < len(delays) {
+		timeout := wheel.nextTimeout(now)
+		if timeout == blocked {
+			t.Fatalf("wheel is empty, fired only %d timers", len(fired))
+		}
+		now = now.Add(time.Duration(timeout) * time.Millisecond)
+		before := len(fired)
+		wheel.advance(now)
+		for i := range fired {
+			if now.Sub(start) < delays[i] {
+				t.Fatalf("timer %d fired too early: %v < %v", i, now.Sub(start), delays[i])
+			}
+		}
+		if len(fired) > before && now.Sub(start) > delays[len(fired)-1]+wheel.tick {
+			t.Fatalf("timer %d fired too late: %v", len(fired)-1, now.Sub(start))
+		}
+	}
+	if wheel.nextTimeout(now) != blocked {
+		t.Fatal("wheel must be empty")
+	}
+}
+
+func TestTimerWheelCancel(t *testing.T) {
+	start := time.Now()
+	wheel := newTimerWheel(10*time.Millisecond, start)
+	fired := 0
+	timers := make([]*Timer, 0)
+	for i := 0; i < 1000; i++ {
+		delay := time.Duration(rand.Intn(100000)) * time.Millisecond
+		timers = append(timers, wheel.schedule(start, delay, func() { fired++ }))
+	}
+	for i, timer := range timers {
+		if i%2 == 0 {
+			wheel.cancel(timer)
+		}
+	}
+	wheel.advance(start.Add(101 * time.Second))
+	if fired != 500 {
+		t.Fatalf("expected 500 fired timers, got %d", fired)
+	}
+	if wheel.count != 0 {
+		t.Fatalf("expected empty wheel, got %d timers", wheel.count)
+	}
+}
@@ -0,0 +1,84 @@
+package dynproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// wouldBlockError is returned by loopConn when the socket has no data. crypto/tls treats temporary
+// net.Error as retryable and keeps the partially read records, so the read is continued on the next event.
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "operation would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+var errWouldBlock net.Error = wouldBlockError{}
+
+// loopConn is the transport of the TLS connections served by the event loop. The handshake runs over
+// the wrapped net.Conn, after switching to the loop mode the non-blocking fd is used directly: reads return
+// errWouldBlock instead of blocking and the ciphertext which can't be written is kept in the out buffer.
+type loopConn struct {
+	net.Conn
+	fd       int
+	loopMode bool
+	out      *writeBuffer
+}
+
+// tlsConn is the TLS connection over loopConn, so it can be moved to the event loop after the handshake.
+type tlsConn struct {
+	*tls.Conn
+	transport *loopConn
+}
+
+// newTlsServerConn Wraps the accepted TCP connection into the TLS server connection which can be moved to the event loop.
+func newTlsServerConn(conn net.Conn, config *tls.Config) (*tlsConn, error) {
+	fd, _, err := ConnToFileDesc(conn)
+	if err != nil {
+		return nil, err
+	}
+	lc := &loopConn{
+		Conn: conn,
+		fd:   fd,
+		out:  newWriteBuffer(defWriteHighWaterMark, defWriteLowWaterMark),
+	}
+	return &tlsConn{Conn: tls.Server(lc, config), transport: lc}, nil
+}
+
+// setLoopMode Switches the connection to the non-blocking I/O, it's called once the event loop owns the fd.
+func (c *loopConn) setLoopMode() {
+	c.Conn.SetDeadline(time.Time{})
+	c.loopMode = true
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	if !c.loopMode {
+		return c.Conn.Read(b)
+	}
+	n, err := readFd(c.fd, b)
+	if err == nil && n == 0 {
+		return 0, errWouldBlock
+	}
+	return n, err
+}
+
+// Write Never blocks in the loop mode, the rest of the data is written on write readiness. crypto/tls
+// treats every write error as fatal, so would-block can't be reported to it.
+func (c *loopConn) Write(b []byte) (int, error) {
+	if !c.loopMode {
+		return c.Conn.Write(b)
+	}
+	data := b
+	if c.out.Len() == 0 {
+		n, err := writeFd(c.fd, data)
+		if err != nil {
+			return 0, err
+		}
+		data = data[n:]
+	}
+	if len(data) > 0 {
+		c.out.Append(data)
+	}
+	return len(b), nil
+}
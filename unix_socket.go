@@ -0,0 +1,226 @@
+package dynproxy
+
+import (
+	"errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const staleSocketCheckTimeout = time.Second
+
+// UnixSocketConfig permissions and ownership of the socket file of the unix frontend. Owner and Group are
+// the names or the numeric ids, the empty values and zero Mode keep what the socket got on creation.
+type UnixSocketConfig struct {
+	Mode  os.FileMode
+	Owner string
+	Group string
+}
+
+// PeerCredentials of the process connected to the unix socket, they're taken by the kernel on connect.
+type PeerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// GetPeerCredentials Returns the credentials of the peer of the unix socket connection.
+func GetPeerCredentials(conn net.Conn) (PeerCredentials, error) {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); !ok {
+		return PeerCredentials{}, notUnixSocket
+	}
+	fd, _, err := ConnToFileDesc(conn)
+	if err != nil {
+		return PeerCredentials{}, err
+	}
+	ucred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return PeerCredentials{}, os.NewSyscallError("getsockopt", err)
+	}
+	return PeerCredentials{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
+
+// parseFileMode Parses the octal permissions like 0660, the empty string is zero mode.
+func parseFileMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(perm) & os.ModePerm, nil
+}
+
+// apply Sets the permissions and the ownership of the socket file.
+func (c UnixSocketConfig) apply(path string) error {
+	if c.Mode != 0 {
+		err := os.Chmod(path, c.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Owner == "" && c.Group == "" {
+		return nil
+	}
+	uid, err := lookupUid(c.Owner)
+	if err != nil {
+		return err
+	}
+	gid, err := lookupGid(c.Group)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// PeerRoute routes the connections of the unix socket peers to the backend group. Uid and Gid are the names
+// or the numeric ids, the empty one matches any peer.
+type PeerRoute struct {
+	Uid     string
+	Gid     string
+	Backend string
+}
+
+// peerRoute is the route with the resolved ids, -1 matches any id
+type peerRoute struct {
+	uid     int
+	gid     int
+	backend string
+}
+
+// resolvePeerRoutes Looks up the user and group names of the routes.
+func resolvePeerRoutes(routes []PeerRoute) ([]peerRoute, error) {
+	resolved := make([]peerRoute, 0, len(routes))
+	for _, route := range routes {
+		uid, err := lookupUid(route.Uid)
+		if err != nil {
+			return nil, err
+		}
+		gid, err := lookupGid(route.Gid)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, peerRoute{uid: uid, gid: gid, backend: route.Backend})
+	}
+	return resolved, nil
+}
+
+// routeByPeer Returns the backend group of the first route matched by the credentials of the peer,
+// the group is kept when no route matches or the connection isn't over the unix socket.
+func routeByPeer(routes []peerRoute, conn net.Conn, backend string) string {
+	cred, err := GetPeerCredentials(conn)
+	if err != nil {
+		return backend
+	}
+	for _, route := range routes {
+		if (route.uid < 0 || uint32(route.uid) == cred.Uid) && (route.gid < 0 || uint32(route.gid) == cred.Gid) {
+			return route.backend
+		}
+	}
+	return backend
+}
+
+// lookupUid Returns the id of the user, -1 for the empty name.
+func lookupUid(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	return lookupId(name, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+// lookupGid Returns the id of the group, -1 for the empty name.
+func lookupGid(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	return lookupId(name, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// lookupId Returns the numeric id as is, the names are looked up.
+func lookupId(name string, lookup func(name string) (string, error)) (int, error) {
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+	value, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(value)
+}
+
+// removeStaleSocket Removes the socket file left by the process which didn't close its listener, the socket
+// is stale when nobody accepts the connections on it. The socket in use and the other files aren't touched.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return notSocketFile
+	}
+	conn, err := net.DialTimeout("unix", path, staleSocketCheckTimeout)
+	if err == nil {
+		conn.Close()
+		return socketInUse
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	log.Info().Msgf("remove stale socket: %s", path)
+	return os.Remove(path)
+}
+
+// listenUnix Opens the non-blocking listening unix socket.
+func listenUnix(path string) (int, net.Addr, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, os.NewSyscallError("socket", err)
+	}
+	err = os.NewSyscallError("bind", unix.Bind(fd, &unix.SockaddrUnix{Name: path}))
+	if err == nil {
+		err = os.NewSyscallError("listen", unix.Listen(fd, unix.SOMAXCONN))
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	return fd, &net.UnixAddr{Name: path, Net: "unix"}, nil
+}
+
+// dialUnix Starts connecting the non-blocking unix socket, the connection owns the fd.
+func dialUnix(path string, timeout time.Duration) (*fdConn, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	conn := newFdConn(fd, addr)
+	err = conn.startConnect(&unix.SockaddrUnix{Name: path}, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "unix", Addr: addr, Err: os.NewSyscallError("connect", err)}
+	}
+	return conn, nil
+}
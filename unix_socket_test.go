@@ -0,0 +1,170 @@
+package dynproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startUnixEchoServer Returns the unix socket listener which sends the received bytes back.
+func startUnixEchoServer(t *testing.T, path string) net.Listener {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("can't listen unix echo server: %+v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "live.sock")
+	live := startUnixEchoServer(t, path)
+	defer live.Close()
+	if err := removeStaleSocket(path); err != socketInUse {
+		t.Fatalf("expected socket in use error, got: %+v", err)
+	}
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0600)
+	if err := removeStaleSocket(file); err != notSocketFile {
+		t.Fatalf("expected not socket error, got: %+v", err)
+	}
+	stalePath := filepath.Join(dir, "stale.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("can't listen: %+v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if err := removeStaleSocket(stalePath); err != nil {
+		t.Fatalf("can't remove stale socket: %+v", err)
+	}
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Fatalf("stale socket isn't removed: %+v", err)
+	}
+}
+
+func TestUnixFrontend(t *testing.T) {
+	dir := t.TempDir()
+	backend := startUnixEchoServer(t, filepath.Join(dir, "backend.sock"))
+	defer backend.Close()
+	balancers = map[string]*Balancer{
+		"unix":  {Name: "unix", Backends: []*Backend{{Name: "unix-echo", Net: "unix", Address: backend.Addr().String(), Status: enabled}}},
+		"group": {Name: "group", Backends: []*Backend{{Name: "group-echo", Net: "unix", Address: backend.Addr().String(), Status: enabled}}},
+	}
+	defer func() {
+		balancers = nil
+	}()
+
+	for _, engineName := range testEngines {
+		t.Run(engineName, func(t *testing.T) {
+			var engine Engine
+			if engineName == GoroutineEngine {
+				engine = NewGoroutineEngine(EventLoopConfig{Name: "TestEngine"})
+			} else {
+				eventLoop, err := NewEventLoop(EventLoopConfig{Name: "TestLoop", EventBufferSize: 256, Poller: engineName})
+				if err != nil {
+					t.Fatalf("can't create event loop: %+v", err)
+				}
+				if eventLoop.PollerName() != engineName {
+					eventLoop.Stop()
+					t.Skipf("%s poller isn't available", engineName)
+				}
+				engine = eventLoop
+			}
+			holder := NewMapSessionProvider(context.Background())
+			go engine.Start(NewBufferHandler(), holder)
+			defer engine.Stop()
+			connChannel := make(chan *newConn, 4)
+			path := filepath.Join(dir, engineName+".sock")
+			frontend := &Frontend{
+				Name:            "TestFrontend",
+				Net:             "unix",
+				Address:         path,
+				defaultBalancer: "unix",
+				connChannel:     connChannel,
+				engine:          engine,
+				SessionConfig:   ProxySessionConfig{Frontend: "TestFrontend", SpliceEnabled: true},
+				UnixSocket:      UnixSocketConfig{Mode: 0600},
+				// the connections of the test process are routed by its credentials
+				PeerRoutes: []PeerRoute{
+					{Uid: strconv.Itoa(os.Getuid() + 1), Backend: "unix"},
+					{Uid: strconv.Itoa(os.Getuid()), Gid: strconv.Itoa(os.Getgid()), Backend: "group"},
+				},
+			}
+			err := frontend.Listen()
+			if err != nil {
+				t.Fatalf("can't listen frontend: %+v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.Mode().Perm() != 0600 {
+				t.Fatalf("unexpected socket permissions: %+v", err)
+			}
+			// the manager creates the session for the accepted connection
+			go func() {
+				for accepted := range connChannel {
+					backend, backendConn, err := getConnByBalancerName(accepted.backend, engine.Dial)
+					if err != nil {
+						t.Errorf("can't connect to backend: %+v", err)
+						accepted.frontend.Close()
+						continue
+					}
+					sessionConfig := accepted.sessionConfig
+					sessionConfig.Backend = backend.Name
+					session, err := NewProxySession(accepted.frontend, backendConn, nil, sessionConfig)
+					if err != nil {
+						t.Errorf("can't create proxy session: %+v", err)
+						continue
+					}
+					engine.Serve(session)
+				}
+			}()
+			defer close(connChannel)
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("can't connect to frontend: %+v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = roundTrip(conn, []byte("hello"), make([]byte, 5))
+			if err != nil {
+				t.Fatalf("round trip failed: %+v", err)
+			}
+			sessions := holder.ListSessions()
+			if len(sessions) != 1 {
+				t.Fatalf("expected 1 session, got: %d", len(sessions))
+			}
+			identity := sessions[0].Identity
+			if identity.PeerUid != strconv.Itoa(os.Getuid()) || identity.PeerPid != strconv.Itoa(os.Getpid()) || identity.Backend != "group-echo" {
+				t.Fatalf("unexpected identity of unix session: %+v", identity)
+			}
+
+			frontend.Close()
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if _, err = os.Stat(path); os.IsNotExist(err) {
+					break
+				}
+			}
+			if !os.IsNotExist(err) {
+				t.Fatalf("socket file isn't removed on close: %+v", err)
+			}
+		})
+	}
+}
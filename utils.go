@@ -1,12 +1,13 @@
 package dynproxy
 
 import (
-	"crypto/tls"
 	"errors"
+	"golang.org/x/sys/unix"
+	"io"
 	"net"
 	"os"
-	"reflect"
-	"unsafe"
+	"syscall"
+	"time"
 )
 
 const (
@@ -14,43 +15,146 @@ const (
 	TCP
 	TLS
 	UDP
+	UNIX
 )
 
-type FileDesc interface {
-	File() (f *os.File, err error)
-}
-
 type ConnType int
 
-func tlsConnToFileDesc(tlsConn *tls.Conn) FileDesc {
-	// XXX: This is really BAD!!! Only way currently to get the underlying
-	// connection of the tls.Conn. At least until
-	// https://github.com/golang/go/issues/29257 is solved.
-	conn := reflect.ValueOf(tlsConn).Elem().FieldByName("conn")
-	conn = reflect.NewAt(conn.Type(), unsafe.Pointer(conn.UnsafeAddr())).Elem()
-	return conn.Interface().(FileDesc)
-}
-
+// ConnToFileDesc Returns the fd of the connection without duplication. The connection stays the only owner
+// of the fd, so the fd is valid exactly as long as the connection isn't closed.
 func ConnToFileDesc(conn net.Conn) (int, ConnType, error) {
-	tcpConn, ok := conn.(*net.TCPConn)
-	if ok {
-		file, err := tcpConn.File()
+	switch c := conn.(type) {
+	case *fdConn:
+		switch c.remote.(type) {
+		case *net.UDPAddr:
+			return c.fd, UDP, nil
+		case *net.UnixAddr:
+			return c.fd, UNIX, nil
+		}
+		return c.fd, TCP, nil
+	case *tlsConn:
+		return c.transport.fd, TLS, nil
+	case *net.TCPConn:
+		fd, err := rawConnFd(c)
 		if err != nil {
 			return 0, TCP, err
 		}
-		return int(file.Fd()), TCP, nil
-	} else {
-		tls, ok := conn.(*tls.Conn)
-		if ok {
-			conn := reflect.ValueOf(tls).Elem().FieldByName("conn")
-			conn = reflect.NewAt(conn.Type(), unsafe.Pointer(conn.UnsafeAddr())).Elem()
-			fileDesc := conn.Interface().(FileDesc)
-			file, err := fileDesc.File()
-			if err != nil {
-				return 0, TLS, err
+		return fd, TCP, nil
+	case *net.UDPConn:
+		fd, err := rawConnFd(c)
+		if err != nil {
+			return 0, UDP, err
+		}
+		return fd, UDP, nil
+	case *net.UnixConn:
+		fd, err := rawConnFd(c)
+		if err != nil {
+			return 0, UNIX, err
+		}
+		return fd, UNIX, nil
+	}
+	return 0, UNKNOWN, errors.New("can't get fd of the connection")
+}
+
+func rawConnFd(conn syscall.Conn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	err = rawConn.Control(func(sysFd uintptr) {
+		fd = int(sysFd)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// readFd Reads the non-blocking fd, returns 0 bytes without error when there is no data and io.EOF when the peer finished sending.
+func readFd(fd int, buffer []byte) (int, error) {
+	for {
+		n, err := unix.Read(fd, buffer)
+		switch err {
+		case nil:
+			if n == 0 {
+				return 0, io.EOF
 			}
-			return int(file.Fd()), TLS, nil
+			return n, nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		default:
+			return 0, os.NewSyscallError("read", err)
 		}
 	}
-	return 0, UNKNOWN, errors.New("can't cast net.Conn to *net.TCPConn")
+}
+
+// readvFd Reads the non-blocking fd into the buffers with one syscall, the results are the same as of readFd.
+func readvFd(fd int, buffers [][]byte) (int, error) {
+	for {
+		n, err := unix.Readv(fd, buffers)
+		switch err {
+		case nil:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		default:
+			return 0, os.NewSyscallError("readv", err)
+		}
+	}
+}
+
+// writevFd Writes the buffers to the non-blocking fd with one syscall, returns 0 bytes without error when the socket buffer is full.
+func writevFd(fd int, buffers [][]byte) (int, error) {
+	for {
+		n, err := unix.Writev(fd, buffers)
+		switch err {
+		case nil:
+			return n, nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		default:
+			return 0, os.NewSyscallError("writev", err)
+		}
+	}
+}
+
+// writeFd Writes the non-blocking fd, returns 0 bytes without error when the socket buffer is full.
+func writeFd(fd int, data []byte) (int, error) {
+	for {
+		n, err := unix.Write(fd, data)
+		switch err {
+		case nil:
+			return n, nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		default:
+			return 0, os.NewSyscallError("write", err)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
 }
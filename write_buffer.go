@@ -0,0 +1,65 @@
+package dynproxy
+
+const (
+	defWriteHighWaterMark = 64 * 1024
+	defWriteLowWaterMark  = 16 * 1024
+)
+
+// writeBuffer keeps the bytes which couldn't be written to a non-blocking socket yet.
+type writeBuffer struct {
+	buf       []byte
+	offset    int
+	highWater int
+	lowWater  int
+}
+
+func newWriteBuffer(highWater, lowWater int) *writeBuffer {
+	if highWater <= 0 {
+		highWater = defWriteHighWaterMark
+	}
+	if lowWater <= 0 || lowWater > highWater {
+		lowWater = highWater / 4
+	}
+	return &writeBuffer{
+		highWater: highWater,
+		lowWater:  lowWater,
+	}
+}
+
+func (b *writeBuffer) Len() int {
+	return len(b.buf) - b.offset
+}
+
+func (b *writeBuffer) Bytes() []byte {
+	return b.buf[b.offset:]
+}
+
+func (b *writeBuffer) Append(data []byte) {
+	if b.offset > 0 && b.offset >= len(b.buf)/2 {
+		n := copy(b.buf, b.buf[b.offset:])
+		b.buf = b.buf[:n]
+		b.offset = 0
+	}
+	b.buf = append(b.buf, data...)
+}
+
+func (b *writeBuffer) Consume(n int) {
+	b.offset += n
+	if b.offset >= len(b.buf) {
+		b.offset = 0
+		if cap(b.buf) > b.highWater {
+			// don't keep the memory of the burst for the whole session lifetime
+			b.buf = nil
+		} else {
+			b.buf = b.buf[:0]
+		}
+	}
+}
+
+func (b *writeBuffer) AboveHighWater() bool {
+	return b.Len() >= b.highWater
+}
+
+func (b *writeBuffer) BelowLowWater() bool {
+	return b.Len() <= b.lowWater
+}